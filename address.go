@@ -0,0 +1,222 @@
+package gsr
+
+// Endpoint addresses are stored as a single segment of an etcd key. The
+// following forms are accepted:
+//
+// 10.0.0.1                      host only
+// 10.0.0.1:8080                 host and port
+// db.example.org:5432           hostname and port
+// [2001:db8::1]:443             IPv6 literals must be enclosed in brackets
+// http://10.0.0.1:8080/api      scheme, host, port and path
+// unix:///var/run/app.sock      unix socket path
+//
+// Unbracketed IPv6 literals, e.g. "2001:db8::1", are rejected because it is
+// not clear whether the last group is part of the address or a port. So are
+// addresses containing a "/" that have no scheme.
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const schemeUnix = "unix"
+
+// Address is the structured form of an endpoint's address.
+type Address struct {
+	// Scheme is optional, e.g. "http" or "grpc". It is always "unix" for a
+	// unix socket address.
+	Scheme string
+	// Host is a hostname, an IPv4 literal or an IPv6 literal without the
+	// enclosing brackets. It is empty for a unix socket address.
+	Host string
+	// Port is zero if the address has no port.
+	Port int
+	// Path is the socket path of a unix socket address, or the path
+	// following the host and port of an address with a scheme, if any.
+	Path string
+}
+
+// AddressError is returned when an endpoint's address cannot be parsed.
+type AddressError struct {
+	Address string
+	Reason  string
+}
+
+func (e *AddressError) Error() string {
+	return fmt.Sprintf("invalid address %q: %s", e.Address, e.Reason)
+}
+
+// ParseAddress parses an endpoint address into its structured form. An error
+// is returned for addresses that are malformed or ambiguous.
+func ParseAddress(s string) (*Address, error) {
+	fail := func(reason string) (*Address, error) {
+		return nil, &AddressError{Address: s, Reason: reason}
+	}
+	if s == "" {
+		return fail("address is empty")
+	}
+	if strings.ContainsAny(s, " \t\r\n") {
+		return fail("address contains whitespace")
+	}
+
+	a := &Address{}
+	hostPort := s
+	if x := strings.Index(s, "://"); x != -1 {
+		a.Scheme = strings.ToLower(s[:x])
+		if !validScheme(a.Scheme) {
+			return fail("invalid scheme")
+		}
+		hostPort = s[x+3:]
+		if a.Scheme == schemeUnix {
+			if !strings.HasPrefix(hostPort, "/") || len(hostPort) == 1 {
+				return fail("unix socket address requires an absolute path")
+			}
+			a.Path = hostPort
+			return a, nil
+		}
+		if x = strings.Index(hostPort, "/"); x != -1 {
+			a.Path = hostPort[x:]
+			hostPort = hostPort[:x]
+		}
+	} else if strings.Contains(s, "/") {
+		return fail("address containing \"/\" requires a scheme")
+	}
+
+	host, port, reason := splitHostPort(hostPort)
+	if reason != "" {
+		return fail(reason)
+	}
+	a.Host = host
+	a.Port = port
+	return a, nil
+}
+
+// Splits a host and optional port. A non-empty reason is returned if they
+// cannot be split unambiguously.
+func splitHostPort(hostPort string) (string, int, string) {
+	host := hostPort
+	port := ""
+	if strings.HasPrefix(hostPort, "[") {
+		end := strings.Index(hostPort, "]")
+		if end == -1 {
+			return "", 0, "missing \"]\" in IPv6 address"
+		}
+		host = hostPort[1:end]
+		// Strip any zone, e.g. "%eth0", before validating the literal
+		ip := host
+		if x := strings.Index(ip, "%"); x != -1 {
+			ip = ip[:x]
+		}
+		if !strings.Contains(ip, ":") || net.ParseIP(ip) == nil {
+			return "", 0, "invalid IPv6 address in brackets"
+		}
+		rest := hostPort[end+1:]
+		if rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return "", 0, "unexpected characters after \"]\""
+			}
+			port = rest[1:]
+			if port == "" {
+				return "", 0, "port is empty"
+			}
+		}
+	} else {
+		switch strings.Count(hostPort, ":") {
+		case 0:
+		case 1:
+			x := strings.Index(hostPort, ":")
+			host, port = hostPort[:x], hostPort[x+1:]
+			if port == "" {
+				return "", 0, "port is empty"
+			}
+		default:
+			return "", 0, "IPv6 addresses must be enclosed in brackets"
+		}
+		if !validHostname(host) {
+			return "", 0, "invalid host"
+		}
+	}
+	if host == "" {
+		return "", 0, "host is empty"
+	}
+	if port == "" {
+		return host, 0, ""
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return "", 0, "invalid port"
+	}
+	return host, p, ""
+}
+
+func validScheme(scheme string) bool {
+	if scheme == "" || scheme[0] < 'a' || scheme[0] > 'z' {
+		return false
+	}
+	return strings.IndexFunc(scheme, func(c rune) bool {
+		return !((c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '+' || c == '-' || c == '.')
+	}) == -1
+}
+
+func validHostname(host string) bool {
+	return strings.IndexFunc(host, func(c rune) bool {
+		return !((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') ||
+			(c >= '0' && c <= '9') || c == '-' || c == '.' || c == '_')
+	}) == -1
+}
+
+// Returns the address in the form accepted by ParseAddress.
+func (a *Address) String() string {
+	if a.Scheme == schemeUnix {
+		return schemeUnix + "://" + a.Path
+	}
+	s := a.Host
+	if strings.Contains(s, ":") {
+		s = "[" + s + "]"
+	}
+	if a.Port != 0 {
+		s += ":" + strconv.Itoa(a.Port)
+	}
+	if a.Scheme != "" {
+		s = a.Scheme + "://" + s + a.Path
+	}
+	return s
+}
+
+// HostPort returns the host and port of the address in the form accepted by
+// net.Dial, e.g. "[2001:db8::1]:443". For a unix socket address, the socket
+// path is returned.
+func (a *Address) HostPort() string {
+	if a.Scheme == schemeUnix {
+		return a.Path
+	}
+	if a.Port == 0 {
+		return a.Host
+	}
+	return net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
+}
+
+// ParsedAddress returns the structured form of the endpoint's address.
+func (ep *Endpoint) ParsedAddress() (*Address, error) {
+	return ParseAddress(ep.Address)
+}
+
+var (
+	keySegmentEscaper   = strings.NewReplacer("%", "%25", "/", "%2F")
+	keySegmentUnescaper = strings.NewReplacer("%2F", "/", "%25", "%")
+)
+
+// Escapes an endpoint address so that it can be used as a single segment of an
+// etcd key. Addresses without "/" or "%" are unchanged, so keys written by
+// older versions of gsr are still read correctly.
+func escapeKeySegment(s string) string {
+	return keySegmentEscaper.Replace(s)
+}
+
+// Reverses escapeKeySegment.
+func unescapeKeySegment(s string) string {
+	return keySegmentUnescaper.Replace(s)
+}
@@ -0,0 +1,91 @@
+package gsr
+
+import (
+	"testing"
+)
+
+func TestParseAddress(t *testing.T) {
+	tests := []struct {
+		addr string
+		want Address
+	}{
+		{"10.0.0.1", Address{Host: "10.0.0.1"}},
+		{"10.0.0.1:8080", Address{Host: "10.0.0.1", Port: 8080}},
+		{"db.example.org:5432", Address{Host: "db.example.org", Port: 5432}},
+		{"[2001:db8::1]", Address{Host: "2001:db8::1"}},
+		{"[2001:db8::1]:443", Address{Host: "2001:db8::1", Port: 443}},
+		{"[fe80::1%eth0]:80", Address{Host: "fe80::1%eth0", Port: 80}},
+		{
+			"http://10.0.0.1:8080/api",
+			Address{Scheme: "http", Host: "10.0.0.1", Port: 8080, Path: "/api"},
+		},
+		{
+			"grpc://[::1]:10000",
+			Address{Scheme: "grpc", Host: "::1", Port: 10000},
+		},
+		{
+			"unix:///var/run/app.sock",
+			Address{Scheme: "unix", Path: "/var/run/app.sock"},
+		},
+	}
+	for _, test := range tests {
+		got, err := ParseAddress(test.addr)
+		if err != nil {
+			t.Fatalf("Expected nil parsing %q, but got %v.", test.addr, err)
+		}
+		if *got != test.want {
+			t.Fatalf("Expected %+v parsing %q, but got %+v.",
+				test.want, test.addr, *got)
+		}
+		if got.String() != test.addr {
+			t.Fatalf("Expected %q, but got %q.", test.addr, got.String())
+		}
+	}
+}
+
+func TestParseAddressBad(t *testing.T) {
+	bad := []string{
+		"",
+		"10.0.0.1 :80",
+		"2001:db8::1",
+		"::1:80",
+		"[2001:db8::1",
+		"[10.0.0.1]:80",
+		"[::1]80",
+		"10.0.0.1:",
+		"10.0.0.1:http",
+		"10.0.0.1:70000",
+		":80",
+		"10.0.0.1/24",
+		"unix://var/run/app.sock",
+		"1http://10.0.0.1",
+	}
+	for _, addr := range bad {
+		if _, err := ParseAddress(addr); err == nil {
+			t.Fatalf("Expected error parsing %q, but got nil.", addr)
+		}
+	}
+}
+
+func TestEscapeKeySegment(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"10.0.0.1:8080", "10.0.0.1:8080"},
+		{"unix:///var/run/app.sock", "unix:%2F%2F%2Fvar%2Frun%2Fapp.sock"},
+		{"[fe80::1%eth0]:80", "[fe80::1%25eth0]:80"},
+		{"http://h/%2F", "http:%2F%2Fh%2F%252F"},
+	}
+	for _, test := range tests {
+		got := escapeKeySegment(test.addr)
+		if got != test.want {
+			t.Fatalf("Expected %q escaping %q, but got %q.",
+				test.want, test.addr, got)
+		}
+		if back := unescapeKeySegment(got); back != test.addr {
+			t.Fatalf("Expected %q unescaping %q, but got %q.",
+				test.addr, got, back)
+		}
+	}
+}
@@ -0,0 +1,481 @@
+package gsr
+
+// The Registry stores everything in a Backend: a key/value store with
+// revisions, leases and watches, modelled on etcd3. etcd is the default
+// backend. Other backends are selected with GSR_BACKEND, e.g.
+// "file:///path/to/registry.yaml", "consul://127.0.0.1:8500",
+// "zk://127.0.0.1:2181" or "redis://127.0.0.1:6379".
+//
+// Every backend must provide the following semantics, which the Registry
+// relies on:
+//
+//  1. Each write (put, delete or lease expiry) increments a single revision
+//     counter for the whole store. KeyValue.ModRevision and CreateRevision are
+//     the revisions at which a key was last written and created.
+//  2. Conditions are evaluated atomically with the write they guard. A key
+//     that does not exist has a zero Version, CreateRevision, ModRevision and
+//     Lease.
+//  3. Keys attached to a lease are deleted when the lease expires or is
+//     revoked.
+//  4. A watch started at a revision delivers every change made at or after
+//     that revision, in order, or ErrCompacted if those changes are no longer
+//     available.
+//  5. A backend that keeps no history of changes cannot tell what changed
+//     since a past revision. It fails reads at a revision older than its
+//     current one, and watches started at a revision that has changes the
+//     watch would have missed, with ErrCompacted. The Registry then reads the
+//     keys again.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	etcd "go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"golang.org/x/net/context"
+)
+
+var (
+	// ErrCompareFailed is returned by Backend.Put() and Backend.Delete() when
+	// the conditions guarding the write do not hold.
+	ErrCompareFailed = errors.New("backend: compare failed")
+	// ErrCompacted is delivered on a watch when the revision it was started
+	// at is no longer available.
+	ErrCompacted = errors.New("backend: required revision has been compacted")
+	// ErrLeaseNotFound is returned for operations on a lease that has expired
+	// or was never granted.
+	ErrLeaseNotFound = errors.New("backend: lease not found")
+	// ErrInvalidTTL is returned by Backend.Grant() when a lease cannot be
+	// granted with the supplied TTL, e.g. one that is not positive.
+	ErrInvalidTTL = errors.New("backend: invalid lease TTL")
+	// ErrNotSupported is returned by features that the configured backend
+	// cannot provide, e.g. leader election on a non-etcd backend.
+	ErrNotSupported = errors.New("not supported by the configured backend")
+)
+
+// LeaseID identifies a lease granted by a Backend.
+type LeaseID int64
+
+// NoLease is the LeaseID of keys not attached to a lease.
+const NoLease LeaseID = 0
+
+// KeyValue is a key read from a Backend.
+type KeyValue struct {
+	Key            string
+	Value          []byte
+	CreateRevision int64
+	ModRevision    int64
+	// Version is the number of times the key has been written since it was
+	// created.
+	Version int64
+	Lease   LeaseID
+}
+
+type GetOptions struct {
+	// Prefix reads every key beginning with the supplied key.
+	Prefix bool
+	// KeysOnly leaves the values of the returned keys empty.
+	KeysOnly bool
+	// Revision reads the store as it was at a past revision. Zero reads the
+	// current revision.
+	Revision int64
+}
+
+// GetResponse holds the keys read by Backend.Get(), sorted by key, and the
+// revision they were read at.
+type GetResponse struct {
+	KVs      []*KeyValue
+	Revision int64
+}
+
+type CompareTarget int
+
+const (
+	CompareVersion CompareTarget = iota
+	CompareCreateRevision
+	CompareModRevision
+	CompareLease
+)
+
+// Condition compares a property of a key with a value, e.g. "the
+// ModRevision of key is 42".
+type Condition struct {
+	Key    string
+	Target CompareTarget
+	// Op is one of "=", "!=", ">" or "<".
+	Op    string
+	Value int64
+}
+
+// Holds returns true if the condition holds for the supplied key, which is
+// nil if the key does not exist. It is used by backends that evaluate
+// conditions themselves.
+func (c Condition) Holds(kv *KeyValue) bool {
+	var actual int64
+	if kv != nil {
+		switch c.Target {
+		case CompareVersion:
+			actual = kv.Version
+		case CompareCreateRevision:
+			actual = kv.CreateRevision
+		case CompareModRevision:
+			actual = kv.ModRevision
+		case CompareLease:
+			actual = int64(kv.Lease)
+		}
+	}
+	switch c.Op {
+	case "=":
+		return actual == c.Value
+	case "!=":
+		return actual != c.Value
+	case ">":
+		return actual > c.Value
+	case "<":
+		return actual < c.Value
+	}
+	return false
+}
+
+type PutOptions struct {
+	// Lease attaches the key to a lease. The key leaves any lease it was
+	// attached to before, so a put with NoLease makes it permanent.
+	Lease LeaseID
+	// IgnoreLease keeps the key's current lease. Lease is then ignored.
+	IgnoreLease bool
+	// If holds conditions that must all hold for the put to be made.
+	If []Condition
+}
+
+type DeleteOptions struct {
+	// Prefix deletes every key beginning with the supplied key.
+	Prefix bool
+	// If holds conditions that must all hold for the delete to be made.
+	If []Condition
+}
+
+type WatchOptions struct {
+	// Prefix watches every key beginning with the supplied key.
+	Prefix bool
+	// Revision is the revision to start watching at. Zero watches changes
+	// made after the watch is created.
+	Revision int64
+}
+
+type KVEventType int
+
+const (
+	KVPut KVEventType = iota
+	KVDelete
+)
+
+// KVEvent is a change to a key delivered on a watch. For a delete, KV holds
+// the key and the revision of the delete.
+type KVEvent struct {
+	Type KVEventType
+	KV   *KeyValue
+	// prev is the key before the change, or nil if it did not exist. It is
+	// only recorded by backends that keep their own history.
+	prev *KeyValue
+}
+
+// WatchResponse holds the changes made at a single revision. Err is set, and
+// Events empty, if the watch failed; the watch channel is closed after such a
+// response.
+type WatchResponse struct {
+	Events   []*KVEvent
+	Revision int64
+	Err      error
+}
+
+// Backend is the store used by a Registry.
+type Backend interface {
+	Get(ctx context.Context, key string, opts *GetOptions) (*GetResponse, error)
+	// Put writes a key and returns the revision of the write.
+	Put(
+		ctx context.Context,
+		key string,
+		val []byte,
+		opts *PutOptions,
+	) (int64, error)
+	// Delete removes keys and returns the number of keys deleted.
+	Delete(ctx context.Context, key string, opts *DeleteOptions) (int64, error)
+	// Grant creates a lease that expires after the supplied number of
+	// seconds unless it is kept alive.
+	Grant(ctx context.Context, ttl int64) (LeaseID, error)
+	// KeepAlive refreshes a lease until the supplied context is done. The
+	// returned channel receives a value after each refresh and is closed
+	// when the lease can no longer be kept alive.
+	KeepAlive(ctx context.Context, lease LeaseID) (<-chan struct{}, error)
+	// Revoke deletes a lease and every key attached to it.
+	Revoke(ctx context.Context, lease LeaseID) error
+	// TimeToLive returns the remaining and granted TTL, in seconds, of a
+	// lease.
+	TimeToLive(ctx context.Context, lease LeaseID) (int64, int64, error)
+	// Watch delivers changes to keys until the supplied context is done.
+	Watch(
+		ctx context.Context,
+		key string,
+		opts *WatchOptions,
+	) <-chan *WatchResponse
+	Close() error
+}
+
+// Creates the backend selected by the Registry's configuration.
+func (r *Registry) newBackend() (Backend, error) {
+	u := r.config.Backend
+	switch {
+	case u == "" || u == "etcd":
+		client, err := r.connect()
+		if err != nil {
+			return nil, err
+		}
+		return &etcdBackend{client: client}, nil
+	case strings.HasPrefix(u, "file://"):
+		return newFileBackend(u[len("file://"):], r.config, r.LERR)
+	case strings.HasPrefix(u, "consul://"):
+		return newConsulBackend("http://" + u[len("consul://"):]), nil
+	case strings.HasPrefix(u, "zk://"):
+		servers := strings.Split(u[len("zk://"):], ",")
+		return newZKBackend(servers, r.config, zkDial)
+	case strings.HasPrefix(u, "redis://"):
+		return newRedisBackend(u, r.LERR, dialRedis), nil
+	}
+	return nil, fmt.Errorf("unknown backend %q", u)
+}
+
+// Returns the etcd client of the Registry's backend, or ErrNotSupported if the
+// backend is not etcd.
+func (r *Registry) etcdClient() (*etcd.Client, error) {
+	if b, ok := r.backend.(*etcdBackend); ok {
+		return b.client, nil
+	}
+	return nil, ErrNotSupported
+}
+
+// etcdBackend stores the registry in etcd3.
+type etcdBackend struct {
+	client *etcd.Client
+}
+
+func (b *etcdBackend) Get(
+	ctx context.Context,
+	key string,
+	opts *GetOptions,
+) (*GetResponse, error) {
+	if opts == nil {
+		opts = &GetOptions{}
+	}
+	ops := []etcd.OpOption{etcd.WithSort(etcd.SortByKey, etcd.SortAscend)}
+	if opts.Prefix {
+		ops = append(ops, etcd.WithPrefix())
+	}
+	if opts.KeysOnly {
+		ops = append(ops, etcd.WithKeysOnly())
+	}
+	if opts.Revision != 0 {
+		ops = append(ops, etcd.WithRev(opts.Revision))
+	}
+	resp, err := b.client.KV.Get(ctx, key, ops...)
+	if err != nil {
+		return nil, err
+	}
+	res := &GetResponse{
+		KVs:      make([]*KeyValue, len(resp.Kvs)),
+		Revision: resp.Header.Revision,
+	}
+	for x, kv := range resp.Kvs {
+		res.KVs[x] = &KeyValue{
+			Key:            string(kv.Key),
+			Value:          kv.Value,
+			CreateRevision: kv.CreateRevision,
+			ModRevision:    kv.ModRevision,
+			Version:        kv.Version,
+			Lease:          LeaseID(kv.Lease),
+		}
+	}
+	return res, nil
+}
+
+// Translates conditions into etcd comparisons.
+func etcdCompares(conds []Condition) []etcd.Cmp {
+	cmps := make([]etcd.Cmp, len(conds))
+	for x, c := range conds {
+		var target etcd.Cmp
+		switch c.Target {
+		case CompareVersion:
+			target = etcd.Version(c.Key)
+		case CompareCreateRevision:
+			target = etcd.CreateRevision(c.Key)
+		case CompareModRevision:
+			target = etcd.ModRevision(c.Key)
+		case CompareLease:
+			target = etcd.LeaseValue(c.Key)
+		}
+		cmps[x] = etcd.Compare(target, c.Op, c.Value)
+	}
+	return cmps
+}
+
+func (b *etcdBackend) Put(
+	ctx context.Context,
+	key string,
+	val []byte,
+	opts *PutOptions,
+) (int64, error) {
+	if opts == nil {
+		opts = &PutOptions{}
+	}
+	var op etcd.Op
+	if opts.IgnoreLease {
+		op = etcd.OpPut(key, string(val), etcd.WithIgnoreLease())
+	} else {
+		op = etcd.OpPut(key, string(val), etcd.WithLease(etcd.LeaseID(opts.Lease)))
+	}
+	resp, err := b.client.KV.Txn(ctx).If(etcdCompares(opts.If)...).Then(op).Commit()
+	if err == rpctypes.ErrLeaseNotFound {
+		return 0, ErrLeaseNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !resp.Succeeded {
+		return 0, ErrCompareFailed
+	}
+	return resp.Header.Revision, nil
+}
+
+func (b *etcdBackend) Delete(
+	ctx context.Context,
+	key string,
+	opts *DeleteOptions,
+) (int64, error) {
+	if opts == nil {
+		opts = &DeleteOptions{}
+	}
+	ops := []etcd.OpOption{}
+	if opts.Prefix {
+		ops = append(ops, etcd.WithPrefix())
+	}
+	op := etcd.OpDelete(key, ops...)
+	resp, err := b.client.KV.Txn(ctx).If(etcdCompares(opts.If)...).Then(op).Commit()
+	if err != nil {
+		return 0, err
+	}
+	if !resp.Succeeded {
+		return 0, ErrCompareFailed
+	}
+	return resp.Responses[0].GetResponseDeleteRange().Deleted, nil
+}
+
+func (b *etcdBackend) Grant(ctx context.Context, ttl int64) (LeaseID, error) {
+	resp, err := b.client.Grant(ctx, ttl)
+	if err != nil {
+		return NoLease, err
+	}
+	return LeaseID(resp.ID), nil
+}
+
+func (b *etcdBackend) KeepAlive(
+	ctx context.Context,
+	lease LeaseID,
+) (<-chan struct{}, error) {
+	ka, err := b.client.KeepAlive(ctx, etcd.LeaseID(lease))
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		for range ka {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (b *etcdBackend) Revoke(ctx context.Context, lease LeaseID) error {
+	_, err := b.client.Revoke(ctx, etcd.LeaseID(lease))
+	if err == rpctypes.ErrLeaseNotFound {
+		return ErrLeaseNotFound
+	}
+	return err
+}
+
+func (b *etcdBackend) TimeToLive(
+	ctx context.Context,
+	lease LeaseID,
+) (int64, int64, error) {
+	resp, err := b.client.TimeToLive(ctx, etcd.LeaseID(lease))
+	if err != nil {
+		return 0, 0, err
+	}
+	if resp.TTL < 0 {
+		return 0, 0, ErrLeaseNotFound
+	}
+	return resp.TTL, resp.GrantedTTL, nil
+}
+
+func (b *etcdBackend) Watch(
+	ctx context.Context,
+	key string,
+	opts *WatchOptions,
+) <-chan *WatchResponse {
+	if opts == nil {
+		opts = &WatchOptions{}
+	}
+	ops := []etcd.OpOption{}
+	if opts.Prefix {
+		ops = append(ops, etcd.WithPrefix())
+	}
+	if opts.Revision != 0 {
+		ops = append(ops, etcd.WithRev(opts.Revision))
+	}
+	wch := b.client.Watch(ctx, key, ops...)
+	ch := make(chan *WatchResponse)
+	go func() {
+		defer close(ch)
+		for wresp := range wch {
+			resp := &WatchResponse{Revision: wresp.Header.Revision}
+			if wresp.CompactRevision != 0 {
+				resp.Err = ErrCompacted
+			} else if err := wresp.Err(); err != nil {
+				resp.Err = err
+			}
+			for _, ev := range wresp.Events {
+				kev := &KVEvent{
+					Type: KVPut,
+					KV: &KeyValue{
+						Key:            string(ev.Kv.Key),
+						Value:          ev.Kv.Value,
+						CreateRevision: ev.Kv.CreateRevision,
+						ModRevision:    ev.Kv.ModRevision,
+						Version:        ev.Kv.Version,
+						Lease:          LeaseID(ev.Kv.Lease),
+					},
+				}
+				if ev.Type == etcd.EventTypeDelete {
+					kev.Type = KVDelete
+				}
+				resp.Events = append(resp.Events, kev)
+			}
+			select {
+			case ch <- resp:
+			case <-ctx.Done():
+				return
+			}
+			if resp.Err != nil {
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+func (b *etcdBackend) Close() error {
+	return b.client.Close()
+}
@@ -0,0 +1,316 @@
+package gsr
+
+// Each Registry keeps a local cache of every endpoint in the registry. The
+// cache is loaded when the Registry is created and kept up to date from the
+// Registry's watch, so lookups against it (Query) and watches of it
+// (Watch) do not need a round trip to etcd.
+
+import (
+	"sort"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// The size of the buffer of a watcher's channel. Events that do not fit are
+// queued until the watcher reads them.
+const watchBufferSize = 64
+
+type EventType int
+
+const (
+	// EventCreated is sent when an endpoint matching the watch appears.
+	EventCreated EventType = iota
+	// EventUpdated is sent when an endpoint matching the watch changes, e.g.
+	// when it starts draining.
+	EventUpdated
+	// EventDeleted is sent when an endpoint matching the watch is removed, or
+	// when its labels change so that it no longer matches the watch.
+	EventDeleted
+	// EventReconnected is sent to every watcher once the Registry has
+	// resumed a watch of the registry that was lost, e.g. because etcd
+	// restarted. Changes made while the watch was lost are still
+	// delivered, before or after it. Its Endpoint is nil.
+	EventReconnected
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventCreated:
+		return "created"
+	case EventUpdated:
+		return "updated"
+	case EventDeleted:
+		return "deleted"
+	case EventReconnected:
+		return "reconnected"
+	}
+	return "unknown"
+}
+
+// Event describes a change to an endpoint delivered by Registry.Watch(). The
+// Endpoint of an EventReconnected is nil.
+type Event struct {
+	Type     EventType
+	Endpoint *Endpoint
+	// Cluster is the name of the cluster the event comes from, for events
+	// delivered by Federation.Watch(). It is empty otherwise.
+	Cluster string
+}
+
+type watchSub struct {
+	ctx     context.Context
+	service string
+	sel     Selector
+	// mu protects queue, which holds events not yet delivered to ch
+	mu     sync.Mutex
+	queue  []*Event
+	notify chan struct{}
+	ch     chan *Event
+}
+
+// Queues an event for delivery without blocking the Registry.
+func (w *watchSub) enqueue(ev *Event) {
+	w.mu.Lock()
+	w.queue = append(w.queue, ev)
+	w.mu.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Delivers queued events to the watcher's channel until its context is done.
+func (w *watchSub) run(remove func()) {
+	defer close(w.ch)
+	defer remove()
+	for {
+		w.mu.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.mu.Unlock()
+		for _, ev := range queue {
+			select {
+			case w.ch <- ev:
+			case <-w.ctx.Done():
+				return
+			}
+		}
+		select {
+		case <-w.notify:
+		case <-w.ctx.Done():
+			return
+		}
+	}
+}
+
+// Returns true if the supplied endpoint is of interest to the watcher.
+func (w *watchSub) matches(ep *Endpoint) bool {
+	if ep == nil {
+		return false
+	}
+	if w.service != "" && w.service != ep.Service.Name {
+		return false
+	}
+	return w.sel.Matches(ep.Labels)
+}
+
+// Returns a copy of the endpoint that callers may modify without affecting the
+// cache.
+func (ep *Endpoint) clone() *Endpoint {
+	c := *ep
+	c.Service = &Service{Name: ep.Service.Name}
+	if ep.Labels != nil {
+		c.Labels = make(map[string]string, len(ep.Labels))
+		for k, v := range ep.Labels {
+			c.Labels[k] = v
+		}
+	}
+	c.lease = NoLease
+	return &c
+}
+
+// Query returns the endpoints of a service whose labels match the supplied
+// selector, sorted by address. Endpoints that are draining are not included.
+// Unlike Endpoints(), Query is answered from the Registry's local cache and
+// does not contact the backend.
+func (r *Registry) Query(service string, sel Selector) []*Endpoint {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res := make([]*Endpoint, 0)
+	for _, ep := range r.cache[service] {
+		if ep.Draining || !sel.Matches(ep.Labels) {
+			continue
+		}
+		res = append(res, ep.clone())
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Address < res[j].Address
+	})
+	return res
+}
+
+// Watch returns a channel on which changes to the endpoints of a service whose
+// labels match the supplied selector are delivered. An empty service name
+// watches every service. The channel first receives an EventCreated for each
+// matching endpoint already in the registry. The channel is closed once the
+// supplied context is done.
+//
+// If the Registry loses its watch of the registry, it sends an
+// EventReconnected once the watch has been resumed, followed by the changes
+// made in the meantime. When those changes are no longer available from etcd,
+// the endpoints are read again instead, and the EventReconnected is preceded
+// by the events that turn the channel's previous view of them into the
+// current one.
+//
+// A watcher that falls behind does not hold up other watchers or lookups:
+// the events it has yet to read are queued for it, so callers should keep
+// reading from the channel until they cancel the context.
+//
+// With the file backend, the changes delivered are those made by rewriting the
+// file and by the process itself: the file backend never returns
+// ErrNotSupported for watches.
+func (r *Registry) Watch(
+	ctx context.Context,
+	service string,
+	sel Selector,
+) <-chan *Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sub := &watchSub{
+		ctx:     ctx,
+		service: service,
+		sel:     sel,
+		notify:  make(chan struct{}, 1),
+		ch:      make(chan *Event, watchBufferSize),
+	}
+	for _, eps := range r.cache {
+		for _, ep := range eps {
+			if sub.matches(ep) {
+				sub.queue = append(sub.queue, &Event{
+					Type:     EventCreated,
+					Endpoint: ep.clone(),
+				})
+			}
+		}
+	}
+	r.subs[sub] = true
+
+	go sub.run(func() {
+		r.mu.Lock()
+		delete(r.subs, sub)
+		r.mu.Unlock()
+	})
+	return sub.ch
+}
+
+// Replaces the contents of the cache with the supplied endpoints.
+func (r *Registry) loadCache(eps []*Endpoint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache = make(map[string]map[string]*Endpoint, 0)
+	for _, ep := range eps {
+		r.cacheEndpoint(ep)
+	}
+}
+
+// Replaces the contents of the cache with the supplied endpoints, notifying
+// watchers of the endpoints that were created, updated or deleted.
+func (r *Registry) resyncCache(eps []*Endpoint) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	old := r.cache
+	r.cache = make(map[string]map[string]*Endpoint, 0)
+	for _, ep := range eps {
+		r.cacheEndpoint(ep)
+		prev := old[ep.Service.Name][ep.Address]
+		if prev != nil {
+			delete(old[ep.Service.Name], ep.Address)
+			if prev.modRev == ep.modRev {
+				continue
+			}
+		}
+		r.notify(prev, ep)
+	}
+	for _, byAddr := range old {
+		for _, ep := range byAddr {
+			r.notify(ep, nil)
+		}
+	}
+}
+
+// Sends an EventReconnected to every watcher.
+func (r *Registry) notifyReconnected() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for sub := range r.subs {
+		sub.enqueue(&Event{Type: EventReconnected})
+	}
+}
+
+// Stores an endpoint in the cache. The caller must hold the write lock.
+func (r *Registry) cacheEndpoint(ep *Endpoint) {
+	sname := ep.Service.Name
+	if r.cache[sname] == nil {
+		r.cache[sname] = make(map[string]*Endpoint, 0)
+	}
+	r.cache[sname][ep.Address] = ep
+}
+
+// Applies a change read from the registry watch to the cache and notifies any
+// watchers.
+func (r *Registry) applyChange(ev *KVEvent) {
+	service, addr := r.partsFromKey(ev.KV.Key)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old := r.cache[service][addr]
+	switch ev.Type {
+	case KVDelete:
+		if old == nil {
+			return
+		}
+		delete(r.cache[service], addr)
+		if len(r.cache[service]) == 0 {
+			delete(r.cache, service)
+		}
+		r.notify(old, nil)
+	case KVPut:
+		ep := &Endpoint{
+			Service: &Service{Name: service},
+			Address: addr,
+			modRev:  ev.KV.ModRevision,
+		}
+		if err := ep.setValue(ev.KV.Value); err != nil {
+			r.LERR("failed to decode registry entry for %s:%s: %v",
+				service, addr, err)
+			return
+		}
+		r.cacheEndpoint(ep)
+		r.notify(old, ep)
+	}
+}
+
+// Sends events to watchers for a change of an endpoint from old to cur, either
+// of which may be nil. A watcher that matched old but not cur sees the endpoint
+// deleted, and one that matched cur but not old sees it created. The caller
+// must hold the write lock.
+func (r *Registry) notify(old *Endpoint, cur *Endpoint) {
+	for sub := range r.subs {
+		oldMatch := sub.matches(old)
+		curMatch := sub.matches(cur)
+		var ev *Event
+		switch {
+		case oldMatch && curMatch:
+			ev = &Event{Type: EventUpdated, Endpoint: cur.clone()}
+		case oldMatch:
+			ev = &Event{Type: EventDeleted, Endpoint: old.clone()}
+		case curMatch:
+			ev = &Event{Type: EventCreated, Endpoint: cur.clone()}
+		default:
+			continue
+		}
+		sub.enqueue(ev)
+	}
+}
@@ -0,0 +1,206 @@
+package gsr_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jaypipes/gsr"
+	"github.com/jaypipes/gsr/gsrtest"
+	"golang.org/x/net/context"
+)
+
+// Returns a Registry whose backend injects faults, and another Registry
+// connected to the same store without faults. The returned function closes
+// both and stops the store.
+func newFaultRegistry(
+	t *testing.T,
+) (*gsr.Registry, *gsrtest.FaultBackend, *gsr.Registry, func()) {
+	factory, stop := gsr.MemBackendFactory()
+	f := gsrtest.NewFaultBackend(factory(t))
+	r, err := gsr.NewWithBackend(f)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	other, err := gsr.NewWithBackend(factory(t))
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	return r, f, other, func() {
+		r.Close()
+		other.Close()
+		stop()
+	}
+}
+
+// Returns the next event from a Registry watch, failing the test if none
+// arrives.
+func nextEvent(t *testing.T, events <-chan *gsr.Event) *gsr.Event {
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatal("Expected an event, but the watch was closed.")
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an event.")
+	}
+	return nil
+}
+
+func expectEvent(
+	t *testing.T,
+	events <-chan *gsr.Event,
+	typ gsr.EventType,
+	addr string,
+) {
+	ev := nextEvent(t, events)
+	if ev.Type != typ {
+		t.Fatalf("Expected %s event, but got %s.", typ, ev.Type)
+	}
+	if typ != gsr.EventReconnected && ev.Endpoint.Address != addr {
+		t.Fatalf("Expected %s, but got %s.", addr, ev.Endpoint.Address)
+	}
+}
+
+func TestWatchResumesFromLastRevision(t *testing.T) {
+	r, f, other, done := newFaultRegistry(t)
+	defer done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := r.Watch(ctx, "web", nil)
+
+	ep1 := gsr.Endpoint{
+		Service: &gsr.Service{Name: "web"},
+		Address: "10.0.0.1:80",
+	}
+	if err := other.Register(&ep1); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	expectEvent(t, events, gsr.EventCreated, ep1.Address)
+
+	// Keep the registry out of reach while the watch is lost, and change it
+	// in the meantime
+	f.SetErrorRate(gsrtest.OpGet, 1, nil)
+	f.DropWatches()
+	waitFor(t, 5*time.Second, "the registry to be retried", func() bool {
+		return f.Calls(gsrtest.OpGet) > 0
+	})
+	ep2 := gsr.Endpoint{
+		Service: &gsr.Service{Name: "web"},
+		Address: "10.0.0.2:80",
+	}
+	if err := other.Register(&ep2); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	f.Reset()
+
+	// The watch picks up where it left off, rather than reading the
+	// endpoints again
+	expectEvent(t, events, gsr.EventReconnected, "")
+	expectEvent(t, events, gsr.EventCreated, ep2.Address)
+	if eps := r.Query("web", nil); !hasAddress(ep2.Address, eps) {
+		t.Fatalf("Expected to find %s in %v.", ep2.Address, eps)
+	}
+}
+
+func TestWatchResyncAfterCompaction(t *testing.T) {
+	r, f, other, done := newFaultRegistry(t)
+	defer done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := r.Watch(ctx, "web", nil)
+
+	ep1 := gsr.Endpoint{
+		Service: &gsr.Service{Name: "web"},
+		Address: "10.0.0.1:80",
+	}
+	ep2 := gsr.Endpoint{
+		Service: &gsr.Service{Name: "web"},
+		Address: "10.0.0.2:80",
+	}
+	for _, ep := range []*gsr.Endpoint{&ep1, &ep2} {
+		if err := other.Register(ep); err != nil {
+			t.Fatalf("Expected nil, but got %v.", err)
+		}
+		expectEvent(t, events, gsr.EventCreated, ep.Address)
+	}
+
+	f.SetErrorRate(gsrtest.OpGet, 1, nil)
+	f.FailWatches(gsr.ErrCompacted)
+	waitFor(t, 5*time.Second, "the endpoints to be read again", func() bool {
+		return f.Calls(gsrtest.OpGet) > 0
+	})
+	if err := other.Unregister(&ep1); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	ep2.Draining = true
+	if err := other.Update(&ep2); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	ep3 := gsr.Endpoint{
+		Service: &gsr.Service{Name: "web"},
+		Address: "10.0.0.3:80",
+	}
+	if err := other.Register(&ep3); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	f.Reset()
+
+	// The changes that were compacted away are made up for by the
+	// differences between the old and new endpoints
+	seen := make(map[string]gsr.EventType, 0)
+	for x := 0; x < 3; x++ {
+		ev := nextEvent(t, events)
+		if ev.Type == gsr.EventReconnected {
+			t.Fatalf("Expected 3 events before %s, but got %d.", ev.Type, x)
+		}
+		seen[ev.Endpoint.Address] = ev.Type
+	}
+	expected := map[string]gsr.EventType{
+		ep1.Address: gsr.EventDeleted,
+		ep2.Address: gsr.EventUpdated,
+		ep3.Address: gsr.EventCreated,
+	}
+	for addr, typ := range expected {
+		if got, ok := seen[addr]; !ok || got != typ {
+			t.Fatalf("Expected %s event for %s, but got %v.", typ, addr, seen)
+		}
+	}
+	expectEvent(t, events, gsr.EventReconnected, "")
+
+	// Changes are watched again from the revision the endpoints were read at
+	if err := other.Unregister(&ep3); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	expectEvent(t, events, gsr.EventDeleted, ep3.Address)
+}
+
+func TestWatchSlowWatcher(t *testing.T) {
+	r, _, other, done := newFaultRegistry(t)
+	defer done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// The first watch is never read from
+	slow := r.Watch(ctx, "web", nil)
+	events := r.Watch(ctx, "web", nil)
+
+	for x := 0; x < 100; x++ {
+		ep := gsr.Endpoint{
+			Service: &gsr.Service{Name: "web"},
+			Address: fmt.Sprintf("10.0.0.%d:80", x+1),
+		}
+		if err := other.Register(&ep); err != nil {
+			t.Fatalf("Expected nil, but got %v.", err)
+		}
+		expectEvent(t, events, gsr.EventCreated, ep.Address)
+	}
+	if eps := r.Query("web", nil); len(eps) != 100 {
+		t.Fatalf("Expected 100 endpoints, but got %d.", len(eps))
+	}
+
+	// The slow watcher still gets every event, in order
+	for x := 0; x < 100; x++ {
+		expectEvent(t, slow, gsr.EventCreated, fmt.Sprintf("10.0.0.%d:80", x+1))
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jaypipes/gsr"
+)
+
+const flagsUsage = `flags list SERVICE
+       gsrctl flags set SERVICE NAME on|off|PERCENT%
+       gsrctl flags delete SERVICE NAME
+       gsrctl flags check SERVICE NAME KEY`
+
+func runFlags(args []string) error {
+	if len(args) < 2 {
+		return usageError(flagsUsage)
+	}
+	sub, service, args := args[0], args[1], args[2:]
+	reg, err := connect()
+	if err != nil {
+		return err
+	}
+	defer reg.Close()
+
+	switch sub {
+	case "list":
+		if len(args) != 0 {
+			return usageError(flagsUsage)
+		}
+		fs, err := reg.Flags(context.Background(), service)
+		if err != nil {
+			return err
+		}
+		for _, f := range fs.All() {
+			fmt.Println(f)
+		}
+		return nil
+	case "set":
+		if len(args) != 2 {
+			return usageError(flagsUsage)
+		}
+		f, err := parseFlag(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		return reg.SetFlag(service, f)
+	case "delete":
+		if len(args) != 1 {
+			return usageError(flagsUsage)
+		}
+		return reg.DeleteFlag(service, args[0])
+	case "check":
+		if len(args) != 2 {
+			return usageError(flagsUsage)
+		}
+		fs, err := reg.Flags(context.Background(), service)
+		if err != nil {
+			return err
+		}
+		if _, err = fs.Flag(args[0]); err != nil {
+			return err
+		}
+		if fs.Enabled(args[0], args[1]) {
+			fmt.Println("on")
+		} else {
+			fmt.Println("off")
+		}
+		return nil
+	}
+	return usageError(flagsUsage)
+}
+
+// Parses the state of a flag given on the command line, e.g. "on", "off" or
+// "25%".
+func parseFlag(name string, state string) (*gsr.Flag, error) {
+	switch state {
+	case "on", "true":
+		return &gsr.Flag{Name: name, Type: gsr.FlagBoolean, Enabled: true}, nil
+	case "off", "false":
+		return &gsr.Flag{Name: name, Type: gsr.FlagBoolean}, nil
+	}
+	if !strings.HasSuffix(state, "%") {
+		return nil, fmt.Errorf(
+			"flag state must be on, off or a percentage, e.g. 25%%",
+		)
+	}
+	pct, err := strconv.ParseFloat(strings.TrimSuffix(state, "%"), 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid percentage %q", state)
+	}
+	return &gsr.Flag{
+		Name:    name,
+		Type:    gsr.FlagPercentage,
+		Enabled: true,
+		Percent: pct,
+	}, nil
+}
@@ -0,0 +1,79 @@
+// gsrctl is a command line tool for administering a gsr registry. Like
+// applications using gsr, it is configured with the GSR_* environment
+// variables, e.g. GSR_ETCD_ENDPOINTS and GSR_NAMESPACE.
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/jaypipes/gsr"
+)
+
+type command struct {
+	usage string
+	help  string
+	run   func(args []string) error
+}
+
+var commands = map[string]*command{
+	"export": {
+		usage: exportUsage,
+		help:  "write a snapshot of the registry",
+		run:   runExport,
+	},
+	"import": {
+		usage: importUsage,
+		help:  "load a snapshot into the registry",
+		run:   runImport,
+	},
+	"flags": {
+		usage: "flags list|set|delete|check SERVICE ...",
+		help:  "manage the feature flags of a service",
+		run:   runFlags,
+	},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: gsrctl COMMAND [ARGS]\n\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd := commands[name]
+		fmt.Fprintf(os.Stderr, "  %-40s %s\n", cmd.usage, cmd.help)
+	}
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, found := commands[os.Args[1]]
+	if !found {
+		fmt.Fprintf(os.Stderr, "gsrctl: unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "gsrctl %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+// Returns an error describing the correct usage of a command.
+func usageError(usage string) error {
+	return fmt.Errorf("usage: gsrctl %s", usage)
+}
+
+func connect() (*gsr.Registry, error) {
+	reg, err := gsr.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to gsr registry: %v", err)
+	}
+	return reg, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/jaypipes/gsr"
+)
+
+const (
+	exportUsage = "export [-format json|yaml] [-o FILE]"
+	importUsage = "import [-format json|yaml] [-dry-run] [-prune] FILE"
+)
+
+// Returns the snapshot format named on the command line or, if none was, the
+// format suggested by the extension of the supplied file name.
+func snapshotFormat(name string, path string) gsr.SnapshotFormat {
+	if name != "" {
+		return gsr.SnapshotFormat(name)
+	}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		return gsr.SnapshotYAML
+	}
+	return gsr.SnapshotJSON
+}
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", "", "snapshot format: json or yaml")
+	out := fs.String("o", "-", "file to write the snapshot to")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return usageError(exportUsage)
+	}
+
+	reg, err := connect()
+	if err != nil {
+		return err
+	}
+	defer reg.Close()
+	snap, err := reg.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	return snap.Encode(w, snapshotFormat(*format, *out))
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "", "snapshot format: json or yaml")
+	dryRun := fs.Bool("dry-run", false, "show changes without making them")
+	prune := fs.Bool("prune", false, "delete entries not in the snapshot")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return usageError(importUsage)
+	}
+	path := fs.Arg(0)
+
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	snap, err := gsr.DecodeSnapshot(r, snapshotFormat(*format, path))
+	if err != nil {
+		return err
+	}
+
+	reg, err := connect()
+	if err != nil {
+		return err
+	}
+	defer reg.Close()
+	changes, err := reg.Import(snap, &gsr.ImportOptions{
+		DryRun: *dryRun,
+		Prune:  *prune,
+	})
+	for _, ch := range changes {
+		fmt.Println(ch)
+	}
+	if err != nil {
+		return err
+	}
+	if *dryRun {
+		fmt.Printf("%d changes (dry run)\n", len(changes))
+	} else {
+		fmt.Printf("%d changes\n", len(changes))
+	}
+	return nil
+}
@@ -25,6 +25,9 @@ const (
 	defaultLogMicroseconds           = false
 	defaultLogFileTrace              = false
 	defaultLeaseSeconds              = 60
+	defaultDrainGraceSeconds         = 5
+	defaultLocalityMinEndpoints      = 1
+	defaultBackend                   = "etcd"
 )
 
 var (
@@ -45,9 +48,21 @@ type Config struct {
 	LogMicroseconds           bool
 	LogFileTrace              bool
 	LeaseSeconds              int64
+	DrainGraceSeconds         time.Duration
+	Region                    string
+	Zone                      string
+	Subzone                   string
+	LocalityMinEndpoints      int
+	Namespace                 string
+	AllowCrossNamespace       bool
+	InstanceID                string
+	Backend                   string
 }
 
-func configFromEnv() *Config {
+// ConfigFromEnv returns the configuration read from the GSR_* environment
+// variables, with defaults for those that are not set. It is the
+// configuration used by New().
+func ConfigFromEnv() *Config {
 	endpoints := etcdEndpoints()
 	keyPrefix := strings.TrimRight(
 		envutil.WithDefault(
@@ -105,6 +120,26 @@ func configFromEnv() *Config {
 		"GSR_LEASE_SECONDS",
 		defaultLeaseSeconds,
 	))
+	drainGrace := time.Duration(
+		envutil.WithDefaultInt(
+			"GSR_DRAIN_GRACE_SECONDS",
+			defaultDrainGraceSeconds,
+		),
+	) * time.Second
+	region := envutil.WithDefault("GSR_REGION", "")
+	zone := envutil.WithDefault("GSR_ZONE", "")
+	subzone := envutil.WithDefault("GSR_SUBZONE", "")
+	localityMinEndpoints := envutil.WithDefaultInt(
+		"GSR_LOCALITY_MIN_ENDPOINTS",
+		defaultLocalityMinEndpoints,
+	)
+	namespace := envutil.WithDefault("GSR_NAMESPACE", "")
+	allowCrossNamespace := envutil.WithDefaultBool(
+		"GSR_ALLOW_CROSS_NAMESPACE",
+		false,
+	)
+	instanceID := envutil.WithDefault("GSR_INSTANCE_ID", "")
+	backend := envutil.WithDefault("GSR_BACKEND", defaultBackend)
 	cfg := &Config{
 		EtcdEndpoints:             endpoints,
 		EtcdKeyPrefix:             keyPrefix,
@@ -118,6 +153,15 @@ func configFromEnv() *Config {
 		LogMicroseconds:           logMicroseconds,
 		LogFileTrace:              logFileTrace,
 		LeaseSeconds:              leaseSeconds,
+		DrainGraceSeconds:         drainGrace,
+		Region:                    region,
+		Zone:                      zone,
+		Subzone:                   subzone,
+		LocalityMinEndpoints:      localityMinEndpoints,
+		Namespace:                 namespace,
+		AllowCrossNamespace:       allowCrossNamespace,
+		InstanceID:                instanceID,
+		Backend:                   backend,
 	}
 	return cfg
 }
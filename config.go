@@ -0,0 +1,330 @@
+package gsr
+
+// Services can store their runtime configuration in the registry as named
+// JSON documents, so that settings can be changed across every instance of a
+// service without redeploying it. Within the etcd3 key namespace, the
+// configuration documents of a service are stored as:
+//
+// $KEY_PREFIX (and namespace, if any)
+// |
+// -> /config
+//    |
+//    ->> /$SERVICE
+//        |
+//        -> /$DOCUMENT  <-- the JSON-encoded document
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/cenkalti/backoff"
+	"golang.org/x/net/context"
+)
+
+var (
+	ErrConfigNotFound    = errors.New("configuration document not found")
+	ErrInvalidConfigName = errors.New(
+		"configuration document name must be non-empty and not contain '/'",
+	)
+)
+
+// ServiceConfig reads, writes and watches the configuration documents of a
+// single service. It is returned by Registry.Config().
+type ServiceConfig struct {
+	r       *Registry
+	service string
+}
+
+// ConfigEvent describes a change to a configuration document delivered to the
+// callback supplied to ServiceConfig.Watch().
+type ConfigEvent struct {
+	// Name is the name of the document that changed.
+	Name string
+	// Deleted is true if the document was removed. Value is then empty.
+	Deleted bool
+	// Value is the JSON-encoded document.
+	Value json.RawMessage
+	// Revision is the etcd revision at which the change was made.
+	Revision int64
+}
+
+// Decode unmarshals the changed document into the supplied value.
+func (ev *ConfigEvent) Decode(v interface{}) error {
+	if ev.Deleted {
+		return ErrConfigNotFound
+	}
+	return json.Unmarshal(ev.Value, v)
+}
+
+// Config returns the configuration documents of the supplied service.
+func (r *Registry) Config(service string) (*ServiceConfig, error) {
+	if err := validateServiceName(service); err != nil {
+		return nil, err
+	}
+	return &ServiceConfig{r: r, service: service}, nil
+}
+
+func validateConfigName(name string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return ErrInvalidConfigName
+	}
+	return nil
+}
+
+// Returns the etcd key prefix of the service's configuration documents.
+func (sc *ServiceConfig) prefix() string {
+	return sc.r.namespaceKey() + "config/" + sc.service + "/"
+}
+
+// Get unmarshals the named configuration document into the supplied value,
+// which should be a pointer, e.g. to a struct with JSON tags.
+// ErrConfigNotFound is returned if the document does not exist.
+func (sc *ServiceConfig) Get(name string, v interface{}) error {
+	if err := validateConfigName(name); err != nil {
+		return err
+	}
+	r := sc.r
+	b := r.backend
+	ctx, cancel := r.requestCtx()
+	resp, err := b.Get(ctx, sc.prefix()+name, nil)
+	cancel()
+	if err != nil {
+		r.L2("error reading config %s for %s: %v", name, sc.service, err)
+		return err
+	}
+	if len(resp.KVs) == 0 {
+		return ErrConfigNotFound
+	}
+	return json.Unmarshal(resp.KVs[0].Value, v)
+}
+
+// Set creates or replaces the named configuration document with the JSON
+// encoding of the supplied value. Like service definitions, configuration
+// documents are not attached to a lease.
+func (sc *ServiceConfig) Set(name string, v interface{}) error {
+	if err := validateConfigName(name); err != nil {
+		return err
+	}
+	val, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	r := sc.r
+	b := r.backend
+
+	r.L2("writing config %s for %s", name, sc.service)
+
+	ctx, cancel := r.requestCtx()
+	_, err = b.Put(ctx, sc.prefix()+name, val, nil)
+	cancel()
+	if err != nil {
+		r.LERR("failed to write config %s for %s: %v", name, sc.service, err)
+		return err
+	}
+	return nil
+}
+
+// Delete removes the named configuration document. ErrConfigNotFound is
+// returned if the document does not exist.
+func (sc *ServiceConfig) Delete(name string) error {
+	if err := validateConfigName(name); err != nil {
+		return err
+	}
+	r := sc.r
+	b := r.backend
+	ctx, cancel := r.requestCtx()
+	deleted, err := b.Delete(ctx, sc.prefix()+name, nil)
+	cancel()
+	if err != nil {
+		r.LERR("failed to delete config %s for %s: %v", name, sc.service, err)
+		return err
+	}
+	if deleted == 0 {
+		return ErrConfigNotFound
+	}
+	return nil
+}
+
+// Names returns the names of the service's configuration documents, in
+// sorted order.
+func (sc *ServiceConfig) Names() ([]string, error) {
+	r := sc.r
+	b := r.backend
+	prefix := sc.prefix()
+	ctx, cancel := r.requestCtx()
+	resp, err := b.Get(ctx, prefix, &GetOptions{Prefix: true, KeysOnly: true})
+	cancel()
+	if err != nil {
+		r.L2("error listing config for %s: %v", sc.service, err)
+		return nil, err
+	}
+	names := make([]string, len(resp.KVs))
+	for x, kv := range resp.KVs {
+		names[x] = kv.Key[len(prefix):]
+	}
+	return names, nil
+}
+
+// Watch calls the supplied function each time the named configuration
+// document changes. An empty name watches every document of the service.
+// Before Watch returns, the function is called with the current value of each
+// watched document that exists, so callers can apply their configuration from
+// a single place. Later calls are made one at a time from a separate goroutine
+// until the supplied context is done.
+//
+// A watch that is lost is resumed from the last revision seen, so that no
+// change is missed. If that revision has been compacted away, the documents
+// are read again and the function is called for each one that changed or was
+// deleted in the meantime.
+func (sc *ServiceConfig) Watch(
+	ctx context.Context,
+	name string,
+	fn func(*ConfigEvent),
+) error {
+	key := sc.prefix()
+	isPrefix := name == ""
+	if !isPrefix {
+		if err := validateConfigName(name); err != nil {
+			return err
+		}
+		key += name
+	}
+	w := &configWatch{
+		sc:       sc,
+		key:      key,
+		isPrefix: isPrefix,
+		fn:       fn,
+		docs:     make(map[string]int64, 0),
+	}
+	if err := w.read(); err != nil {
+		return err
+	}
+	go w.run(ctx)
+	return nil
+}
+
+// configWatch follows the changes to the configuration documents watched by
+// ServiceConfig.Watch().
+type configWatch struct {
+	sc       *ServiceConfig
+	key      string
+	isPrefix bool
+	fn       func(*ConfigEvent)
+	// rev is the last revision seen, and docs the revision at which each
+	// watched document was last changed
+	rev  int64
+	docs map[string]int64
+}
+
+// Reads the watched documents, calling the watch's function for each one that
+// differs from what the watch last saw, including those since deleted.
+func (w *configWatch) read() error {
+	r := w.sc.r
+	b := r.backend
+	ctx, cancel := r.requestCtx()
+	resp, err := b.Get(ctx, w.key, &GetOptions{Prefix: w.isPrefix})
+	cancel()
+	if err != nil {
+		r.L2("error reading config for %s: %v", w.sc.service, err)
+		return err
+	}
+	prefix := w.sc.prefix()
+	docs := make(map[string]int64, len(resp.KVs))
+	for _, kv := range resp.KVs {
+		name := kv.Key[len(prefix):]
+		docs[name] = kv.ModRevision
+		if w.docs[name] == kv.ModRevision {
+			continue
+		}
+		w.fn(&ConfigEvent{
+			Name:     name,
+			Value:    kv.Value,
+			Revision: kv.ModRevision,
+		})
+	}
+	for name := range w.docs {
+		if _, found := docs[name]; !found {
+			w.fn(&ConfigEvent{
+				Name:     name,
+				Deleted:  true,
+				Revision: resp.Revision,
+			})
+		}
+	}
+	w.docs = docs
+	w.rev = resp.Revision
+	return nil
+}
+
+// Watches the documents from the last revision seen until the supplied
+// context is done, resuming the watch whenever it is lost.
+func (w *configWatch) run(ctx context.Context) {
+	r := w.sc.r
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = watchRetryInterval
+	bo.MaxInterval = watchRetryMaxInterval
+	bo.MaxElapsedTime = 0
+	for {
+		wch := r.backend.Watch(ctx, w.key, &WatchOptions{
+			Prefix:   w.isPrefix,
+			Revision: w.rev + 1,
+		})
+		err := w.readWatch(wch, bo)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == ErrCompacted {
+			r.LERR("changes to config for %s since generation %d have "+
+				"been compacted. reading it again.", w.sc.service, w.rev)
+		} else {
+			r.LERR("lost watch on config for %s: %v. resuming @ "+
+				"generation %d.", w.sc.service, err, w.rev+1)
+		}
+		for {
+			if !sleepCtx(ctx, bo.NextBackOff()) {
+				return
+			}
+			if err != ErrCompacted {
+				break
+			}
+			if w.read() == nil {
+				break
+			}
+		}
+	}
+}
+
+// Calls the watch's function for each change delivered on a watch of the
+// documents until the watch ends, and returns the error it ended with. Each
+// response received resets the supplied backoff.
+func (w *configWatch) readWatch(
+	wch <-chan *WatchResponse,
+	bo backoff.BackOff,
+) error {
+	prefix := w.sc.prefix()
+	for wresp := range wch {
+		if wresp.Err != nil {
+			return wresp.Err
+		}
+		bo.Reset()
+		for _, ev := range wresp.Events {
+			if ev.KV.ModRevision > w.rev {
+				w.rev = ev.KV.ModRevision
+			}
+			cev := &ConfigEvent{
+				Name:     ev.KV.Key[len(prefix):],
+				Revision: ev.KV.ModRevision,
+			}
+			if ev.Type == KVDelete {
+				cev.Deleted = true
+				delete(w.docs, cev.Name)
+			} else {
+				cev.Value = ev.KV.Value
+				w.docs[cev.Name] = ev.KV.ModRevision
+			}
+			w.fn(cev)
+		}
+	}
+	return errWatchClosed
+}
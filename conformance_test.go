@@ -0,0 +1,32 @@
+package gsr_test
+
+import (
+	"testing"
+
+	"github.com/jaypipes/gsr"
+	"github.com/jaypipes/gsr/gsrtest"
+)
+
+func TestMemBackendConformance(t *testing.T) {
+	factory, stop := gsr.MemBackendFactory()
+	defer stop()
+	gsrtest.BackendConformance(t, factory)
+}
+
+func TestConsulBackendConformance(t *testing.T) {
+	factory, stop := gsr.ConsulBackendFactory()
+	defer stop()
+	gsrtest.BackendConformance(t, factory)
+}
+
+func TestZKBackendConformance(t *testing.T) {
+	factory, stop := gsr.ZKBackendFactory()
+	defer stop()
+	gsrtest.BackendConformance(t, factory)
+}
+
+func TestRedisBackendConformance(t *testing.T) {
+	factory, stop := gsr.RedisBackendFactory(t)
+	defer stop()
+	gsrtest.BackendConformance(t, factory)
+}
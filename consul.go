@@ -0,0 +1,705 @@
+package gsr
+
+// The consul backend stores the registry in Consul's KV store:
+//
+//   GSR_BACKEND=consul://127.0.0.1:8500
+//
+// Consul sessions stand in for leases. They are created with the "delete"
+// behavior, so keys attached to a session are deleted when the session expires
+// or is destroyed, just like keys attached to an etcd lease. Watches are
+// implemented with blocking queries.
+//
+// Consul's indexes are used as revisions. Consul does not count the writes to
+// a key, so the backend counts them in the key's flags. Consul keeps no
+// history of changes, so reads and watches at a past revision fail as the
+// Backend contract (see backend.go) describes.
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// How long a blocking query waits for a change before returning.
+const consulWatchWait = "30s"
+
+type consulBackend struct {
+	addr   string
+	client *http.Client
+	// mu protects sessions, which maps the leases we know about to the IDs
+	// of the Consul sessions they stand for. Sessions are forgotten once
+	// they are revoked or found to be gone.
+	mu       sync.Mutex
+	sessions map[LeaseID]string
+	closed   chan struct{}
+}
+
+func newConsulBackend(addr string) *consulBackend {
+	return &consulBackend{
+		addr:     strings.TrimRight(addr, "/"),
+		client:   &http.Client{},
+		sessions: make(map[LeaseID]string, 0),
+		closed:   make(chan struct{}),
+	}
+}
+
+// A KV entry as returned by Consul.
+type consulKV struct {
+	Key         string
+	Value       []byte
+	CreateIndex int64
+	ModifyIndex int64
+	// Flags holds the number of writes to the key
+	Flags   uint64
+	Session string `json:",omitempty"`
+}
+
+// Returns the lease standing for a Consul session ID, remembering the
+// session so that the lease can be looked up later.
+func (b *consulBackend) leaseFor(session string) LeaseID {
+	if session == "" {
+		return NoLease
+	}
+	// Session IDs are UUIDs. Their first 64 bits make a stable lease ID.
+	raw, err := hex.DecodeString(strings.Replace(session, "-", "", -1))
+	var id int64
+	if err == nil && len(raw) >= 8 {
+		for _, c := range raw[:8] {
+			id = id<<8 | int64(c)
+		}
+	}
+	id &= 0x7fffffffffffffff
+	if id == 0 {
+		id = 1
+	}
+	b.mu.Lock()
+	b.sessions[LeaseID(id)] = session
+	b.mu.Unlock()
+	return LeaseID(id)
+}
+
+// Returns the Consul session ID a lease stands for.
+func (b *consulBackend) sessionFor(lease LeaseID) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	session, found := b.sessions[lease]
+	if !found {
+		return "", ErrLeaseNotFound
+	}
+	return session, nil
+}
+
+// Forgets the Consul session a lease stands for.
+func (b *consulBackend) forget(lease LeaseID) {
+	b.mu.Lock()
+	delete(b.sessions, lease)
+	b.mu.Unlock()
+}
+
+// Returns the number of writes to the key. Keys written by other Consul
+// clients have no count, and are taken to be at their first version.
+func (kv *consulKV) version() uint64 {
+	if kv.Flags == 0 {
+		return 1
+	}
+	return kv.Flags
+}
+
+func (kv *consulKV) toKeyValue(b *consulBackend) *KeyValue {
+	return &KeyValue{
+		Key:            kv.Key,
+		Value:          kv.Value,
+		CreateRevision: kv.CreateIndex,
+		ModRevision:    kv.ModifyIndex,
+		Version:        int64(kv.version()),
+		Lease:          b.leaseFor(kv.Session),
+	}
+}
+
+// Sends a request to Consul. A nil body sends no body. The response body is
+// decoded into out, if it is not nil. The Consul index of the response is
+// returned along with its status code.
+func (b *consulBackend) do(
+	ctx context.Context,
+	method string,
+	path string,
+	query url.Values,
+	body interface{},
+	out interface{},
+) (int, int64, error) {
+	u := b.addr + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var rd io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return 0, 0, err
+		}
+		rd = bytes.NewReader(buf)
+	}
+	req, err := http.NewRequest(method, u, rd)
+	if err != nil {
+		return 0, 0, err
+	}
+	resp, err := b.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	index, _ := strconv.ParseInt(resp.Header.Get("X-Consul-Index"), 10, 64)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return resp.StatusCode, index, nil
+	case resp.StatusCode == http.StatusConflict:
+		// Failed transactions; the caller decides what that means
+		return resp.StatusCode, index, nil
+	case resp.StatusCode >= 300:
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, index, fmt.Errorf(
+			"consul: %s %s: %s: %s", method, path, resp.Status,
+			strings.TrimSpace(string(msg)),
+		)
+	}
+	if out != nil {
+		if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, index, err
+		}
+	}
+	return resp.StatusCode, index, nil
+}
+
+// Reads a key, or every key beginning with it, and the Consul index of the
+// read. A non-zero index makes a blocking query that returns once the index
+// has moved past it.
+func (b *consulBackend) read(
+	ctx context.Context,
+	key string,
+	prefix bool,
+	index int64,
+) ([]*consulKV, int64, error) {
+	q := url.Values{}
+	if prefix {
+		q.Set("recurse", "")
+	}
+	if index != 0 {
+		q.Set("index", strconv.FormatInt(index, 10))
+		q.Set("wait", consulWatchWait)
+	}
+	kvs := make([]*consulKV, 0)
+	status, idx, err := b.do(ctx, "GET", "/v1/kv/"+key, q, nil, &kvs)
+	if err != nil {
+		return nil, 0, err
+	}
+	if status == http.StatusNotFound {
+		kvs = kvs[:0]
+	}
+	sort.Slice(kvs, func(i, j int) bool {
+		return kvs[i].Key < kvs[j].Key
+	})
+	return kvs, idx, nil
+}
+
+func (b *consulBackend) Get(
+	ctx context.Context,
+	key string,
+	opts *GetOptions,
+) (*GetResponse, error) {
+	if opts == nil {
+		opts = &GetOptions{}
+	}
+	kvs, index, err := b.read(ctx, key, opts.Prefix, 0)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Revision != 0 && index > opts.Revision {
+		return nil, ErrCompacted
+	}
+	res := &GetResponse{KVs: make([]*KeyValue, len(kvs)), Revision: index}
+	for x, kv := range kvs {
+		res.KVs[x] = kv.toKeyValue(b)
+		if opts.KeysOnly {
+			res.KVs[x].Value = nil
+		}
+	}
+	return res, nil
+}
+
+// An operation in a Consul transaction.
+type consulTxnOp struct {
+	KV *consulTxnKV
+}
+
+type consulTxnKV struct {
+	Verb    string
+	Key     string
+	Value   []byte `json:",omitempty"`
+	Index   int64  `json:",omitempty"`
+	Flags   uint64 `json:",omitempty"`
+	Session string `json:",omitempty"`
+}
+
+type consulTxnResult struct {
+	Results []struct {
+		KV *consulKV
+	}
+	Errors []struct {
+		OpIndex int
+		What    string
+	}
+}
+
+// Evaluates conditions against the current state of their keys and returns
+// transaction operations that fail if any of those keys change before the
+// transaction is applied. ErrCompareFailed is returned if a condition does
+// not hold.
+func (b *consulBackend) guard(
+	ctx context.Context,
+	conds []Condition,
+) ([]*consulTxnOp, error) {
+	ops := make([]*consulTxnOp, 0, len(conds))
+	seen := make(map[string]bool, 0)
+	for _, c := range conds {
+		kvs, _, err := b.read(ctx, c.Key, false, 0)
+		if err != nil {
+			return nil, err
+		}
+		var kv *KeyValue
+		if len(kvs) > 0 {
+			kv = kvs[0].toKeyValue(b)
+		}
+		if !c.Holds(kv) {
+			return nil, ErrCompareFailed
+		}
+		if seen[c.Key] {
+			continue
+		}
+		seen[c.Key] = true
+		if kv == nil {
+			ops = append(ops, &consulTxnOp{KV: &consulTxnKV{
+				Verb: "check-not-exists",
+				Key:  c.Key,
+			}})
+		} else {
+			ops = append(ops, &consulTxnOp{KV: &consulTxnKV{
+				Verb:  "check-index",
+				Key:   c.Key,
+				Index: kv.ModRevision,
+			}})
+		}
+	}
+	return ops, nil
+}
+
+// Applies a transaction. ErrCompareFailed is returned if it fails, along with
+// the results, which hold the index of the operation that failed.
+func (b *consulBackend) txn(
+	ctx context.Context,
+	ops []*consulTxnOp,
+) (*consulTxnResult, error) {
+	res := &consulTxnResult{}
+	status, _, err := b.do(ctx, "PUT", "/v1/txn", nil, ops, res)
+	if err != nil {
+		return nil, err
+	}
+	if status == http.StatusConflict {
+		return res, ErrCompareFailed
+	}
+	return res, nil
+}
+
+// Returns true if a failed transaction failed at the operation with the
+// supplied index.
+func (res *consulTxnResult) failedAt(op int) bool {
+	for _, e := range res.Errors {
+		if e.OpIndex == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *consulBackend) Put(
+	ctx context.Context,
+	key string,
+	val []byte,
+	opts *PutOptions,
+) (int64, error) {
+	if opts == nil {
+		opts = &PutOptions{}
+	}
+	for {
+		ops, err := b.guard(ctx, opts.If)
+		if err != nil {
+			return 0, err
+		}
+		// The key's version is counted from its current one, so the write
+		// only goes ahead if the key has not changed since it was read
+		kvs, _, err := b.read(ctx, key, false, 0)
+		if err != nil {
+			return 0, err
+		}
+		check := &consulTxnKV{Verb: "check-not-exists", Key: key}
+		op := &consulTxnKV{Verb: "set", Key: key, Value: val, Flags: 1}
+		held := ""
+		if len(kvs) > 0 {
+			check.Verb, check.Index = "check-index", kvs[0].ModifyIndex
+			op.Flags = kvs[0].version() + 1
+			held = kvs[0].Session
+		}
+		checkAt, unlockAt := len(ops), -1
+		ops = append(ops, &consulTxnOp{KV: check})
+		if !opts.IgnoreLease {
+			session := ""
+			if opts.Lease != NoLease {
+				if session, err = b.sessionFor(opts.Lease); err != nil {
+					return 0, err
+				}
+			}
+			// As with etcd, the key leaves the session holding it. Only
+			// that session may release it.
+			if held != "" && held != session {
+				unlockAt = len(ops)
+				ops = append(ops, &consulTxnOp{KV: &consulTxnKV{
+					Verb:    "unlock",
+					Key:     key,
+					Value:   val,
+					Flags:   op.Flags,
+					Session: held,
+				}})
+			}
+			if session != "" {
+				// Acquiring the key attaches it to the session
+				op.Verb, op.Session = "lock", session
+			}
+		}
+		ops = append(ops, &consulTxnOp{KV: op})
+		res, err := b.txn(ctx, ops)
+		if err == ErrCompareFailed &&
+			(res.failedAt(checkAt) || res.failedAt(unlockAt)) {
+			// The key was written concurrently, or its session ended. Its
+			// conditions are evaluated again before retrying.
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		var rev int64
+		for _, r := range res.Results {
+			if r.KV != nil && r.KV.Key == key {
+				rev = r.KV.ModifyIndex
+			}
+		}
+		if rev == 0 {
+			return 0, fmt.Errorf("consul: no result for %s in transaction", key)
+		}
+		return rev, nil
+	}
+}
+
+func (b *consulBackend) Delete(
+	ctx context.Context,
+	key string,
+	opts *DeleteOptions,
+) (int64, error) {
+	if opts == nil {
+		opts = &DeleteOptions{}
+	}
+	ops, err := b.guard(ctx, opts.If)
+	if err != nil {
+		return 0, err
+	}
+	kvs, _, err := b.read(ctx, key, opts.Prefix, 0)
+	if err != nil {
+		return 0, err
+	}
+	if len(kvs) == 0 {
+		return 0, nil
+	}
+	verb := "delete"
+	if opts.Prefix {
+		verb = "delete-tree"
+	}
+	ops = append(ops, &consulTxnOp{KV: &consulTxnKV{Verb: verb, Key: key}})
+	if _, err = b.txn(ctx, ops); err != nil {
+		return 0, err
+	}
+	return int64(len(kvs)), nil
+}
+
+type consulSession struct {
+	ID        string
+	TTL       string
+	Behavior  string `json:",omitempty"`
+	LockDelay string `json:",omitempty"`
+}
+
+func (b *consulBackend) Grant(ctx context.Context, ttl int64) (LeaseID, error) {
+	req := &consulSession{
+		TTL:      fmt.Sprintf("%ds", ttl),
+		Behavior: "delete",
+		// Let other processes take over keys as soon as a session ends, as
+		// they can with etcd leases
+		LockDelay: "0s",
+	}
+	res := &consulSession{}
+	_, _, err := b.do(ctx, "PUT", "/v1/session/create", nil, req, res)
+	if err != nil {
+		return NoLease, err
+	}
+	return b.leaseFor(res.ID), nil
+}
+
+// Returns the session a lease stands for, or nil if it does not exist.
+func (b *consulBackend) info(
+	ctx context.Context,
+	lease LeaseID,
+) (*consulSession, error) {
+	session, err := b.sessionFor(lease)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]*consulSession, 0)
+	_, _, err = b.do(ctx, "GET", "/v1/session/info/"+session, nil, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+	if len(res) == 0 {
+		b.forget(lease)
+		return nil, nil
+	}
+	return res[0], nil
+}
+
+func (b *consulBackend) KeepAlive(
+	ctx context.Context,
+	lease LeaseID,
+) (<-chan struct{}, error) {
+	s, err := b.info(ctx, lease)
+	if err != nil {
+		return nil, err
+	}
+	if s == nil {
+		return nil, ErrLeaseNotFound
+	}
+	ttl, err := time.ParseDuration(s.TTL)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		t := time.NewTicker(ttl / 3)
+		defer t.Stop()
+		for {
+			res := make([]*consulSession, 0)
+			status, _, err := b.do(
+				ctx, "PUT", "/v1/session/renew/"+s.ID, nil, nil, &res,
+			)
+			if err == nil && status == http.StatusNotFound {
+				// The session has expired
+				b.forget(lease)
+				return
+			}
+			if err == nil {
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			case <-b.closed:
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (b *consulBackend) Revoke(ctx context.Context, lease LeaseID) error {
+	// Consul does not report destroying a session that does not exist
+	s, err := b.info(ctx, lease)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		return ErrLeaseNotFound
+	}
+	_, _, err = b.do(ctx, "PUT", "/v1/session/destroy/"+s.ID, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	b.forget(lease)
+	return nil
+}
+
+// Consul does not report the remaining TTL of a session, so a session that
+// exists is reported as having its full TTL left.
+func (b *consulBackend) TimeToLive(
+	ctx context.Context,
+	lease LeaseID,
+) (int64, int64, error) {
+	s, err := b.info(ctx, lease)
+	if err != nil {
+		return 0, 0, err
+	}
+	if s == nil {
+		return 0, 0, ErrLeaseNotFound
+	}
+	ttl, err := time.ParseDuration(s.TTL)
+	if err != nil {
+		return 0, 0, err
+	}
+	secs := int64(ttl / time.Second)
+	return secs, secs, nil
+}
+
+func (b *consulBackend) Watch(
+	ctx context.Context,
+	key string,
+	opts *WatchOptions,
+) <-chan *WatchResponse {
+	if opts == nil {
+		opts = &WatchOptions{}
+	}
+	ch := make(chan *WatchResponse)
+	// Blocking queries can take a while to return, so cancel them when the
+	// backend is closed
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-b.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	// The first read is made before returning, so that changes made once
+	// Watch returns are seen by the watch
+	kvs, index, err := b.read(ctx, key, opts.Prefix, 0)
+	go func() {
+		defer cancel()
+		b.watch(ctx, key, opts, kvs, index, err, ch)
+	}()
+	return ch
+}
+
+// Polls a key or prefix with blocking queries, starting from the supplied
+// read, and sends the differences between successive reads as events.
+func (b *consulBackend) watch(
+	ctx context.Context,
+	key string,
+	opts *WatchOptions,
+	kvs []*consulKV,
+	index int64,
+	err error,
+	ch chan<- *WatchResponse,
+) {
+	defer close(ch)
+	send := func(resp *WatchResponse) bool {
+		select {
+		case ch <- resp:
+			return true
+		case <-ctx.Done():
+			return false
+		case <-b.closed:
+			return false
+		}
+	}
+
+	if err != nil {
+		send(&WatchResponse{Err: err})
+		return
+	}
+	if opts.Revision != 0 && index >= opts.Revision {
+		// See point 5 of the Backend contract
+		send(&WatchResponse{Err: ErrCompacted, Revision: index})
+		return
+	}
+	last := make(map[string]*consulKV, len(kvs))
+	for _, kv := range kvs {
+		last[kv.Key] = kv
+	}
+
+	for {
+		kvs, next, err := b.read(ctx, key, opts.Prefix, index)
+		if err != nil {
+			if ctx.Err() == nil {
+				send(&WatchResponse{Err: err})
+			}
+			return
+		}
+		if next < index {
+			// Consul's index went backwards, e.g. after a restore. Start
+			// over from the current state.
+			next = 0
+		}
+		index = next
+		cur := make(map[string]*consulKV, len(kvs))
+		resp := &WatchResponse{Revision: index}
+		for _, kv := range kvs {
+			cur[kv.Key] = kv
+			if prev, found := last[kv.Key]; found &&
+				prev.ModifyIndex == kv.ModifyIndex {
+				continue
+			}
+			resp.Events = append(resp.Events, &KVEvent{
+				Type: KVPut,
+				KV:   kv.toKeyValue(b),
+			})
+		}
+		deleted := make([]string, 0)
+		for k := range last {
+			if _, found := cur[k]; !found {
+				deleted = append(deleted, k)
+			}
+		}
+		sort.Strings(deleted)
+		for _, k := range deleted {
+			resp.Events = append(resp.Events, &KVEvent{
+				Type: KVDelete,
+				KV:   &KeyValue{Key: k, ModRevision: index},
+			})
+		}
+		last = cur
+		if len(resp.Events) > 0 && !send(resp) {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-b.closed:
+			return
+		default:
+		}
+	}
+}
+
+func (b *consulBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.closed:
+	default:
+		close(b.closed)
+	}
+	return nil
+}
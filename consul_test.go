@@ -0,0 +1,537 @@
+package gsr
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// fakeConsul implements the subset of the Consul HTTP API used by the consul
+// backend: the KV store with blocking queries, transactions and sessions.
+type fakeConsul struct {
+	mu         sync.Mutex
+	index      int64
+	kvs        map[string]*consulKV
+	tombstones map[string]int64
+	sessions   map[string]*fakeSession
+	nextID     int
+	// changed is closed and replaced whenever the KV store changes
+	changed chan struct{}
+	done    chan struct{}
+}
+
+type fakeSession struct {
+	ttl     time.Duration
+	expires time.Time
+}
+
+func newFakeConsul() (*fakeConsul, *httptest.Server) {
+	c := &fakeConsul{
+		kvs:        make(map[string]*consulKV, 0),
+		tombstones: make(map[string]int64, 0),
+		sessions:   make(map[string]*fakeSession, 0),
+		changed:    make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/kv/", c.handleKV)
+	mux.HandleFunc("/v1/txn", c.handleTxn)
+	mux.HandleFunc("/v1/session/", c.handleSession)
+	srv := httptest.NewServer(mux)
+	go c.expire()
+	return c, srv
+}
+
+func (c *fakeConsul) stop(srv *httptest.Server) {
+	close(c.done)
+	srv.Close()
+}
+
+func (c *fakeConsul) expire() {
+	t := time.NewTicker(50 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-t.C:
+			c.mu.Lock()
+			for id, s := range c.sessions {
+				if now.After(s.expires) {
+					c.destroyLocked(id)
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// Must be called with c.mu held.
+func (c *fakeConsul) notifyLocked() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// Must be called with c.mu held.
+func (c *fakeConsul) deleteLocked(key string) {
+	c.index++
+	delete(c.kvs, key)
+	c.tombstones[key] = c.index
+}
+
+// Must be called with c.mu held.
+func (c *fakeConsul) destroyLocked(id string) {
+	delete(c.sessions, id)
+	for k, kv := range c.kvs {
+		if kv.Session == id {
+			c.deleteLocked(k)
+		}
+	}
+	c.notifyLocked()
+}
+
+// Returns the entries matching a key and the index of the last change to
+// them, as Consul does for KV reads. Must be called with c.mu held.
+func (c *fakeConsul) matchLocked(key string, recurse bool) ([]*consulKV, int64) {
+	match := func(k string) bool {
+		if recurse {
+			return strings.HasPrefix(k, key)
+		}
+		return k == key
+	}
+	res := make([]*consulKV, 0)
+	index := int64(1)
+	for k, kv := range c.kvs {
+		if match(k) {
+			cp := *kv
+			res = append(res, &cp)
+			if kv.ModifyIndex > index {
+				index = kv.ModifyIndex
+			}
+		}
+	}
+	for k, idx := range c.tombstones {
+		if match(k) && idx > index {
+			index = idx
+		}
+	}
+	return res, index
+}
+
+func (c *fakeConsul) handleKV(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+		return
+	}
+	key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+	q := r.URL.Query()
+	_, recurse := q["recurse"]
+	wait, _ := strconv.ParseInt(q.Get("index"), 10, 64)
+	deadline := time.After(time.Second)
+
+	c.mu.Lock()
+	kvs, index := c.matchLocked(key, recurse)
+	for wait != 0 && index <= wait {
+		changed := c.changed
+		c.mu.Unlock()
+		select {
+		case <-changed:
+		case <-deadline:
+			wait = 0
+		case <-r.Context().Done():
+			return
+		}
+		c.mu.Lock()
+		kvs, index = c.matchLocked(key, recurse)
+	}
+	c.mu.Unlock()
+
+	w.Header().Set("X-Consul-Index", strconv.FormatInt(index, 10))
+	if len(kvs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(kvs)
+}
+
+func (c *fakeConsul) handleTxn(w http.ResponseWriter, r *http.Request) {
+	ops := make([]*consulTxnOp, 0)
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Checks are evaluated before anything is applied, so a failed
+	// transaction changes nothing. released holds the keys unlocked by
+	// earlier operations of the transaction.
+	released := make(map[string]bool, 0)
+	for x, op := range ops {
+		kv, found := c.kvs[op.KV.Key]
+		holder := ""
+		if found && !released[op.KV.Key] {
+			holder = kv.Session
+		}
+		ok := true
+		switch op.KV.Verb {
+		case "check-index":
+			ok = found && kv.ModifyIndex == op.KV.Index
+		case "check-not-exists":
+			ok = !found
+		case "lock":
+			_, live := c.sessions[op.KV.Session]
+			ok = live && (holder == "" || holder == op.KV.Session)
+		case "unlock":
+			ok = found && holder == op.KV.Session
+			released[op.KV.Key] = true
+		}
+		if !ok {
+			w.WriteHeader(http.StatusConflict)
+			fmt.Fprintf(w, `{"Errors":[{"OpIndex":%d,"What":"failed %s"}]}`,
+				x, op.KV.Verb)
+			return
+		}
+	}
+	res := &consulTxnResult{}
+	for _, op := range ops {
+		key := op.KV.Key
+		switch op.KV.Verb {
+		case "set", "lock", "unlock":
+			c.index++
+			kv, found := c.kvs[key]
+			if !found {
+				kv = &consulKV{Key: key, CreateIndex: c.index}
+				c.kvs[key] = kv
+			}
+			kv.Value = op.KV.Value
+			kv.Flags = op.KV.Flags
+			kv.ModifyIndex = c.index
+			switch op.KV.Verb {
+			case "lock":
+				kv.Session = op.KV.Session
+			case "unlock":
+				kv.Session = ""
+			}
+			cp := *kv
+			cp.Value = nil
+			res.Results = append(res.Results, struct{ KV *consulKV }{&cp})
+		case "delete":
+			if _, found := c.kvs[key]; found {
+				c.deleteLocked(key)
+			}
+		case "delete-tree":
+			for k := range c.kvs {
+				if strings.HasPrefix(k, key) {
+					c.deleteLocked(k)
+				}
+			}
+		}
+	}
+	c.notifyLocked()
+	json.NewEncoder(w).Encode(res)
+}
+
+func (c *fakeConsul) handleSession(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/v1/session/"), "/", 2)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	info := func(id string) []*consulSession {
+		s, found := c.sessions[id]
+		if !found {
+			return []*consulSession{}
+		}
+		return []*consulSession{{ID: id, TTL: s.ttl.String()}}
+	}
+	switch parts[0] {
+	case "create":
+		req := &consulSession{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || req.Behavior != "delete" {
+			http.Error(w, "bad session", http.StatusBadRequest)
+			return
+		}
+		c.nextID++
+		id := fmt.Sprintf("%08x-0000-4000-8000-000000000000", c.nextID)
+		c.sessions[id] = &fakeSession{ttl: ttl, expires: time.Now().Add(ttl)}
+		json.NewEncoder(w).Encode(&consulSession{ID: id})
+	case "renew":
+		s, found := c.sessions[parts[1]]
+		if !found {
+			http.Error(w, "session not found", http.StatusNotFound)
+			return
+		}
+		s.expires = time.Now().Add(s.ttl)
+		json.NewEncoder(w).Encode(info(parts[1]))
+	case "destroy":
+		if _, found := c.sessions[parts[1]]; found {
+			c.destroyLocked(parts[1])
+		}
+		w.Write([]byte("true"))
+	case "info":
+		json.NewEncoder(w).Encode(info(parts[1]))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestConsulBackendConditions(t *testing.T) {
+	c, srv := newFakeConsul()
+	defer c.stop(srv)
+	b := newConsulBackend(srv.URL)
+	defer b.Close()
+	ctx := context.Background()
+
+	create := &PutOptions{
+		If: []Condition{{Key: "k", Target: CompareVersion, Op: "=", Value: 0}},
+	}
+	rev, err := b.Put(ctx, "k", []byte("v1"), create)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if _, err = b.Put(ctx, "k", []byte("v2"), create); err != ErrCompareFailed {
+		t.Fatalf("Expected ErrCompareFailed, but got %v.", err)
+	}
+	update := &PutOptions{
+		If: []Condition{
+			{Key: "k", Target: CompareModRevision, Op: "=", Value: rev},
+		},
+	}
+	rev2, err := b.Put(ctx, "k", []byte("v2"), update)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if rev2 <= rev {
+		t.Fatalf("Expected revision greater than %d, but got %d.", rev, rev2)
+	}
+	if _, err = b.Put(ctx, "k", []byte("v3"), update); err != ErrCompareFailed {
+		t.Fatalf("Expected ErrCompareFailed, but got %v.", err)
+	}
+
+	resp, err := b.Get(ctx, "k", nil)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	kv := resp.KVs[0]
+	if string(kv.Value) != "v2" || kv.CreateRevision != rev {
+		t.Fatalf("Expected v2 created at %d, but got %+v.", rev, kv)
+	}
+
+	// There is no history to read past revisions from
+	if _, err = b.Get(ctx, "k", &GetOptions{Revision: rev}); err != ErrCompacted {
+		t.Fatalf("Expected ErrCompacted, but got %v.", err)
+	}
+
+	b.Put(ctx, "d/1", nil, nil)
+	b.Put(ctx, "d/2", nil, nil)
+	n, err := b.Delete(ctx, "d/", &DeleteOptions{Prefix: true})
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if n != 2 {
+		t.Fatalf("Expected 2 keys deleted, but got %d.", n)
+	}
+	resp, _ = b.Get(ctx, "d/", &GetOptions{Prefix: true})
+	if len(resp.KVs) != 0 {
+		t.Fatalf("Expected no keys, but got %v.", resp.KVs)
+	}
+}
+
+func TestConsulBackendLeases(t *testing.T) {
+	c, srv := newFakeConsul()
+	defer c.stop(srv)
+	b := newConsulBackend(srv.URL)
+	defer b.Close()
+	ctx := context.Background()
+
+	lease, err := b.Grant(ctx, 1)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if _, err = b.Put(ctx, "a/1", nil, &PutOptions{Lease: lease}); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if _, err = b.Put(ctx, "a/2", nil, nil); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	resp, _ := b.Get(ctx, "a/1", nil)
+	if resp.KVs[0].Lease != lease {
+		t.Fatalf("Expected lease %d, but got %d.", lease, resp.KVs[0].Lease)
+	}
+
+	// Without a keepalive, the session expires and takes its key with it
+	time.Sleep(1500 * time.Millisecond)
+	resp, err = b.Get(ctx, "a/", &GetOptions{Prefix: true})
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if len(resp.KVs) != 1 || resp.KVs[0].Key != "a/2" {
+		t.Fatalf("Expected only a/2, but got %v.", resp.KVs)
+	}
+	if _, _, err = b.TimeToLive(ctx, lease); err != ErrLeaseNotFound {
+		t.Fatalf("Expected ErrLeaseNotFound, but got %v.", err)
+	}
+
+	lease, err = b.Grant(ctx, 1)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	kactx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if _, err = b.KeepAlive(kactx, lease); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if _, _, err = b.TimeToLive(ctx, lease); err != nil {
+		t.Fatalf("Expected the lease to be kept alive, but got %v.", err)
+	}
+
+	b.Put(ctx, "a/3", nil, &PutOptions{Lease: lease})
+	if err = b.Revoke(ctx, lease); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	resp, _ = b.Get(ctx, "a/3", nil)
+	if len(resp.KVs) != 0 {
+		t.Fatalf("Expected a/3 to be deleted, but got %v.", resp.KVs)
+	}
+
+	// Neither the expired nor the revoked session is remembered
+	b.mu.Lock()
+	sessions := len(b.sessions)
+	b.mu.Unlock()
+	if sessions != 0 {
+		t.Fatalf("Expected no sessions, but got %d.", sessions)
+	}
+}
+
+func TestConsulBackendWatch(t *testing.T) {
+	c, srv := newFakeConsul()
+	defer c.stop(srv)
+	b := newConsulBackend(srv.URL)
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b.Put(ctx, "w/1", []byte("a"), nil)
+	resp, _ := b.Get(ctx, "w/", &GetOptions{Prefix: true})
+
+	wch := b.Watch(ctx, "w/", &WatchOptions{
+		Prefix:   true,
+		Revision: resp.Revision + 1,
+	})
+	expect := func(typ KVEventType, key string) {
+		select {
+		case resp := <-wch:
+			if resp.Err != nil {
+				t.Fatalf("Expected nil, but got %v.", resp.Err)
+			}
+			ev := resp.Events[0]
+			if ev.Type != typ || ev.KV.Key != key {
+				t.Fatalf("Expected %v of %s, but got %v of %s.",
+					typ, key, ev.Type, ev.KV.Key)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for watch event")
+		}
+	}
+	b.Put(ctx, "other", []byte("b"), nil)
+	b.Put(ctx, "w/2", []byte("c"), nil)
+	expect(KVPut, "w/2")
+	b.Delete(ctx, "w/1", nil)
+	expect(KVDelete, "w/1")
+
+	// Changes made before the watch started cannot be replayed
+	wch = b.Watch(ctx, "w/", &WatchOptions{
+		Prefix:   true,
+		Revision: resp.Revision + 1,
+	})
+	select {
+	case resp := <-wch:
+		if resp.Err != ErrCompacted {
+			t.Fatalf("Expected ErrCompacted, but got %v.", resp.Err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Timed out waiting for watch error")
+	}
+}
+
+func TestConsulBackendRegistry(t *testing.T) {
+	c, srv := newFakeConsul()
+	defer c.stop(srv)
+
+	orig, found := os.LookupEnv("GSR_BACKEND")
+	if !found {
+		defer os.Unsetenv("GSR_BACKEND")
+	} else {
+		defer os.Setenv("GSR_BACKEND", orig)
+	}
+	os.Setenv("GSR_BACKEND", "consul://"+strings.TrimPrefix(srv.URL, "http://"))
+
+	r, err := New()
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := r.Watch(ctx, "web", nil)
+
+	ep := Endpoint{Service: &Service{Name: "web"}, Address: "127.0.0.1:8080"}
+	if err = r.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	select {
+	case ev := <-events:
+		if ev.Type != EventCreated || ev.Endpoint.Address != ep.Address {
+			t.Fatalf("Expected %s of %s, but got %s of %s.",
+				EventCreated, ep.Address, ev.Type, ev.Endpoint.Address)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for %s of %s.", EventCreated, ep.Address)
+	}
+
+	// A second registry sharing the store sees the endpoint
+	r2, err := New()
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer r2.Close()
+	eps := r2.Endpoints("web")
+	if len(eps) != 1 || eps[0].Address != ep.Address {
+		t.Fatalf("Expected %s, but got %v.", ep.Address, eps)
+	}
+
+	snap, err := r2.Snapshot()
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if len(snap.Services) != 1 || len(snap.Services[0].Endpoints) != 1 {
+		t.Fatalf("Expected one web endpoint, but got %+v.", snap.Services)
+	}
+
+	if err = r.Unregister(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(r2.Endpoints("web")) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s to be removed.", ep.Address)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,320 @@
+package gsr
+
+// Leader elections let exactly one of the endpoints of a service act as its
+// primary. Candidates campaign using the Registry's session lease, so a
+// leader that crashes loses its leadership when the lease expires. Within
+// the etcd3 key namespace, elections are stored as:
+//
+// $KEY_PREFIX (and namespace, if any)
+// |
+// -> /elections
+//    |
+//    ->> /$SERVICE
+//        |
+//        -> /$LEASE_ID  <-- one key per candidate. the oldest is the leader.
+
+import (
+	"encoding/json"
+	"errors"
+
+	etcd "go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/clientv3/concurrency"
+	"golang.org/x/net/context"
+)
+
+var (
+	ErrNotRegistered = errors.New(
+		"no endpoint registered for service by this registry",
+	)
+	ErrNoLeader       = errors.New("service has no leader")
+	ErrNotCampaigning = errors.New(
+		"not campaigning for leadership of service",
+	)
+)
+
+// leadership is an election won with Campaign().
+type leadership struct {
+	e *concurrency.Election
+	// lost cancels the context returned by Campaign()
+	lost context.CancelFunc
+}
+
+// The value stored in etcd at a candidate's election key.
+type candidateValue struct {
+	Address string `json:"address"`
+	Owner   *Owner `json:"owner,omitempty"`
+}
+
+// Returns the etcd key prefix for a service's election.
+func (r *Registry) electionKey(service string) string {
+	return r.namespaceKey() + "elections/" + service
+}
+
+// Returns the etcd session used for elections, which is attached to the
+// Registry's session lease. With any other backend than etcd, ErrNotSupported
+// is returned before the session lease is granted.
+func (r *Registry) concurrencySession() (*concurrency.Session, error) {
+	client, err := r.etcdClient()
+	if err != nil {
+		return nil, err
+	}
+	lease, err := r.sessionLease()
+	if err != nil {
+		return nil, err
+	}
+	s := r.session
+	s.Lock()
+	defer s.Unlock()
+	if s.cs != nil && s.cs.Lease() == etcd.LeaseID(lease) {
+		return s.cs, nil
+	}
+	cs, err := concurrency.NewSession(
+		client, concurrency.WithLease(etcd.LeaseID(lease)),
+	)
+	if err != nil {
+		r.LERR("failed to create election session: %v", err)
+		return nil, err
+	}
+	s.cs = cs
+	return cs, nil
+}
+
+// Returns an endpoint this Registry has registered for the supplied service.
+func (r *Registry) registeredEndpoint(service string) *Endpoint {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for ep := range r.registered {
+		if ep.Service.Name == service {
+			return ep
+		}
+	}
+	return nil
+}
+
+// Campaign blocks until one of the endpoints this Registry has registered for
+// the supplied service becomes the leader of the service, or the supplied
+// context is done. The leader's endpoint is recorded in the registry so that
+// discovery clients can find it with Leader() or ObserveLeader(). Leadership
+// is held until Resign() is called or the Registry's session lease is lost.
+//
+// Campaign returns a context that is done once leadership is lost, whether
+// through Resign(), the loss of the session lease, the deletion of the
+// leader's election key or the Registry being closed. The leader should stop
+// acting as the primary as soon as it is done.
+//
+// Leader elections need the etcd backend: ErrNotSupported is returned with any
+// other backend.
+func (r *Registry) Campaign(
+	ctx context.Context,
+	service string,
+) (context.Context, error) {
+	if err := validateServiceName(service); err != nil {
+		return nil, err
+	}
+	ep := r.registeredEndpoint(service)
+	if ep == nil {
+		return nil, ErrNotRegistered
+	}
+	cs, err := r.concurrencySession()
+	if err != nil {
+		return nil, err
+	}
+	val, err := json.Marshal(&candidateValue{
+		Address: ep.Address,
+		Owner:   ep.Owner,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	e := concurrency.NewElection(cs, r.electionKey(service))
+	r.L2("campaigning for leadership of %s as %s", service, ep.Address)
+	if err = e.Campaign(ctx, string(val)); err != nil {
+		r.L2("campaign for leadership of %s failed: %v", service, err)
+		return nil, err
+	}
+	r.L1("%s is now the leader of %s", ep.Address, service)
+
+	lctx, lost := context.WithCancel(context.Background())
+	l := &leadership{e: e, lost: lost}
+	r.mu.Lock()
+	r.elections[service] = l
+	r.mu.Unlock()
+	go r.watchLeadership(lctx, service, cs, l)
+	return lctx, nil
+}
+
+// Waits for leadership of a service to be lost and then cancels the context
+// returned by Campaign(). Leadership is lost when the leader's election key is
+// deleted, e.g. because the session lease expired, when the etcd session
+// ends, or when the Registry is closed.
+func (r *Registry) watchLeadership(
+	ctx context.Context,
+	service string,
+	cs *concurrency.Session,
+	l *leadership,
+) {
+	defer func() {
+		l.lost()
+		r.mu.Lock()
+		if r.elections[service] == l {
+			delete(r.elections, service)
+		}
+		r.mu.Unlock()
+	}()
+	c, err := r.etcdClient()
+	if err != nil {
+		return
+	}
+	wch := c.Watch(ctx, l.e.Key(), etcd.WithRev(l.e.Rev()+1))
+	for {
+		select {
+		case wresp, ok := <-wch:
+			if !ok {
+				return
+			}
+			if err := wresp.Err(); err != nil {
+				r.LERR("lost watch of leadership of %s: %v", service, err)
+				return
+			}
+			for _, ev := range wresp.Events {
+				if ev.Type == etcd.EventTypeDelete {
+					r.LERR("lost leadership of %s", service)
+					return
+				}
+			}
+		case <-cs.Done():
+			r.LERR("lost leadership of %s: session ended", service)
+			return
+		case <-r.session.ctx.Done():
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Resign gives up leadership of the supplied service, which was won with
+// Campaign(). ErrNotCampaigning is returned if this Registry is not the
+// leader of the service.
+func (r *Registry) Resign(ctx context.Context, service string) error {
+	r.mu.Lock()
+	l, found := r.elections[service]
+	delete(r.elections, service)
+	r.mu.Unlock()
+	if !found {
+		return ErrNotCampaigning
+	}
+	r.L2("resigning leadership of %s", service)
+	l.lost()
+	return l.e.Resign(ctx)
+}
+
+// Leader returns the endpoint that is the current leader of the supplied
+// service. ErrNoLeader is returned if no endpoint has won an election for the
+// service, and ErrNotSupported if the Registry does not use the etcd backend.
+func (r *Registry) Leader(service string) (*Endpoint, error) {
+	if err := validateServiceName(service); err != nil {
+		return nil, err
+	}
+	ctx, cancel := r.requestCtx()
+	defer cancel()
+	return r.readLeader(ctx, service)
+}
+
+// Reads the oldest candidate key of a service's election, which belongs to
+// the leader.
+func (r *Registry) readLeader(
+	ctx context.Context,
+	service string,
+) (*Endpoint, error) {
+	c, err := r.etcdClient()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.KV.Get(
+		ctx,
+		r.electionKey(service)+"/",
+		etcd.WithFirstCreate()...,
+	)
+	if err != nil {
+		r.L2("error looking up leader of %s: %v", service, err)
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrNoLeader
+	}
+	cv := candidateValue{}
+	if err = json.Unmarshal(resp.Kvs[0].Value, &cv); err != nil {
+		r.LERR("failed to decode leader of %s: %v", service, err)
+		return nil, err
+	}
+	return &Endpoint{
+		Service: &Service{Name: service},
+		Address: cv.Address,
+		Owner:   cv.Owner,
+	}, nil
+}
+
+// ObserveLeader returns a channel on which the leader of the supplied service
+// is delivered each time it changes, starting with the current leader, if
+// any. A nil endpoint is delivered when the service loses its leader. The
+// channel is closed once the supplied context is done, or straight away if the
+// Registry does not use the etcd backend, which leader elections need.
+func (r *Registry) ObserveLeader(
+	ctx context.Context,
+	service string,
+) <-chan *Endpoint {
+	ch := make(chan *Endpoint, 1)
+	go r.observeLeader(ctx, service, ch)
+	return ch
+}
+
+func (r *Registry) observeLeader(
+	ctx context.Context,
+	service string,
+	ch chan<- *Endpoint,
+) {
+	defer close(ch)
+	c, err := r.etcdClient()
+	if err != nil {
+		return
+	}
+	wch := c.Watch(ctx, r.electionKey(service)+"/", etcd.WithPrefix())
+
+	var last *Endpoint
+	first := true
+	for {
+		rctx, cancel := r.requestCtx()
+		leader, err := r.readLeader(rctx, service)
+		cancel()
+		if err != nil && err != ErrNoLeader {
+			leader = last
+		}
+		if first || !sameLeader(last, leader) {
+			select {
+			case ch <- leader:
+			case <-ctx.Done():
+				return
+			}
+			first = false
+			last = leader
+		}
+		// Wait for any change to the candidates before looking again
+		select {
+		case _, ok := <-wch:
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func sameLeader(a *Endpoint, b *Endpoint) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Address == b.Address
+}
@@ -0,0 +1,835 @@
+package gsr_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jaypipes/gsr"
+	"github.com/jaypipes/gsr/gsrtest"
+	"golang.org/x/net/context"
+)
+
+func hasAddress(addr string, eps []*gsr.Endpoint) bool {
+	for _, ep := range eps {
+		if ep.Address == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// Calls check until it returns true, failing the test if it does not do so
+// within the timeout.
+func waitFor(t *testing.T, timeout time.Duration, what string, check func() bool) {
+	deadline := time.Now().Add(timeout)
+	for !check() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s.", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestFunctionalSimple(t *testing.T) {
+	e := gsrtest.StartEtcd(t)
+	defer e.Close()
+
+	service := "web"
+	addr := "192.168.1.12"
+	ep := gsr.Endpoint{
+		Service: &gsr.Service{Name: service},
+		Address: addr,
+	}
+
+	r := e.NewRegistry()
+	if err := r.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	eps := r.Endpoints(service)
+	if eps == nil {
+		t.Fatalf("Expected []string, but got nil")
+	}
+	if !hasAddress(addr, eps) {
+		t.Fatalf("Expected to find %s in %v.", addr, eps)
+	}
+}
+
+func TestFunctionalConcurrency(t *testing.T) {
+	e := gsrtest.StartEtcd(t)
+	defer e.Close()
+
+	service := "data-access"
+	addr1 := "192.168.1.12"
+	addr2 := "192.168.1.13"
+	ep1 := gsr.Endpoint{
+		Service: &gsr.Service{Name: service},
+		Address: addr1,
+	}
+	ep2 := gsr.Endpoint{
+		Service: &gsr.Service{Name: service},
+		Address: addr2,
+	}
+
+	r1 := e.NewRegistry()
+	if err := r1.Register(&ep1); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if eps := r1.Endpoints(service); !hasAddress(addr1, eps) {
+		t.Fatalf("Expected to find %s in %v.", addr1, eps)
+	}
+
+	r2 := e.NewRegistry()
+	if err := r2.Register(&ep2); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	for _, addr := range []string{addr1, addr2} {
+		if eps := r2.Endpoints(service); !hasAddress(addr, eps) {
+			t.Fatalf("Expected to find %s in %v.", addr, eps)
+		}
+		// first registry should find both endpoints now too
+		if eps := r1.Endpoints(service); !hasAddress(addr, eps) {
+			t.Fatalf("Expected to find %s in %v.", addr, eps)
+		}
+	}
+}
+
+func TestEtcdLeaseExpiry(t *testing.T) {
+	e := gsrtest.StartEtcd(t)
+	defer e.Close()
+
+	r1 := e.NewRegistry()
+	r2 := e.NewRegistry()
+	ep := gsr.Endpoint{
+		Service: &gsr.Service{Name: "web"},
+		Address: "10.0.0.1:80",
+	}
+	if err := r1.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	waitFor(t, 5*time.Second, "the endpoint to be cached", func() bool {
+		return hasAddress(ep.Address, r2.Query("web", nil))
+	})
+
+	// When the lease of the registering process runs out, the endpoint goes
+	// away for everyone
+	e.ExpireLease(gsr.LeaseID(ep.Owner.Lease))
+	if eps := r2.Endpoints("web"); hasAddress(ep.Address, eps) {
+		t.Fatalf("Expected %s to have expired, but got %v.", ep.Address, eps)
+	}
+	waitFor(t, 5*time.Second, "the endpoint to leave the cache", func() bool {
+		return !hasAddress(ep.Address, r2.Query("web", nil))
+	})
+}
+
+func TestEtcdRestart(t *testing.T) {
+	e := gsrtest.StartEtcd(t)
+	defer e.Close()
+
+	r := e.NewRegistry()
+	ep1 := gsr.Endpoint{
+		Service: &gsr.Service{Name: "web"},
+		Address: "10.0.0.1:80",
+	}
+	if err := r.Register(&ep1); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	e.Stop()
+	ep2 := gsr.Endpoint{
+		Service: &gsr.Service{Name: "web"},
+		Address: "10.0.0.2:80",
+	}
+	if err := r.Register(&ep2); err == nil {
+		t.Fatal("Expected error registering while etcd is down, but got nil.")
+	}
+	e.Restart()
+
+	// The registry reconnects on its own, and its watch picks up where it
+	// left off
+	waitFor(t, 10*time.Second, "the registry to reconnect", func() bool {
+		return r.Register(&ep2) == nil
+	})
+	waitFor(t, 5*time.Second, "the endpoint to be cached", func() bool {
+		return hasAddress(ep2.Address, r.Query("web", nil))
+	})
+	eps := e.NewRegistry().Endpoints("web")
+	for _, addr := range []string{ep1.Address, ep2.Address} {
+		if !hasAddress(addr, eps) {
+			t.Fatalf("Expected to find %s in %v.", addr, eps)
+		}
+	}
+}
+
+func TestEtcdBackendConformance(t *testing.T) {
+	e := gsrtest.StartEtcd(t)
+	defer e.Close()
+	gsrtest.BackendConformance(t, gsr.EtcdBackendFactory(e.Endpoints()))
+}
+
+func TestFunctionalHandleSignals(t *testing.T) {
+	e := gsrtest.StartEtcd(t)
+	defer e.Close()
+
+	service := "drain"
+	addr := "192.168.1.14"
+	ep := gsr.Endpoint{
+		Service: &gsr.Service{Name: service},
+		Address: addr,
+	}
+
+	r1 := e.NewRegistry()
+	r2 := e.NewRegistry()
+
+	if err := r1.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if eps := r2.Endpoints(service); !hasAddress(addr, eps) {
+		t.Fatalf("Expected to find %s in %v.", addr, eps)
+	}
+
+	drained := false
+	opts := &gsr.SignalOptions{
+		GracePeriod: 10 * time.Millisecond,
+		OnDrain: func() error {
+			// Other registries should stop seeing the endpoint as soon as
+			// it is draining.
+			drained = !hasAddress(addr, r2.Endpoints(service))
+			return nil
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := r1.HandleSignals(ctx, []*gsr.Endpoint{&ep}, opts); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if !drained {
+		t.Fatalf("Expected %s to be hidden while draining.", addr)
+	}
+	if eps := r2.Endpoints(service); hasAddress(addr, eps) {
+		t.Fatalf("Expected not to find %s in %v.", addr, eps)
+	}
+}
+
+func TestFunctionalServiceDefinitions(t *testing.T) {
+	e := gsrtest.StartEtcd(t)
+	defer e.Close()
+
+	r := e.NewRegistry()
+
+	if _, err := r.Service("undefined"); err != gsr.ErrServiceNotFound {
+		t.Fatalf("Expected ErrServiceNotFound, but got %v.", err)
+	}
+
+	svc := &gsr.Service{
+		Name:        "billing",
+		Owner:       "billing-team",
+		Protocol:    "grpc",
+		DefaultPort: 10000,
+	}
+	if err := r.DefineService(svc); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	got, err := r.Service("billing")
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if got.Owner != svc.Owner || got.DefaultPort != svc.DefaultPort {
+		t.Fatalf("Expected %v, but got %v.", svc, got)
+	}
+
+	// The definition must not show up as an endpoint of the service
+	ep := gsr.Endpoint{
+		Service: &gsr.Service{Name: "billing"},
+		Address: "192.168.1.15",
+	}
+	if err := r.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if eps := r.Endpoints("billing"); len(eps) != 1 {
+		t.Fatalf("Expected 1 endpoint, but got %v.", eps)
+	}
+
+	defs, err := r.Services()
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	found := false
+	for _, s := range defs {
+		if s.Name == "billing" {
+			found = true
+		}
+	}
+	if !found {
+		t.Fatalf("Expected to find billing in %v.", defs)
+	}
+
+	svcs, err := r.ServiceSummaries()
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	found = false
+	for _, s := range svcs {
+		if s.Name == "billing" {
+			found = true
+			if !s.Defined || s.EndpointCount != 1 {
+				t.Fatalf("Expected defined billing with 1 endpoint, "+
+					"but got %v.", s)
+			}
+		}
+	}
+	if !found {
+		t.Fatalf("Expected to find billing in %v.", svcs)
+	}
+
+	if eps := r.AllEndpoints()["billing"]; len(eps) != 1 {
+		t.Fatalf("Expected 1 billing endpoint, but got %v.", eps)
+	}
+	if eps := r.Endpoints(""); !hasAddress(ep.Address, eps) {
+		t.Fatalf("Expected to find %s in %v.", ep.Address, eps)
+	}
+}
+
+func TestFunctionalQueryAndWatch(t *testing.T) {
+	e := gsrtest.StartEtcd(t)
+	defer e.Close()
+
+	service := "search"
+	sel := gsr.MustParseSelector("zone=us-east,version in (v2,v3)")
+
+	r1 := e.NewRegistry()
+	r2 := e.NewRegistry()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := r2.Watch(ctx, service, sel)
+
+	v1 := gsr.Endpoint{
+		Service: &gsr.Service{Name: service},
+		Address: "192.168.1.16",
+		Labels:  map[string]string{"zone": "us-east", "version": "v1"},
+	}
+	v2 := gsr.Endpoint{
+		Service: &gsr.Service{Name: service},
+		Address: "192.168.1.17",
+		Labels:  map[string]string{"zone": "us-east", "version": "v2"},
+	}
+	if err := r1.Register(&v1); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if err := r1.Register(&v2); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	select {
+	case ev := <-events:
+		if ev.Type != gsr.EventCreated || ev.Endpoint.Address != v2.Address {
+			t.Fatalf("Expected created event for %s, but got %v.",
+				v2.Address, ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for watch event.")
+	}
+
+	eps := r2.Query(service, sel)
+	if len(eps) != 1 || eps[0].Address != v2.Address {
+		t.Fatalf("Expected only %s, but got %v.", v2.Address, eps)
+	}
+}
+
+func TestFunctionalNamespaces(t *testing.T) {
+	e := gsrtest.StartEtcd(t)
+	defer e.Close()
+
+	r := e.NewRegistry()
+
+	if _, err := r.Namespace("staging"); err != gsr.ErrCrossNamespace {
+		t.Fatalf("Expected ErrCrossNamespace, but got %v.", err)
+	}
+
+	cross := gsr.ConfigFromEnv()
+	cross.AllowCrossNamespace = true
+	r = e.NewRegistryWithConfig(cross)
+	staging, err := r.Namespace("staging")
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	service := "isolated"
+	addr := "192.168.1.18"
+	ep := gsr.Endpoint{
+		Service: &gsr.Service{Name: service},
+		Address: addr,
+	}
+	if err := staging.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if eps := staging.Endpoints(service); !hasAddress(addr, eps) {
+		t.Fatalf("Expected to find %s in %v.", addr, eps)
+	}
+	if eps := r.Endpoints(service); hasAddress(addr, eps) {
+		t.Fatalf("Expected not to find %s in %v.", addr, eps)
+	}
+}
+
+func TestFunctionalSessionLease(t *testing.T) {
+	e := gsrtest.StartEtcd(t)
+	defer e.Close()
+
+	r1 := e.NewRegistry()
+	r2 := e.NewRegistry()
+
+	http := gsr.Endpoint{
+		Service: &gsr.Service{Name: "session-http"},
+		Address: "192.168.1.19:80",
+	}
+	grpc := gsr.Endpoint{
+		Service: &gsr.Service{Name: "session-grpc"},
+		Address: "192.168.1.19:10000",
+	}
+	if err := r1.Register(&http); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if err := r1.Register(&grpc); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if http.Owner.Lease != grpc.Owner.Lease {
+		t.Fatalf("Expected shared lease, but got %x and %x.",
+			http.Owner.Lease, grpc.Owner.Lease)
+	}
+
+	// Shutting down revokes the session, which removes every endpoint
+	// attached to it, even those that were not unregistered
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	opts := &gsr.SignalOptions{GracePeriod: time.Millisecond}
+	if err := r1.HandleSignals(ctx, nil, opts); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if eps := r2.Endpoints("session-http"); hasAddress(http.Address, eps) {
+		t.Fatalf("Expected not to find %s in %v.", http.Address, eps)
+	}
+	if eps := r2.Endpoints("session-grpc"); hasAddress(grpc.Address, eps) {
+		t.Fatalf("Expected not to find %s in %v.", grpc.Address, eps)
+	}
+}
+
+func TestFunctionalUpdate(t *testing.T) {
+	e := gsrtest.StartEtcd(t)
+	defer e.Close()
+
+	service := "update"
+	ep := gsr.Endpoint{
+		Service: &gsr.Service{Name: service},
+		Address: "192.168.1.20",
+		Labels:  map[string]string{"version": "v1"},
+	}
+
+	r := e.NewRegistry()
+	if err := r.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	eps := r.Endpoints(service)
+	if len(eps) != 1 {
+		t.Fatalf("Expected 1 endpoint, but got %v.", eps)
+	}
+	stale := eps[0]
+
+	ep.Labels["version"] = "v2"
+	if err := r.Update(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	// The copy read before the update must not overwrite it
+	stale.Labels["version"] = "v3"
+	if err := r.Update(stale); err != gsr.ErrConflict {
+		t.Fatalf("Expected ErrConflict, but got %v.", err)
+	}
+
+	eps = r.Endpoints(service)
+	if len(eps) != 1 || eps[0].Labels["version"] != "v2" {
+		t.Fatalf("Expected version v2, but got %v.", eps)
+	}
+}
+
+func TestFunctionalClaim(t *testing.T) {
+	e := gsrtest.StartEtcd(t)
+	defer e.Close()
+
+	service := "claim"
+	ep := gsr.Endpoint{
+		Service: &gsr.Service{Name: service},
+		Address: "192.168.1.21",
+	}
+
+	r1 := e.NewRegistry()
+	r2 := e.NewRegistry()
+
+	res, err := r1.Claim(&ep)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if res != gsr.ClaimCreated && res != gsr.ClaimReattached {
+		t.Fatalf("Expected created or reattached, but got %s.", res)
+	}
+
+	if res, err = r1.Claim(&ep); err != nil || res != gsr.ClaimExisting {
+		t.Fatalf("Expected existing and nil, but got %s and %v.", res, err)
+	}
+
+	// r1 is still alive and keeping its session lease alive
+	other := ep
+	if _, err := r2.Claim(&other); err != gsr.ErrEndpointOwned {
+		t.Fatalf("Expected ErrEndpointOwned, but got %v.", err)
+	}
+}
+
+func TestFunctionalOwnership(t *testing.T) {
+	e := gsrtest.StartEtcd(t)
+	defer e.Close()
+
+	service := "owned"
+	addr := "192.168.1.22"
+	ep := gsr.Endpoint{
+		Service: &gsr.Service{Name: service},
+		Address: addr,
+	}
+
+	r1 := e.NewRegistry()
+	r2 := e.NewRegistry()
+
+	if err := r1.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	eps := r2.Endpoints(service)
+	if len(eps) != 1 || eps[0].Owner == nil {
+		t.Fatalf("Expected 1 endpoint with an owner, but got %v.", eps)
+	}
+	if eps[0].Owner.InstanceID != r1.InstanceID() {
+		t.Fatalf("Expected owner %s, but got %v.",
+			r1.InstanceID(), eps[0].Owner)
+	}
+
+	// Neither an endpoint read from the registry nor one constructed by
+	// another process may be used to unregister somebody else's entry
+	if err := r2.Unregister(eps[0]); err != gsr.ErrNotOwner {
+		t.Fatalf("Expected ErrNotOwner, but got %v.", err)
+	}
+	other := gsr.Endpoint{
+		Service: &gsr.Service{Name: service},
+		Address: addr,
+	}
+	if err := r2.Unregister(&other); err != gsr.ErrNotOwner {
+		t.Fatalf("Expected ErrNotOwner, but got %v.", err)
+	}
+
+	if err := r2.ForceUnregister(&other); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if eps := r1.Endpoints(service); hasAddress(addr, eps) {
+		t.Fatalf("Expected not to find %s in %v.", addr, eps)
+	}
+}
+
+func TestFunctionalElection(t *testing.T) {
+	e := gsrtest.StartEtcd(t)
+	defer e.Close()
+
+	service := "elected"
+	ep1 := gsr.Endpoint{
+		Service: &gsr.Service{Name: service},
+		Address: "192.168.1.31",
+	}
+	ep2 := gsr.Endpoint{
+		Service: &gsr.Service{Name: service},
+		Address: "192.168.1.32",
+	}
+
+	r1 := e.NewRegistry()
+	r2 := e.NewRegistry()
+
+	ctx := context.Background()
+	if _, err := r1.Campaign(ctx, service); err != gsr.ErrNotRegistered {
+		t.Fatalf("Expected ErrNotRegistered, but got %v.", err)
+	}
+	if _, err := r1.Leader(service); err != gsr.ErrNoLeader {
+		t.Fatalf("Expected ErrNoLeader, but got %v.", err)
+	}
+
+	if err := r1.Register(&ep1); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer r1.Unregister(&ep1)
+	if err := r2.Register(&ep2); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer r2.Unregister(&ep2)
+
+	octx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	leaders := r2.ObserveLeader(octx, service)
+	if leader := <-leaders; leader != nil {
+		t.Fatalf("Expected no leader, but got %v.", leader)
+	}
+
+	led, err := r1.Campaign(ctx, service)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if leader := <-leaders; leader == nil || leader.Address != ep1.Address {
+		t.Fatalf("Expected leader %s, but got %v.", ep1.Address, leader)
+	}
+
+	// The second candidate blocks until the first resigns
+	elected := make(chan error, 1)
+	go func() {
+		_, err := r2.Campaign(ctx, service)
+		elected <- err
+	}()
+	select {
+	case err = <-elected:
+		t.Fatalf("Expected campaign to block, but got %v.", err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if err := r1.Resign(ctx, service); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	select {
+	case <-led.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected leadership context to be done after resigning.")
+	}
+	if err := <-elected; err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	leader, err := r1.Leader(service)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if leader.Address != ep2.Address {
+		t.Fatalf("Expected leader %s, but got %s.", ep2.Address, leader.Address)
+	}
+	if err := r2.Resign(ctx, service); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if err := r2.Resign(ctx, service); err != gsr.ErrNotCampaigning {
+		t.Fatalf("Expected ErrNotCampaigning, but got %v.", err)
+	}
+}
+
+func TestFunctionalLock(t *testing.T) {
+	e := gsrtest.StartEtcd(t)
+	defer e.Close()
+
+	name := "migrations"
+	r1 := e.NewRegistry()
+	r2 := e.NewRegistry()
+
+	ctx := context.Background()
+	unlock1, token1, err := r1.Lock(ctx, name)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if _, _, err = r1.TryLock(ctx, name); err != gsr.ErrLockHeld {
+		t.Fatalf("Expected ErrLockHeld, but got %v.", err)
+	}
+	if _, _, err = r2.TryLock(ctx, name); err != gsr.ErrLocked {
+		t.Fatalf("Expected ErrLocked, but got %v.", err)
+	}
+
+	// The second process waits until the first releases the lock
+	type result struct {
+		unlock gsr.UnlockFunc
+		token  int64
+		err    error
+	}
+	acquired := make(chan result, 1)
+	go func() {
+		unlock, token, err := r2.Lock(ctx, name)
+		acquired <- result{unlock, token, err}
+	}()
+	select {
+	case res := <-acquired:
+		t.Fatalf("Expected Lock to block, but got %v.", res.err)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	if err := unlock1(); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	res := <-acquired
+	if res.err != nil {
+		t.Fatalf("Expected nil, but got %v.", res.err)
+	}
+	if res.token <= token1 {
+		t.Fatalf("Expected token greater than %d, but got %d.",
+			token1, res.token)
+	}
+	if err := res.unlock(); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	unlock, token, err := r1.TryLock(ctx, name)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if token <= res.token {
+		t.Fatalf("Expected token greater than %d, but got %d.",
+			res.token, token)
+	}
+	if err := unlock(); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+}
+
+func TestFunctionalConfig(t *testing.T) {
+	e := gsrtest.StartEtcd(t)
+	defer e.Close()
+
+	type limits struct {
+		MaxConns int `json:"max_conns"`
+	}
+
+	r := e.NewRegistry()
+	cfg, err := r.Config("configured")
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer cfg.Delete("limits")
+
+	var got limits
+	if err := cfg.Get("limits", &got); err != gsr.ErrConfigNotFound {
+		t.Fatalf("Expected ErrConfigNotFound, but got %v.", err)
+	}
+	if err := cfg.Set("limits", &limits{MaxConns: 10}); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan *gsr.ConfigEvent, 4)
+	err = cfg.Watch(ctx, "limits", func(ev *gsr.ConfigEvent) {
+		events <- ev
+	})
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	expect := func(maxConns int) {
+		select {
+		case ev := <-events:
+			got := limits{}
+			if err := ev.Decode(&got); err != nil {
+				t.Fatalf("Expected nil, but got %v.", err)
+			}
+			if got.MaxConns != maxConns {
+				t.Fatalf("Expected %d, but got %d.", maxConns, got.MaxConns)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for config event")
+		}
+	}
+	expect(10)
+
+	if err := cfg.Set("limits", &limits{MaxConns: 20}); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	expect(20)
+
+	if err := cfg.Get("limits", &got); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if got.MaxConns != 20 {
+		t.Fatalf("Expected 20, but got %d.", got.MaxConns)
+	}
+	names, err := cfg.Names()
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if len(names) != 1 || names[0] != "limits" {
+		t.Fatalf("Expected [limits], but got %v.", names)
+	}
+
+	if err := cfg.Delete("limits"); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	select {
+	case ev := <-events:
+		if !ev.Deleted {
+			t.Fatalf("Expected a deleted event, but got %v.", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timed out waiting for config event")
+	}
+}
+
+func TestFunctionalSnapshotImport(t *testing.T) {
+	e := gsrtest.StartEtcd(t)
+	defer e.Close()
+
+	srcCfg := gsr.ConfigFromEnv()
+	srcCfg.Namespace = "snapshot-src"
+	src := e.NewRegistryWithConfig(srcCfg)
+	ep := gsr.Endpoint{
+		Service: &gsr.Service{Name: "snapped"},
+		Address: "192.168.1.41:80",
+		Labels:  map[string]string{"zone": "a"},
+	}
+	if err := src.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer src.Unregister(&ep)
+	cfg, err := src.Config("snapped")
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if err := cfg.Set("limits", map[string]int{"max_conns": 5}); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer cfg.Delete("limits")
+
+	snap, err := src.Snapshot()
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if len(snap.Services) != 1 || len(snap.Services[0].Endpoints) != 1 {
+		t.Fatalf("Expected 1 service with 1 endpoint, but got %+v.", snap)
+	}
+
+	dstCfg := gsr.ConfigFromEnv()
+	dstCfg.Namespace = "snapshot-dst"
+	dst := e.NewRegistryWithConfig(dstCfg)
+	changes, err := dst.Import(snap, &gsr.ImportOptions{DryRun: true})
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if len(changes) != 2 {
+		t.Fatalf("Expected 2 changes, but got %v.", changes)
+	}
+	if eps := dst.Endpoints("snapped"); len(eps) != 0 {
+		t.Fatalf("Expected a dry run to change nothing, but got %v.", eps)
+	}
+
+	if _, err := dst.Import(snap, nil); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	eps := dst.Endpoints("snapped")
+	if len(eps) != 1 || eps[0].Labels["zone"] != "a" {
+		t.Fatalf("Expected the imported endpoint, but got %v.", eps)
+	}
+
+	// Importing the same snapshot again changes nothing, and pruning with
+	// an empty snapshot removes everything that was imported
+	changes, err = dst.Import(snap, nil)
+	if err != nil || len(changes) != 0 {
+		t.Fatalf("Expected no changes, but got %v, %v.", changes, err)
+	}
+	empty := &gsr.Snapshot{Version: gsr.SnapshotVersion}
+	changes, err = dst.Import(empty, &gsr.ImportOptions{Prune: true})
+	if err != nil || len(changes) != 2 {
+		t.Fatalf("Expected 2 changes, but got %v, %v.", changes, err)
+	}
+}
@@ -1,14 +1,14 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"os/signal"
+	"sort"
 	"strings"
-	"syscall"
 
 	"github.com/jaypipes/gsr"
 )
@@ -50,13 +50,18 @@ func main() {
 		log.Fatalf("failed to register with gsr: %v", err)
 	}
 
-	sigs := make(chan os.Signal, 1)
+	srv := &http.Server{Addr: myAddr}
+	http.HandleFunc("/", handleHttp)
+
 	done := make(chan bool, 1)
-	signal.Notify(sigs, syscall.SIGTERM)
 	go func() {
-		sig := <-sigs
-		info("received %s. unregistering %s:%s endpoint in gsr", sig, myServiceName, myAddr)
-		err := reg.Unregister(&ep)
+		opts := &gsr.SignalOptions{
+			BeforeUnregister: func() error {
+				info("shutting down HTTP server on %s.", myAddr)
+				return srv.Shutdown(context.Background())
+			},
+		}
+		err := reg.HandleSignals(context.Background(), []*gsr.Endpoint{&ep}, opts)
 		if err != nil {
 			log.Fatalf("failed to unregister: %s\n", err)
 		}
@@ -64,17 +69,20 @@ func main() {
 	}()
 
 	info("listening for HTTP traffic on %s.", myAddr)
-	http.HandleFunc("/", handleHttp)
-	log.Fatal(http.ListenAndServe(myAddr, nil))
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
 	<-done
 }
 
 func getEndpoints() []string {
-	eps := reg.Endpoints("")
-	out := make([]string, len(eps))
-	for x, ep := range eps {
-		out[x] = ep.Service.Name + ":" + ep.Address
+	out := make([]string, 0)
+	for _, eps := range reg.AllEndpoints() {
+		for _, ep := range eps {
+			out = append(out, ep.Service.Name+":"+ep.Address)
+		}
 	}
+	sort.Strings(out)
 	return out
 }
 
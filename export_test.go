@@ -0,0 +1,150 @@
+package gsr
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	etcd "go.etcd.io/etcd/clientv3"
+	"golang.org/x/net/context"
+)
+
+// The conformance tests of the built-in backends are in the gsr_test package,
+// since gsrtest imports gsr. The factories below give them clients of each
+// backend. Each also returns a function that stops the store behind the
+// clients.
+
+// memClient is a client of a memBackend shared with other clients. Closing it
+// ends its keepalives and watches but leaves the store alone.
+type memClient struct {
+	*memBackend
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Returns a context that is done when either the supplied context or the
+// client is.
+func (c *memClient) scope(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-c.ctx.Done():
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	return ctx
+}
+
+func (c *memClient) KeepAlive(
+	ctx context.Context,
+	lease LeaseID,
+) (<-chan struct{}, error) {
+	return c.memBackend.KeepAlive(c.scope(ctx), lease)
+}
+
+func (c *memClient) Watch(
+	ctx context.Context,
+	key string,
+	opts *WatchOptions,
+) <-chan *WatchResponse {
+	return c.memBackend.Watch(c.scope(ctx), key, opts)
+}
+
+func (c *memClient) Close() error {
+	c.cancel()
+	return nil
+}
+
+func MemBackendFactory() (func(t *testing.T) Backend, func()) {
+	b := newMemBackend()
+	factory := func(t *testing.T) Backend {
+		ctx, cancel := context.WithCancel(context.Background())
+		return &memClient{memBackend: b, ctx: ctx, cancel: cancel}
+	}
+	return factory, func() { b.Close() }
+}
+
+func ConsulBackendFactory() (func(t *testing.T) Backend, func()) {
+	c, srv := newFakeConsul()
+	factory := func(t *testing.T) Backend {
+		return newConsulBackend(srv.URL)
+	}
+	return factory, func() { c.stop(srv) }
+}
+
+func ZKBackendFactory() (func(t *testing.T) Backend, func()) {
+	z := newFakeZK()
+	factory := func(t *testing.T) Backend {
+		return newTestZKBackend(t, z)
+	}
+	return factory, func() {}
+}
+
+// RedisBackendFactory returns clients of a real Redis server, since miniredis
+// lets other clients in between the commands of a script, and the suite checks
+// that the backend's scripts run atomically. The server at GSR_TEST_REDIS_URL
+// is used if it is set. Otherwise one is started from the redis-server binary,
+// and the test is skipped if that is not installed.
+func RedisBackendFactory(t *testing.T) (func(t *testing.T) Backend, func()) {
+	logf := func(string, ...interface{}) {}
+	factory := func(url string) func(t *testing.T) Backend {
+		return func(t *testing.T) Backend {
+			return newRedisBackend(url, logf, dialRedis)
+		}
+	}
+	if url, found := os.LookupEnv("GSR_TEST_REDIS_URL"); found {
+		return factory(url), func() {}
+	}
+	bin, err := exec.LookPath("redis-server")
+	if err != nil {
+		t.Skip("GSR_TEST_REDIS_URL not set and redis-server not found. " +
+			"Skipping redis conformance test.")
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	l.Close()
+	cmd := exec.Command(bin, "--bind", "127.0.0.1", "--port", port,
+		"--save", "", "--appendonly", "no")
+	if err = cmd.Start(); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	stop := func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	}
+	url := "redis://127.0.0.1:" + port
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := dialRedis(url)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			stop()
+			t.Fatalf("Timed out waiting for redis-server: %v.", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return factory(url), stop
+}
+
+func EtcdBackendFactory(endpoints []string) func(t *testing.T) Backend {
+	return func(t *testing.T) Backend {
+		client, err := etcd.New(etcd.Config{
+			Endpoints:   endpoints,
+			DialTimeout: 5 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("Expected nil, but got %v.", err)
+		}
+		return &etcdBackend{client: client}
+	}
+}
@@ -0,0 +1,353 @@
+package gsr_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jaypipes/gsr"
+	"github.com/jaypipes/gsr/gsrtest"
+	"golang.org/x/net/context"
+)
+
+// Returns a FaultBackend wrapping a new in-memory backend, and a function that
+// stops the backend.
+func newFaultBackend(t *testing.T) (*gsrtest.FaultBackend, func()) {
+	factory, stop := gsr.MemBackendFactory()
+	return gsrtest.NewFaultBackend(factory(t)), stop
+}
+
+func TestFaultBackendScript(t *testing.T) {
+	f, stop := newFaultBackend(t)
+	defer stop()
+	r, err := gsr.NewWithBackend(f)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer r.Close()
+
+	ep := gsr.Endpoint{
+		Service: &gsr.Service{Name: "web"},
+		Address: "10.0.0.1:80",
+	}
+	// The first write loses a race with another process, the second fails
+	errDown := errors.New("etcd is down")
+	f.Script(gsrtest.OpPut,
+		gsrtest.Fault{Err: gsr.ErrCompareFailed},
+		gsrtest.Fault{Err: errDown},
+	)
+	if err := r.Register(&ep); err != gsr.ErrConflict {
+		t.Fatalf("Expected ErrConflict, but got %v.", err)
+	}
+	if err := r.Register(&ep); err != errDown {
+		t.Fatalf("Expected %v, but got %v.", errDown, err)
+	}
+	if err := r.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if calls := f.Calls(gsrtest.OpPut); calls != 3 {
+		t.Fatalf("Expected 3 calls, but got %d.", calls)
+	}
+
+	f.Script(gsrtest.OpGet, gsrtest.Fault{Err: errDown})
+	if eps := r.Endpoints("web"); len(eps) != 0 {
+		t.Fatalf("Expected no endpoints, but got %v.", eps)
+	}
+	if eps := r.Endpoints("web"); !hasAddress(ep.Address, eps) {
+		t.Fatalf("Expected to find %s in %v.", ep.Address, eps)
+	}
+}
+
+func TestFaultBackendErrorRate(t *testing.T) {
+	f, stop := newFaultBackend(t)
+	defer stop()
+	defer f.Close()
+
+	f.SetErrorRate(gsrtest.OpGet, 0.5, nil)
+	failures := func() []bool {
+		res := make([]bool, 100)
+		for x := range res {
+			_, err := f.Get(context.Background(), "a", nil)
+			if err != nil && err != gsrtest.ErrInjected {
+				t.Fatalf("Expected ErrInjected, but got %v.", err)
+			}
+			res[x] = err != nil
+		}
+		return res
+	}
+
+	first := failures()
+	failed := 0
+	for _, fail := range first {
+		if fail {
+			failed++
+		}
+	}
+	if failed == 0 || failed == len(first) {
+		t.Fatalf("Expected some of %d calls to fail, but %d did.",
+			len(first), failed)
+	}
+
+	// The same seed fails the same calls
+	f.Seed(1)
+	second := failures()
+	for x := range first {
+		if first[x] != second[x] {
+			t.Fatalf("Expected call %d to fail: %v, but got %v.",
+				x, first[x], second[x])
+		}
+	}
+
+	f.Reset()
+	if _, err := f.Get(context.Background(), "a", nil); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+}
+
+func TestFaultBackendLatency(t *testing.T) {
+	f, stop := newFaultBackend(t)
+	defer stop()
+	defer f.Close()
+
+	f.SetLatency(gsrtest.OpGet, 100*time.Millisecond)
+	start := time.Now()
+	if _, err := f.Get(context.Background(), "a", nil); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if took := time.Since(start); took < 100*time.Millisecond {
+		t.Fatalf("Expected Get to take at least 100ms, but it took %v.", took)
+	}
+
+	// A slow call gives up when its context is done
+	f.SetLatency(gsrtest.OpGet, time.Hour)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := f.Get(ctx, "a", nil); err != context.DeadlineExceeded {
+		t.Fatalf("Expected DeadlineExceeded, but got %v.", err)
+	}
+}
+
+func TestFaultBackendWatches(t *testing.T) {
+	f, stop := newFaultBackend(t)
+	defer stop()
+	defer f.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	next := func(ch <-chan *gsr.WatchResponse) (*gsr.WatchResponse, bool) {
+		select {
+		case resp, ok := <-ch:
+			return resp, ok
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for the watch.")
+		}
+		return nil, false
+	}
+
+	// Events are passed on until the watch is failed
+	ch := f.Watch(ctx, "a/", &gsr.WatchOptions{Prefix: true})
+	if _, err := f.Put(ctx, "a/1", []byte("1"), nil); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if resp, ok := next(ch); !ok || len(resp.Events) != 1 {
+		t.Fatalf("Expected 1 event, but got %v.", resp)
+	}
+	f.FailWatches(gsr.ErrCompacted)
+	if resp, ok := next(ch); !ok || resp.Err != gsr.ErrCompacted {
+		t.Fatalf("Expected ErrCompacted, but got %v.", resp)
+	}
+	if _, ok := next(ch); ok {
+		t.Fatal("Expected the watch to be closed.")
+	}
+
+	// A dropped watch is closed without an error
+	ch = f.Watch(ctx, "a/", &gsr.WatchOptions{Prefix: true})
+	f.DropWatches()
+	if resp, ok := next(ch); ok {
+		t.Fatalf("Expected the watch to be closed, but got %v.", resp)
+	}
+
+	// A watch failed by a script fails straight away
+	f.Script(gsrtest.OpWatch, gsrtest.Fault{Err: gsr.ErrCompacted})
+	ch = f.Watch(ctx, "a/", &gsr.WatchOptions{Prefix: true})
+	if resp, ok := next(ch); !ok || resp.Err != gsr.ErrCompacted {
+		t.Fatalf("Expected ErrCompacted, but got %v.", resp)
+	}
+	if _, ok := next(ch); ok {
+		t.Fatal("Expected the watch to be closed.")
+	}
+}
+
+func TestFaultBackendRevokeLeases(t *testing.T) {
+	f, stop := newFaultBackend(t)
+	defer stop()
+	r, err := gsr.NewWithBackend(f)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer r.Close()
+
+	ep := gsr.Endpoint{
+		Service: &gsr.Service{Name: "web"},
+		Address: "10.0.0.1:80",
+	}
+	if err := r.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if err := f.RevokeLeases(); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if eps := r.Endpoints("web"); len(eps) != 0 {
+		t.Fatalf("Expected no endpoints, but got %v.", eps)
+	}
+
+	// The Registry grants itself a new lease when its heartbeat stops, and
+	// registers its endpoints again under it
+	waitFor(t, 5*time.Second, "the endpoint to be registered again", func() bool {
+		return hasAddress(ep.Address, r.Endpoints("web"))
+	})
+	if err := r.Unregister(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+}
+
+func TestFaultBackendClaimLeaseLookup(t *testing.T) {
+	factory, stop := gsr.MemBackendFactory()
+	defer stop()
+	f1 := gsrtest.NewFaultBackend(factory(t))
+	r1, err := gsr.NewWithBackend(f1)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	f := gsrtest.NewFaultBackend(factory(t))
+	r2, err := gsr.NewWithBackend(f)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer r2.Close()
+
+	ep := gsr.Endpoint{
+		Service: &gsr.Service{Name: "web"},
+		Address: "10.0.0.1:80",
+	}
+	if err := r1.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	// Failing to look up r1's lease does not make it dead
+	errDown := errors.New("etcd is down")
+	f.Script(gsrtest.OpTimeToLive, gsrtest.Fault{Err: errDown})
+	other := ep
+	if _, err := r2.Claim(&other); err != errDown {
+		t.Fatalf("Expected %v, but got %v.", errDown, err)
+	}
+	if _, err := r2.Claim(&other); err != gsr.ErrEndpointOwned {
+		t.Fatalf("Expected ErrEndpointOwned, but got %v.", err)
+	}
+
+	// Once r1's lease is gone, r2 takes the endpoint over
+	if err := r1.Close(); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if err := f1.RevokeLeases(); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	res, err := r2.Claim(&other)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if res != gsr.ClaimCreated {
+		t.Fatalf("Expected created, but got %s.", res)
+	}
+}
+
+func TestFaultBackendConfigWatch(t *testing.T) {
+	f, stop := newFaultBackend(t)
+	defer stop()
+	r, err := gsr.NewWithBackend(f)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer r.Close()
+	sc, err := r.Config("web")
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if err := sc.Set("a", 1); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := make(chan *gsr.ConfigEvent, 10)
+	err = sc.Watch(ctx, "", func(ev *gsr.ConfigEvent) {
+		events <- ev
+	})
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	expect := func(name string, deleted bool) {
+		select {
+		case ev := <-events:
+			if ev.Name != name || ev.Deleted != deleted {
+				t.Fatalf("Expected %s (deleted: %v), but got %s (deleted: %v).",
+					name, deleted, ev.Name, ev.Deleted)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s.", name)
+		}
+	}
+	expect("a", false)
+
+	// A lost watch is resumed without missing changes
+	f.Script(gsrtest.OpWatch, gsrtest.Fault{Err: errors.New("etcd is down")})
+	f.DropWatches()
+	if err := sc.Set("b", 2); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	expect("b", false)
+
+	// When the changes are compacted away, the documents are read again
+	f.Script(gsrtest.OpWatch, gsrtest.Fault{Err: gsr.ErrCompacted})
+	f.FailWatches(gsr.ErrCompacted)
+	if err := sc.Delete("a"); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	expect("a", true)
+	if err := sc.Set("c", 3); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	expect("c", false)
+}
+
+func TestFaultBackendImportConflict(t *testing.T) {
+	f, stop := newFaultBackend(t)
+	defer stop()
+	r, err := gsr.NewWithBackend(f)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer r.Close()
+
+	snap := &gsr.Snapshot{
+		Version: gsr.SnapshotVersion,
+		Services: []*gsr.SnapshotService{
+			{
+				Name:      "web",
+				Endpoints: []*gsr.SnapshotEndpoint{{Address: "10.0.0.1:80"}},
+			},
+		},
+	}
+	// Somebody else writes the endpoint while it is being imported
+	f.Script(gsrtest.OpPut, gsrtest.Fault{Err: gsr.ErrCompareFailed})
+	changes, err := r.Import(snap, nil)
+	if err != gsr.ErrConflict {
+		t.Fatalf("Expected ErrConflict, but got %v.", err)
+	}
+	if len(changes) != 0 {
+		t.Fatalf("Expected no changes, but got %v.", changes)
+	}
+	if changes, err = r.Import(snap, nil); err != nil || len(changes) != 1 {
+		t.Fatalf("Expected 1 change and nil, but got %v and %v.", changes, err)
+	}
+}
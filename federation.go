@@ -0,0 +1,374 @@
+package gsr
+
+// A Federation spans the registries of several clusters, e.g. one etcd
+// cluster per region, so that a service in one region can discover failover
+// endpoints in the others. Lookups and watches cover every cluster, while
+// endpoints are only ever registered in the local cluster.
+//
+// Endpoints read through a Federation are labeled with the name of the
+// cluster they were read from. Clusters are ranked by priority: lookups list
+// the endpoints of the clusters with the lowest Priority first, and Pick()
+// only uses clusters with a higher Priority when the clusters ranked before
+// them have fewer than LocalityMinEndpoints endpoints between them, as with
+// locality tiers.
+//
+// The registries of the other clusters are connected to in the background,
+// so that a cluster which cannot be reached neither holds up nor fails the
+// creation of the Federation. Until a cluster is connected to, lookups skip
+// it and watches wait for it.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/cenkalti/backoff"
+	"golang.org/x/net/context"
+)
+
+// LabelCluster is the label holding the name of the cluster an endpoint was
+// read from through a Federation.
+const LabelCluster = "cluster"
+
+var (
+	ErrUnknownCluster = errors.New("unknown cluster")
+)
+
+// Cluster describes one of the clusters of a Federation.
+type Cluster struct {
+	// Name identifies the cluster, e.g. "us-west". It is recorded in the
+	// LabelCluster label of the endpoints read from the cluster.
+	Name string
+	// Priority ranks the cluster. Endpoints of clusters with a lower Priority
+	// are preferred. Clusters with the same Priority are used together.
+	Priority int
+	// Config configures the Registry of the cluster. It is ignored if
+	// Registry is set.
+	Config *Config
+	// Registry is the Registry of the cluster. If nil, one is created with
+	// NewWithConfig(). The Registry of the local cluster is created by
+	// NewFederation(), while those of the other clusters are created in the
+	// background, and creating them is retried until it succeeds.
+	Registry *Registry
+}
+
+type federatedCluster struct {
+	name     string
+	priority int
+	// mu protects r, which is nil until the Registry of the cluster has been
+	// created
+	mu sync.Mutex
+	r  *Registry
+	// ready is closed once r is set
+	ready chan struct{}
+}
+
+// Returns the Registry of the cluster, or nil if it has not been created yet.
+func (c *federatedCluster) registry() *Registry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.r
+}
+
+// Labels an endpoint read from the cluster with the cluster's name.
+func (c *federatedCluster) label(ep *Endpoint) {
+	if ep.Labels == nil {
+		ep.Labels = make(map[string]string, 1)
+	}
+	ep.Labels[LabelCluster] = c.name
+}
+
+// Labels endpoints read from the cluster, and returns those whose labels
+// then match the supplied selector.
+func (c *federatedCluster) filter(eps []*Endpoint, sel Selector) []*Endpoint {
+	res := make([]*Endpoint, 0, len(eps))
+	for _, ep := range eps {
+		c.label(ep)
+		if sel.Matches(ep.Labels) {
+			res = append(res, ep)
+		}
+	}
+	return res
+}
+
+// Federation aggregates the Registry objects of several clusters.
+type Federation struct {
+	local *federatedCluster
+	// clusters holds every cluster, including the local one, by priority
+	// and then by name
+	clusters []*federatedCluster
+	// mu protects next, which holds, per service, the round-robin position
+	// used by Pick()
+	mu   sync.Mutex
+	next map[string]uint64
+	// ctx is done once the Federation is closed, which stops the Registry
+	// objects of the clusters from being created
+	ctx  context.Context
+	stop context.CancelFunc
+}
+
+// NewFederation creates a Federation of the supplied clusters. Endpoints are
+// registered in the cluster named local, which must be one of them. The
+// Federation takes ownership of the Registry objects of the clusters and
+// closes them when it is closed. If an error is returned, the Registry
+// objects supplied in clusters are left alone.
+//
+// Only the Registry of the local cluster is created before NewFederation
+// returns. Those of the other clusters that are configured with a Config are
+// created in the background.
+func NewFederation(local string, clusters []Cluster) (*Federation, error) {
+	seen := make(map[string]bool, len(clusters))
+	for _, c := range clusters {
+		if c.Name == "" || seen[c.Name] {
+			return nil, fmt.Errorf("invalid or duplicate cluster name %q", c.Name)
+		}
+		if c.Registry == nil && c.Config == nil {
+			return nil, fmt.Errorf("cluster %q has neither a registry nor a config", c.Name)
+		}
+		seen[c.Name] = true
+	}
+	if !seen[local] {
+		return nil, ErrUnknownCluster
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f := &Federation{
+		next: make(map[string]uint64, 0),
+		ctx:  ctx,
+		stop: cancel,
+	}
+	pending := make(map[*federatedCluster]*Config, 0)
+	for _, c := range clusters {
+		fc := &federatedCluster{
+			name:     c.Name,
+			priority: c.Priority,
+			r:        c.Registry,
+			ready:    make(chan struct{}),
+		}
+		if c.Name == local && fc.r == nil {
+			r, err := NewWithConfig(c.Config)
+			if err != nil {
+				cancel()
+				return nil, err
+			}
+			fc.r = r
+		}
+		if fc.r != nil {
+			close(fc.ready)
+		} else {
+			pending[fc] = c.Config
+		}
+		if c.Name == local {
+			f.local = fc
+		}
+		f.clusters = append(f.clusters, fc)
+	}
+	sort.SliceStable(f.clusters, func(i, j int) bool {
+		a, b := f.clusters[i], f.clusters[j]
+		if a.priority != b.priority {
+			return a.priority < b.priority
+		}
+		return a.name < b.name
+	})
+	for fc, cfg := range pending {
+		go f.connect(fc, cfg)
+	}
+	return f, nil
+}
+
+// Creates the Registry of a cluster from the supplied configuration, retrying
+// until it succeeds or the Federation is closed.
+func (f *Federation) connect(c *federatedCluster, cfg *Config) {
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = watchRetryInterval
+	bo.MaxInterval = watchRetryMaxInterval
+	bo.MaxElapsedTime = 0
+	for {
+		r, err := NewWithConfig(cfg)
+		if err == nil {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			if f.ctx.Err() != nil {
+				r.Close()
+				return
+			}
+			c.r = r
+			close(c.ready)
+			f.local.r.L1("connected to the registry of cluster %s.", c.name)
+			return
+		}
+		f.local.r.LERR("failed to connect to the registry of cluster %s: %v",
+			c.name, err)
+		if !sleepCtx(f.ctx, bo.NextBackOff()) {
+			return
+		}
+	}
+}
+
+// Local returns the Registry of the local cluster, for the features of gsr
+// that do not span clusters.
+func (f *Federation) Local() *Registry {
+	return f.local.r
+}
+
+// Register registers an endpoint in the local cluster. See
+// Registry.Register().
+func (f *Federation) Register(ep *Endpoint) error {
+	return f.local.r.Register(ep)
+}
+
+// Unregister removes an endpoint registered with Register() from the local
+// cluster. See Registry.Unregister().
+func (f *Federation) Unregister(ep *Endpoint) error {
+	return f.local.r.Unregister(ep)
+}
+
+// Endpoints returns the endpoints of a service in every cluster, in the
+// clusters' order of priority. Endpoints that are draining are not included.
+// Clusters that cannot be reached, or have not been connected to yet, are
+// skipped. See Registry.Endpoints().
+func (f *Federation) Endpoints(service string) []*Endpoint {
+	res := make([]*Endpoint, 0)
+	for _, c := range f.clusters {
+		if r := c.registry(); r != nil {
+			res = append(res, c.filter(r.Endpoints(service), nil)...)
+		}
+	}
+	return res
+}
+
+// Query returns the endpoints of a service in every cluster whose labels,
+// including LabelCluster, match the supplied selector, in the clusters'
+// order of priority and then by address. Endpoints that are draining are not
+// included. Like Registry.Query(), Query is answered from local caches.
+// Clusters that have not been connected to yet are skipped.
+func (f *Federation) Query(service string, sel Selector) []*Endpoint {
+	res := make([]*Endpoint, 0)
+	for _, c := range f.clusters {
+		if r := c.registry(); r != nil {
+			res = append(res, c.filter(r.Query(service, nil), sel)...)
+		}
+	}
+	return res
+}
+
+// Pick returns one of the endpoints of a service matching the supplied
+// selector, balancing requests in round-robin fashion. Only the endpoints of
+// the clusters with the lowest Priority are used, unless there are fewer than
+// the local cluster's LocalityMinEndpoints setting of them, in which case the
+// clusters with the next lowest Priority are added, and so on.
+// ErrNoEndpoints is returned if no endpoint is available.
+func (f *Federation) Pick(service string, sel Selector) (*Endpoint, error) {
+	min := f.local.r.config.LocalityMinEndpoints
+	eps := make([]*Endpoint, 0)
+	for x, c := range f.clusters {
+		if x > 0 && c.priority != f.clusters[x-1].priority &&
+			len(eps) >= min && len(eps) > 0 {
+			break
+		}
+		if r := c.registry(); r != nil {
+			eps = append(eps, c.filter(r.Query(service, nil), sel)...)
+		}
+	}
+	if len(eps) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	f.mu.Lock()
+	n := f.next[service]
+	f.next[service] = n + 1
+	f.mu.Unlock()
+	return eps[n%uint64(len(eps))], nil
+}
+
+// Watch returns a channel on which changes to the endpoints of a service in
+// every cluster are delivered, as with Registry.Watch(). The supplied
+// selector may match LabelCluster. The Cluster of each event is set to the
+// name of the cluster it comes from, which also tells which cluster an
+// EventReconnected is about. Clusters that have not been connected to yet are
+// watched once they are. The channel is closed once the supplied context is
+// done.
+func (f *Federation) Watch(
+	ctx context.Context,
+	service string,
+	sel Selector,
+) <-chan *Event {
+	ch := make(chan *Event, watchBufferSize)
+	var wg sync.WaitGroup
+	for _, c := range f.clusters {
+		wg.Add(1)
+		go func(c *federatedCluster) {
+			defer wg.Done()
+			select {
+			case <-c.ready:
+			case <-ctx.Done():
+				return
+			case <-f.ctx.Done():
+				return
+			}
+			c.forward(ctx, c.registry().Watch(ctx, service, nil), sel, ch)
+		}(c)
+	}
+	go func() {
+		wg.Wait()
+		close(ch)
+	}()
+	return ch
+}
+
+// Passes the events of a watch of the cluster's Registry on to ch until the
+// watch is closed. Endpoints are labeled with the cluster's name before the
+// selector is applied, so the selector decides itself whether an endpoint is
+// created, updated or deleted as far as ch is concerned.
+func (c *federatedCluster) forward(
+	ctx context.Context,
+	events <-chan *Event,
+	sel Selector,
+	ch chan<- *Event,
+) {
+	// matched holds the service and address of the endpoints last seen
+	// matching the selector
+	matched := make(map[string]bool, 0)
+	for ev := range events {
+		ev.Cluster = c.name
+		if ev.Type != EventReconnected {
+			c.label(ev.Endpoint)
+			key := ev.Endpoint.Service.Name + "/" + ev.Endpoint.Address
+			was := matched[key]
+			is := ev.Type != EventDeleted && sel.Matches(ev.Endpoint.Labels)
+			switch {
+			case was && is:
+				ev.Type = EventUpdated
+			case was:
+				ev.Type = EventDeleted
+				delete(matched, key)
+			case is:
+				ev.Type = EventCreated
+				matched[key] = true
+			default:
+				continue
+			}
+		}
+		select {
+		case ch <- ev:
+		case <-ctx.Done():
+		}
+	}
+}
+
+// Close closes the Registry of every cluster, and stops trying to create
+// those that have not been created yet.
+func (f *Federation) Close() error {
+	f.stop()
+	var res error
+	for _, c := range f.clusters {
+		r := c.registry()
+		if r == nil {
+			continue
+		}
+		if err := r.Close(); err != nil && res == nil {
+			res = err
+		}
+	}
+	return res
+}
@@ -0,0 +1,312 @@
+package gsr_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jaypipes/gsr"
+	"golang.org/x/net/context"
+)
+
+// Returns a Federation of two clusters, the local "us-east" and "us-west",
+// each with an in-memory store, along with a Registry of its own connected to
+// each cluster's store. The returned function closes everything.
+func newFederation(
+	t *testing.T,
+	eastPriority int,
+	westPriority int,
+) (*gsr.Federation, *gsr.Registry, *gsr.Registry, func()) {
+	stops := make([]func(), 0)
+	others := make([]*gsr.Registry, 0)
+	clusters := make([]gsr.Cluster, 0)
+	for _, c := range []struct {
+		name     string
+		priority int
+	}{{"us-east", eastPriority}, {"us-west", westPriority}} {
+		factory, stop := gsr.MemBackendFactory()
+		stops = append(stops, stop)
+		r, err := gsr.NewWithBackend(factory(t))
+		if err != nil {
+			t.Fatalf("Expected nil, but got %v.", err)
+		}
+		other, err := gsr.NewWithBackend(factory(t))
+		if err != nil {
+			t.Fatalf("Expected nil, but got %v.", err)
+		}
+		others = append(others, other)
+		clusters = append(clusters, gsr.Cluster{
+			Name:     c.name,
+			Priority: c.priority,
+			Registry: r,
+		})
+	}
+	f, err := gsr.NewFederation("us-east", clusters)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	return f, others[0], others[1], func() {
+		f.Close()
+		for x := range others {
+			others[x].Close()
+			stops[x]()
+		}
+	}
+}
+
+func TestNewFederationErrors(t *testing.T) {
+	factory, stop := gsr.MemBackendFactory()
+	defer stop()
+	r, err := gsr.NewWithBackend(factory(t))
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer r.Close()
+
+	clusters := []gsr.Cluster{{Name: "us-east", Registry: r}}
+	if _, err := gsr.NewFederation("eu-west", clusters); err != gsr.ErrUnknownCluster {
+		t.Fatalf("Expected ErrUnknownCluster, but got %v.", err)
+	}
+	clusters = append(clusters, gsr.Cluster{Name: "us-east", Registry: r})
+	if _, err := gsr.NewFederation("us-east", clusters); err == nil {
+		t.Fatal("Expected error for duplicate cluster names, but got nil.")
+	}
+	clusters[1] = gsr.Cluster{Name: "us-west"}
+	if _, err := gsr.NewFederation("us-east", clusters); err == nil {
+		t.Fatal("Expected error for a cluster without a config, but got nil.")
+	}
+	// The Registry supplied is left alone when the Federation is not
+	// created
+	if eps := r.Endpoints("web"); eps == nil {
+		t.Fatal("Expected []*Endpoint, but got nil.")
+	}
+}
+
+func TestFederationRegisterAndQuery(t *testing.T) {
+	f, east, west, done := newFederation(t, 0, 0)
+	defer done()
+
+	local := gsr.Endpoint{
+		Service: &gsr.Service{Name: "web"},
+		Address: "10.0.0.1:80",
+	}
+	if err := f.Register(&local); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	remote := gsr.Endpoint{
+		Service: &gsr.Service{Name: "web"},
+		Address: "10.1.0.1:80",
+	}
+	if err := west.Register(&remote); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	// Registration only ever goes to the local cluster
+	if eps := east.Endpoints("web"); !hasAddress(local.Address, eps) {
+		t.Fatalf("Expected to find %s in %v.", local.Address, eps)
+	}
+	if eps := west.Endpoints("web"); hasAddress(local.Address, eps) {
+		t.Fatalf("Expected not to find %s in %v.", local.Address, eps)
+	}
+
+	// Lookups span every cluster, and tell where each endpoint comes from
+	eps := f.Endpoints("web")
+	if len(eps) != 2 {
+		t.Fatalf("Expected 2 endpoints, but got %v.", eps)
+	}
+	clusters := map[string]string{
+		local.Address:  "us-east",
+		remote.Address: "us-west",
+	}
+	for _, ep := range eps {
+		if got := ep.Labels[gsr.LabelCluster]; got != clusters[ep.Address] {
+			t.Fatalf("Expected %s to be in %s, but got %q.",
+				ep.Address, clusters[ep.Address], got)
+		}
+	}
+	waitFor(t, 5*time.Second, "the endpoints to be cached", func() bool {
+		return len(f.Query("web", nil)) == 2
+	})
+	eps = f.Query("web", gsr.MustParseSelector("cluster=us-west"))
+	if len(eps) != 1 || eps[0].Address != remote.Address {
+		t.Fatalf("Expected only %s, but got %v.", remote.Address, eps)
+	}
+
+	if err := f.Unregister(&local); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if eps := east.Endpoints("web"); len(eps) != 0 {
+		t.Fatalf("Expected no endpoints, but got %v.", eps)
+	}
+}
+
+func TestFederationPriority(t *testing.T) {
+	f, _, west, done := newFederation(t, 0, 1)
+	defer done()
+
+	local := gsr.Endpoint{
+		Service: &gsr.Service{Name: "web"},
+		Address: "10.0.0.1:80",
+	}
+	remote := gsr.Endpoint{
+		Service: &gsr.Service{Name: "web"},
+		Address: "10.1.0.1:80",
+	}
+	if err := west.Register(&remote); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if err := f.Register(&local); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	waitFor(t, 5*time.Second, "the endpoints to be cached", func() bool {
+		return len(f.Query("web", nil)) == 2
+	})
+
+	// The cluster with the lowest priority comes first, and is the only one
+	// used while it has endpoints
+	if eps := f.Query("web", nil); eps[0].Address != local.Address {
+		t.Fatalf("Expected %s first, but got %v.", local.Address, eps)
+	}
+	for x := 0; x < 3; x++ {
+		ep, err := f.Pick("web", nil)
+		if err != nil {
+			t.Fatalf("Expected nil, but got %v.", err)
+		}
+		if ep.Address != local.Address {
+			t.Fatalf("Expected %s, but got %s.", local.Address, ep.Address)
+		}
+	}
+
+	// Without local endpoints, the next cluster takes over
+	if err := f.Unregister(&local); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	waitFor(t, 5*time.Second, "the endpoint to leave the cache", func() bool {
+		return len(f.Query("web", nil)) == 1
+	})
+	ep, err := f.Pick("web", nil)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if ep.Address != remote.Address {
+		t.Fatalf("Expected %s, but got %s.", remote.Address, ep.Address)
+	}
+
+	if _, err := f.Pick("data", nil); err != gsr.ErrNoEndpoints {
+		t.Fatalf("Expected ErrNoEndpoints, but got %v.", err)
+	}
+}
+
+func TestFederationWatch(t *testing.T) {
+	f, _, west, done := newFederation(t, 0, 1)
+	defer done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	all := f.Watch(ctx, "web", nil)
+	sel := gsr.MustParseSelector("cluster=us-west,version=v2")
+	westV2 := f.Watch(ctx, "web", sel)
+
+	local := gsr.Endpoint{
+		Service: &gsr.Service{Name: "web"},
+		Address: "10.0.0.1:80",
+		Labels:  map[string]string{"version": "v2"},
+	}
+	if err := f.Register(&local); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	ev := nextEvent(t, all)
+	if ev.Type != gsr.EventCreated || ev.Cluster != "us-east" ||
+		ev.Endpoint.Labels[gsr.LabelCluster] != "us-east" {
+		t.Fatalf("Expected %s created in us-east, but got %v.",
+			local.Address, ev)
+	}
+
+	remote := gsr.Endpoint{
+		Service: &gsr.Service{Name: "web"},
+		Address: "10.1.0.1:80",
+		Labels:  map[string]string{"version": "v2"},
+	}
+	if err := west.Register(&remote); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	for _, events := range []<-chan *gsr.Event{all, westV2} {
+		ev := nextEvent(t, events)
+		if ev.Type != gsr.EventCreated || ev.Cluster != "us-west" ||
+			ev.Endpoint.Address != remote.Address {
+			t.Fatalf("Expected %s created in us-west, but got %v.",
+				remote.Address, ev)
+		}
+	}
+
+	// An endpoint that no longer matches the selector is deleted as far as
+	// the watch is concerned
+	remote.Labels["version"] = "v1"
+	if err := west.Update(&remote); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	expectEvent(t, all, gsr.EventUpdated, remote.Address)
+	expectEvent(t, westV2, gsr.EventDeleted, remote.Address)
+}
+
+func TestFederationConnectsLater(t *testing.T) {
+	factory, stop := gsr.MemBackendFactory()
+	defer stop()
+	east, err := gsr.NewWithBackend(factory(t))
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	// The registry file of us-west does not exist yet, so its Registry
+	// cannot be created
+	dir, err := ioutil.TempDir("", "gsr-federation")
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "us-west", "registry.yaml")
+	west := gsr.ConfigFromEnv()
+	west.Backend = "file://" + path
+
+	f, err := gsr.NewFederation("us-east", []gsr.Cluster{
+		{Name: "us-east", Registry: east},
+		{Name: "us-west", Priority: 1, Config: west},
+	})
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer f.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := f.Watch(ctx, "web", nil)
+
+	local := gsr.Endpoint{
+		Service: &gsr.Service{Name: "web"},
+		Address: "10.0.0.1:80",
+	}
+	if err := f.Register(&local); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if eps := f.Endpoints("web"); len(eps) != 1 || eps[0].Address != local.Address {
+		t.Fatalf("Expected only %s, but got %v.", local.Address, eps)
+	}
+	expectEvent(t, events, gsr.EventCreated, local.Address)
+
+	// Once us-west can be reached, it joins lookups and watches
+	if err := os.Mkdir(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	file := "version: 1\nservices:\n- name: web\n  endpoints:\n  - address: 10.1.0.1:80\n"
+	if err := ioutil.WriteFile(path, []byte(file), 0644); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	waitFor(t, 10*time.Second, "us-west to be connected", func() bool {
+		return hasAddress("10.1.0.1:80", f.Query("web", nil))
+	})
+	ev := nextEvent(t, events)
+	if ev.Type != gsr.EventCreated || ev.Cluster != "us-west" ||
+		ev.Endpoint.Address != "10.1.0.1:80" {
+		t.Fatalf("Expected 10.1.0.1:80 created in us-west, but got %v.", ev)
+	}
+}
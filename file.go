@@ -0,0 +1,152 @@
+package gsr
+
+// The file backend serves the registry from a local snapshot document (see
+// snapshot.go), so that applications can use gsr without an etcd cluster,
+// e.g. during local development:
+//
+//   GSR_BACKEND=file:///path/to/registry.yaml
+//
+// The file is watched for changes. When it is rewritten, the services,
+// endpoints and configuration documents it holds are updated and watchers see
+// the same events they would from etcd. Endpoints registered by the
+// application itself are kept in memory and are only visible to the
+// application's own process. A reload leaves them alone, even if the file
+// holds an endpoint with the same address.
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// How long to wait after a change to the file before reloading it, so that a
+// burst of writes from an editor results in a single reload.
+const fileReloadDelay = 50 * time.Millisecond
+
+type fileBackend struct {
+	*memBackend
+	path    string
+	prefix  string
+	logf    func(string, ...interface{})
+	watcher *fsnotify.Watcher
+	// loaded holds the keys and values read from the file by the last
+	// successful load
+	loaded map[string]string
+}
+
+func newFileBackend(
+	path string,
+	cfg *Config,
+	logf func(string, ...interface{}),
+) (*fileBackend, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	b := &fileBackend{
+		memBackend: newMemBackend(),
+		path:       path,
+		prefix:     cfg.EtcdKeyPrefix,
+		logf:       logf,
+		loaded:     make(map[string]string, 0),
+	}
+	if err = b.load(); err != nil {
+		b.memBackend.Close()
+		return nil, err
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		b.memBackend.Close()
+		return nil, err
+	}
+	// Watch the directory rather than the file, since editors often replace
+	// a file by renaming a new one over it
+	if err = w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		b.memBackend.Close()
+		return nil, err
+	}
+	b.watcher = w
+	go b.watch()
+	return b, nil
+}
+
+// Reads the file and applies any differences from its last load to the store.
+func (b *fileBackend) load() error {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	format := SnapshotJSON
+	switch filepath.Ext(b.path) {
+	case ".yaml", ".yml":
+		format = SnapshotYAML
+	}
+	snap, err := DecodeSnapshot(f, format)
+	if err != nil {
+		return err
+	}
+	entries, err := snapshotEntries(
+		namespaceKeyFor(b.prefix, snap.Namespace), snap,
+	)
+	if err != nil {
+		return err
+	}
+
+	puts := make(map[string]string, 0)
+	loaded := make(map[string]string, len(entries))
+	for key, entry := range entries {
+		loaded[key] = entry.value
+		if prev, found := b.loaded[key]; !found || prev != entry.value {
+			puts[key] = entry.value
+		}
+	}
+	deletes := make([]string, 0)
+	for key := range b.loaded {
+		if _, found := loaded[key]; !found {
+			deletes = append(deletes, key)
+		}
+	}
+	b.apply(puts, deletes)
+	b.loaded = loaded
+	return nil
+}
+
+// Reloads the file whenever it changes until the backend is closed.
+func (b *fileBackend) watch() {
+	var reload <-chan time.Time
+	for {
+		select {
+		case ev, ok := <-b.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(ev.Name) != b.path {
+				continue
+			}
+			if ev.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) != 0 {
+				reload = time.After(fileReloadDelay)
+			}
+		case err, ok := <-b.watcher.Errors:
+			if !ok {
+				return
+			}
+			b.logf("error watching %s: %v", b.path, err)
+		case <-reload:
+			reload = nil
+			if err := b.load(); err != nil {
+				// Keep serving the last good contents while the file is
+				// being edited
+				b.logf("failed to reload %s: %v", b.path, err)
+			}
+		}
+	}
+}
+
+func (b *fileBackend) Close() error {
+	b.watcher.Close()
+	return b.memBackend.Close()
+}
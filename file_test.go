@@ -0,0 +1,201 @@
+package gsr
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const testRegistryFile = `version: 1
+services:
+- name: web
+  endpoints:
+  - address: 10.0.0.1:80
+    labels:
+      zone: a
+  config:
+    limits:
+      max_conns: 10
+`
+
+const testRegistryFileUpdated = `version: 1
+services:
+- name: web
+  endpoints:
+  - address: 10.0.0.2:80
+`
+
+func TestFileBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsr-file-backend")
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registry.yaml")
+	if err = ioutil.WriteFile(path, []byte(testRegistryFile), 0644); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	orig, found := os.LookupEnv("GSR_BACKEND")
+	if !found {
+		defer os.Unsetenv("GSR_BACKEND")
+	} else {
+		defer os.Setenv("GSR_BACKEND", orig)
+	}
+	os.Setenv("GSR_BACKEND", "file://"+path)
+
+	r, err := New()
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := r.Watch(ctx, "web", nil)
+	expect := func(typ EventType, addr string) {
+		select {
+		case ev := <-events:
+			if ev.Type != typ || ev.Endpoint.Address != addr {
+				t.Fatalf("Expected %s of %s, but got %s of %s.",
+					typ, addr, ev.Type, ev.Endpoint.Address)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s of %s.", typ, addr)
+		}
+	}
+	expect(EventCreated, "10.0.0.1:80")
+
+	eps := r.Endpoints("web")
+	if len(eps) != 1 || eps[0].Address != "10.0.0.1:80" ||
+		eps[0].Labels["zone"] != "a" {
+		t.Fatalf("Expected 10.0.0.1:80 in zone a, but got %v.", eps)
+	}
+	cfg, err := r.Config("web")
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	limits := struct {
+		MaxConns int `json:"max_conns"`
+	}{}
+	if err = cfg.Get("limits", &limits); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if limits.MaxConns != 10 {
+		t.Fatalf("Expected 10, but got %d.", limits.MaxConns)
+	}
+
+	// Endpoints registered by the process are served alongside those in
+	// the file
+	ep := Endpoint{Service: &Service{Name: "web"}, Address: "127.0.0.1:8080"}
+	if err = r.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if eps = r.Endpoints("web"); len(eps) != 2 {
+		t.Fatalf("Expected 2 endpoints, but got %v.", eps)
+	}
+	if err = r.Unregister(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	expect(EventCreated, "127.0.0.1:8080")
+	expect(EventDeleted, "127.0.0.1:8080")
+
+	// Rewriting the file is seen by watchers like any other change
+	err = ioutil.WriteFile(path, []byte(testRegistryFileUpdated), 0644)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	got := map[EventType]string{}
+	for x := 0; x < 2; x++ {
+		select {
+		case ev := <-events:
+			got[ev.Type] = ev.Endpoint.Address
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for changes from the file.")
+		}
+	}
+	if got[EventCreated] != "10.0.0.2:80" || got[EventDeleted] != "10.0.0.1:80" {
+		t.Fatalf("Expected 10.0.0.2:80 created and 10.0.0.1:80 deleted, "+
+			"but got %v.", got)
+	}
+	if err = cfg.Get("limits", &limits); err != ErrConfigNotFound {
+		t.Fatalf("Expected ErrConfigNotFound, but got %v.", err)
+	}
+
+	// Features that need etcd report that they are not supported
+	if _, err = r.Leader("web"); err != ErrNotSupported {
+		t.Fatalf("Expected ErrNotSupported, but got %v.", err)
+	}
+	snap := &Snapshot{Version: SnapshotVersion}
+	if _, err = r.Import(snap, nil); err != ErrNotSupported {
+		t.Fatalf("Expected ErrNotSupported, but got %v.", err)
+	}
+}
+
+func TestFileBackendKeepsLeasedKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gsr-file-backend")
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registry.yaml")
+	if err = ioutil.WriteFile(path, []byte(testRegistryFile), 0644); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	b, err := newFileBackend(path, &Config{EtcdKeyPrefix: "gsr/"}, t.Logf)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	r, err := NewWithBackend(b)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer r.Close()
+
+	// The process takes over the endpoint from the file
+	ep := Endpoint{Service: &Service{Name: "web"}, Address: "10.0.0.1:80"}
+	if err = r.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	// Reloading a file without the endpoint leaves it registered
+	err = ioutil.WriteFile(path, []byte(testRegistryFileUpdated), 0644)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !contains("10.0.0.2:80", r.Endpoints("web")) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for changes from the file.")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if eps := r.Endpoints("web"); !contains(ep.Address, eps) {
+		t.Fatalf("Expected to find %s in %v.", ep.Address, eps)
+	}
+}
+
+func TestFileBackendBadFile(t *testing.T) {
+	cfg := &Config{EtcdKeyPrefix: "gsr/"}
+	logf := func(string, ...interface{}) {}
+	if _, err := newFileBackend("/nonexistent/registry.yaml", cfg, logf); err == nil {
+		t.Fatalf("Expected an error for a missing file, but got nil.")
+	}
+
+	dir, err := ioutil.TempDir("", "gsr-file-backend")
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registry.json")
+	if err = ioutil.WriteFile(path, []byte(`{"version": 9}`), 0644); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if _, err = newFileBackend(path, cfg, logf); err != ErrSnapshotVersion {
+		t.Fatalf("Expected ErrSnapshotVersion, but got %v.", err)
+	}
+}
@@ -0,0 +1,207 @@
+package gsr
+
+// Feature flags are stored as configuration documents of a service (see
+// config.go) whose names begin with "flag.". A FlagSet watches those documents
+// and evaluates flags against its local copy, so checking a flag never
+// contacts etcd.
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// The prefix of the names of configuration documents that hold flags.
+const flagDocPrefix = "flag."
+
+var (
+	ErrFlagNotFound = errors.New("flag not found")
+)
+
+type FlagType string
+
+const (
+	// FlagBoolean flags are either on or off for everybody.
+	FlagBoolean FlagType = "boolean"
+	// FlagPercentage flags are on for a percentage of the keys they are
+	// evaluated against.
+	FlagPercentage FlagType = "percentage"
+)
+
+// Flag is a feature flag of a service.
+type Flag struct {
+	Name string   `json:"name"`
+	Type FlagType `json:"type"`
+	// Enabled turns the flag on for everybody, for a boolean flag, or for
+	// Percent percent of keys, for a percentage flag. A disabled flag is off
+	// for everybody.
+	Enabled bool `json:"enabled"`
+	// Percent is between 0 and 100 and only applies to percentage flags.
+	Percent float64 `json:"percent,omitempty"`
+}
+
+func (f *Flag) String() string {
+	state := "off"
+	if f.Enabled {
+		state = "on"
+		if f.Type == FlagPercentage {
+			state = fmt.Sprintf("%g%%", f.Percent)
+		}
+	}
+	return f.Name + "=" + state
+}
+
+func (f *Flag) validate() error {
+	if err := validateConfigName(f.Name); err != nil {
+		return fmt.Errorf("invalid flag name %q", f.Name)
+	}
+	switch f.Type {
+	case FlagBoolean:
+	case FlagPercentage:
+		if f.Percent < 0 || f.Percent > 100 {
+			return fmt.Errorf(
+				"percent of flag %s must be between 0 and 100", f.Name,
+			)
+		}
+	default:
+		return fmt.Errorf("unknown type %q of flag %s", f.Type, f.Name)
+	}
+	return nil
+}
+
+// EnabledFor returns whether the flag is on for the supplied key, e.g. a user
+// or account ID. Percentage flags hash the key together with the flag's name,
+// so a key gets the same answer from every process and different flags roll
+// out to different keys.
+func (f *Flag) EnabledFor(key string) bool {
+	if !f.Enabled {
+		return false
+	}
+	if f.Type != FlagPercentage {
+		return true
+	}
+	return flagBucket(f.Name, key) < f.Percent
+}
+
+// Returns a number in [0, 100) that is fixed for a flag name and key.
+func flagBucket(name string, key string) float64 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write([]byte(key))
+	return float64(h.Sum32()%10000) / 100
+}
+
+// SetFlag creates or replaces a flag of the supplied service.
+func (r *Registry) SetFlag(service string, f *Flag) error {
+	if err := f.validate(); err != nil {
+		return err
+	}
+	sc, err := r.Config(service)
+	if err != nil {
+		return err
+	}
+	return sc.Set(flagDocPrefix+f.Name, f)
+}
+
+// DeleteFlag removes a flag of the supplied service. ErrFlagNotFound is
+// returned if the flag does not exist.
+func (r *Registry) DeleteFlag(service string, name string) error {
+	sc, err := r.Config(service)
+	if err != nil {
+		return err
+	}
+	if err = validateConfigName(name); err != nil {
+		return err
+	}
+	err = sc.Delete(flagDocPrefix + name)
+	if err == ErrConfigNotFound {
+		return ErrFlagNotFound
+	}
+	return err
+}
+
+// FlagSet holds the flags of a service and keeps them up to date.
+type FlagSet struct {
+	service string
+	mu      sync.RWMutex
+	flags   map[string]*Flag
+}
+
+// Flags returns the flags of the supplied service. The returned FlagSet is
+// kept up to date as flags change until the supplied context is done.
+func (r *Registry) Flags(ctx context.Context, service string) (*FlagSet, error) {
+	sc, err := r.Config(service)
+	if err != nil {
+		return nil, err
+	}
+	fs := &FlagSet{
+		service: service,
+		flags:   make(map[string]*Flag, 0),
+	}
+	err = sc.Watch(ctx, "", func(ev *ConfigEvent) {
+		if !strings.HasPrefix(ev.Name, flagDocPrefix) {
+			return
+		}
+		name := ev.Name[len(flagDocPrefix):]
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		if ev.Deleted {
+			delete(fs.flags, name)
+			return
+		}
+		f := &Flag{}
+		if err := json.Unmarshal(ev.Value, f); err != nil {
+			r.LERR("failed to decode flag %s of %s: %v", name, service, err)
+			return
+		}
+		f.Name = name
+		fs.flags[name] = f
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// Enabled returns whether the named flag is on for the supplied key. Flags
+// that do not exist are off.
+func (fs *FlagSet) Enabled(name string, key string) bool {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	f, found := fs.flags[name]
+	return found && f.EnabledFor(key)
+}
+
+// Flag returns a copy of the named flag, or ErrFlagNotFound.
+func (fs *FlagSet) Flag(name string) (*Flag, error) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	f, found := fs.flags[name]
+	if !found {
+		return nil, ErrFlagNotFound
+	}
+	c := *f
+	return &c, nil
+}
+
+// All returns copies of every flag, sorted by name.
+func (fs *FlagSet) All() []*Flag {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	res := make([]*Flag, 0, len(fs.flags))
+	for _, f := range fs.flags {
+		c := *f
+		res = append(res, &c)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
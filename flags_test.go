@@ -0,0 +1,72 @@
+package gsr
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestFlagEnabledFor(t *testing.T) {
+	tests := []struct {
+		flag   Flag
+		expect bool
+	}{
+		{Flag{Name: "f", Type: FlagBoolean, Enabled: true}, true},
+		{Flag{Name: "f", Type: FlagBoolean}, false},
+		{Flag{Name: "f", Type: FlagPercentage, Enabled: true, Percent: 100}, true},
+		{Flag{Name: "f", Type: FlagPercentage, Enabled: true, Percent: 0}, false},
+		{Flag{Name: "f", Type: FlagPercentage, Percent: 100}, false},
+	}
+	for _, test := range tests {
+		if got := test.flag.EnabledFor("user-1"); got != test.expect {
+			t.Fatalf("Expected %v for %s, but got %v.",
+				test.expect, test.flag.String(), got)
+		}
+	}
+}
+
+func TestFlagPercentageRollout(t *testing.T) {
+	f := Flag{Name: "new-ui", Type: FlagPercentage, Enabled: true, Percent: 25}
+	on := 0
+	for x := 0; x < 10000; x++ {
+		key := fmt.Sprintf("user-%d", x)
+		got := f.EnabledFor(key)
+		if got != f.EnabledFor(key) {
+			t.Fatalf("Expected the same result for %s every time.", key)
+		}
+		if got {
+			on++
+		}
+	}
+	if on < 2300 || on > 2700 {
+		t.Fatalf("Expected roughly 2500 keys to be enabled, but got %d.", on)
+	}
+
+	// A key enabled at a lower percentage stays enabled as the rollout grows
+	g := f
+	g.Percent = 50
+	for x := 0; x < 1000; x++ {
+		key := fmt.Sprintf("user-%d", x)
+		if f.EnabledFor(key) && !g.EnabledFor(key) {
+			t.Fatalf("Expected %s to stay enabled at 50%%.", key)
+		}
+	}
+}
+
+func TestFlagValidate(t *testing.T) {
+	bad := []Flag{
+		{Name: "", Type: FlagBoolean},
+		{Name: "a/b", Type: FlagBoolean},
+		{Name: "f", Type: "sometimes"},
+		{Name: "f", Type: FlagPercentage, Percent: 101},
+		{Name: "f", Type: FlagPercentage, Percent: -1},
+	}
+	for _, f := range bad {
+		if err := f.validate(); err == nil {
+			t.Fatalf("Expected an error for %+v, but got nil.", f)
+		}
+	}
+	good := Flag{Name: "f", Type: FlagPercentage, Percent: 10}
+	if err := good.validate(); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+}
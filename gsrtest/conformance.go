@@ -0,0 +1,876 @@
+// Package gsrtest provides helpers for testing gsr and the code that uses it.
+//
+// BackendConformance holds a gsr.Backend to the contract the Registry relies
+// on. Every backend shipped with gsr is run through it, and backends written
+// elsewhere should be too:
+//
+//	func TestMyBackendConformance(t *testing.T) {
+//	    gsrtest.BackendConformance(t, func(t *testing.T) gsr.Backend {
+//	        return mybackend.New(addr)
+//	    })
+//	}
+package gsrtest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jaypipes/gsr"
+	"golang.org/x/net/context"
+)
+
+// How long changes are waited for before a test fails. Lease expiry is waited
+// for for longer, since stores such as etcd round short TTLs up.
+const (
+	waitTimeout   = 10 * time.Second
+	expiryTimeout = 30 * time.Second
+)
+
+// Factory returns a new client of the backend under test. Every client
+// returned during a run of BackendConformance must be connected to the same
+// store, so that changes made through one client are seen by the others. The
+// suite closes every client it is given.
+type Factory func(t *testing.T) gsr.Backend
+
+// BackendConformance runs the backend conformance suite against the backend
+// whose clients are returned by the supplied factory. It checks conditional
+// writes, prefix isolation, lease expiry, watch ordering and delivery after a
+// client reconnects, and races between Registry objects registering and
+// unregistering endpoints. Each test works beneath a key prefix of its own, so
+// the suite can be run against a store holding other data.
+func BackendConformance(t *testing.T, factory Factory) {
+	root := "gsrtest-" + randomHex() + "/"
+	tests := []struct {
+		name string
+		run  func(t *testing.T, factory Factory, prefix string)
+	}{
+		{"Conditions", testConditions},
+		{"PrefixIsolation", testPrefixIsolation},
+		{"LeaseExpiry", testLeaseExpiry},
+		{"LeaseDetach", testLeaseDetach},
+		{"WatchOrder", testWatchOrder},
+		{"WatchAfterReconnect", testWatchAfterReconnect},
+		{"RegisterUnregisterRaces", testRegisterUnregisterRaces},
+		{"ManyEndpoints", testManyEndpoints},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.run(t, factory, root+test.name+"/")
+		})
+	}
+}
+
+func randomHex() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Returns a new client from the factory, failing the test if it is nil.
+func connect(t *testing.T, factory Factory) gsr.Backend {
+	b := factory(t)
+	if b == nil {
+		t.Fatal("Expected gsr.Backend, but got nil.")
+	}
+	return b
+}
+
+// Calls check until it returns nil or the timeout passes, in which case the
+// test fails with the last error returned.
+func eventually(t *testing.T, timeout time.Duration, check func() error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := check()
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out after %v: %v", timeout, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// Reads the keys beginning with prefix.
+func keys(t *testing.T, b gsr.Backend, prefix string) []string {
+	resp, err := b.Get(context.Background(), prefix, &gsr.GetOptions{Prefix: true})
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	res := make([]string, len(resp.KVs))
+	for x, kv := range resp.KVs {
+		res[x] = kv.Key
+	}
+	return res
+}
+
+// Reads a single key, returning nil if it does not exist.
+func get(t *testing.T, b gsr.Backend, key string) *gsr.KeyValue {
+	resp, err := b.Get(context.Background(), key, nil)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if len(resp.KVs) == 0 {
+		return nil
+	}
+	return resp.KVs[0]
+}
+
+func put(
+	t *testing.T,
+	b gsr.Backend,
+	key string,
+	val string,
+	opts *gsr.PutOptions,
+) int64 {
+	rev, err := b.Put(context.Background(), key, []byte(val), opts)
+	if err != nil {
+		t.Fatalf("Expected nil putting %s, but got %v.", key, err)
+	}
+	return rev
+}
+
+func sameKeys(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for x := range a {
+		if a[x] != b[x] {
+			return false
+		}
+	}
+	return true
+}
+
+// watchReader reads events from a watch channel.
+type watchReader struct {
+	t  *testing.T
+	ch <-chan *gsr.WatchResponse
+	// pending holds events received but not yet read
+	pending []*gsr.KVEvent
+	// rev is the revision of the last response received
+	rev int64
+}
+
+// Returns the next event on the watch. A watch error is returned, rather than
+// failing the test, so that callers can handle ErrCompacted.
+func (w *watchReader) next() (*gsr.KVEvent, error) {
+	timeout := time.After(waitTimeout)
+	for len(w.pending) == 0 {
+		select {
+		case resp, ok := <-w.ch:
+			if !ok {
+				w.t.Fatal("Expected watch event, but the watch was closed.")
+			}
+			if resp.Err != nil {
+				return nil, resp.Err
+			}
+			if resp.Revision <= w.rev {
+				w.t.Fatalf("Expected revision greater than %d, but got %d.",
+					w.rev, resp.Revision)
+			}
+			w.rev = resp.Revision
+			w.pending = resp.Events
+		case <-timeout:
+			w.t.Fatal("Timed out waiting for watch event.")
+		}
+	}
+	ev := w.pending[0]
+	w.pending = w.pending[1:]
+	return ev, nil
+}
+
+// Fails the test unless the next event on the watch is the supplied change.
+func (w *watchReader) expect(typ gsr.KVEventType, key string) *gsr.KVEvent {
+	ev, err := w.next()
+	if err != nil {
+		w.t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if ev.Type != typ || ev.KV.Key != key {
+		w.t.Fatalf("Expected %v of %s, but got %v of %s.",
+			typ, key, ev.Type, ev.KV.Key)
+	}
+	return ev
+}
+
+// Fails the test if an event arrives on the watch within a short while.
+func (w *watchReader) expectNone() {
+	if len(w.pending) > 0 {
+		w.t.Fatalf("Expected no event, but got %v of %s.",
+			w.pending[0].Type, w.pending[0].KV.Key)
+	}
+	select {
+	case resp := <-w.ch:
+		w.t.Fatalf("Expected no event, but got %+v.", resp)
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+func testConditions(t *testing.T, factory Factory, p string) {
+	b := connect(t, factory)
+	defer b.Close()
+	ctx := context.Background()
+	key := p + "k"
+	cond := func(target gsr.CompareTarget, op string, val int64) []gsr.Condition {
+		return []gsr.Condition{{Key: key, Target: target, Op: op, Value: val}}
+	}
+
+	// A key that does not exist has a zero version
+	if _, err := b.Put(ctx, key, []byte("v0"), &gsr.PutOptions{
+		If: cond(gsr.CompareVersion, ">", 0),
+	}); err != gsr.ErrCompareFailed {
+		t.Fatalf("Expected ErrCompareFailed, but got %v.", err)
+	}
+	create := &gsr.PutOptions{If: cond(gsr.CompareVersion, "=", 0)}
+	rev1 := put(t, b, key, "v1", create)
+	if _, err := b.Put(ctx, key, []byte("v1"), create); err != gsr.ErrCompareFailed {
+		t.Fatalf("Expected ErrCompareFailed, but got %v.", err)
+	}
+
+	rev2 := put(t, b, key, "v2", &gsr.PutOptions{
+		If: cond(gsr.CompareModRevision, "=", rev1),
+	})
+	if rev2 <= rev1 {
+		t.Fatalf("Expected revision greater than %d, but got %d.", rev1, rev2)
+	}
+	kv := get(t, b, key)
+	if kv == nil || string(kv.Value) != "v2" || kv.Version != 2 ||
+		kv.CreateRevision != rev1 || kv.ModRevision != rev2 {
+		t.Fatalf("Expected v2 at version 2, created at %d and modified at "+
+			"%d, but got %+v.", rev1, rev2, kv)
+	}
+
+	// A stale revision fails and leaves the key alone
+	if _, err := b.Put(ctx, key, []byte("v3"), &gsr.PutOptions{
+		If: cond(gsr.CompareModRevision, "=", rev1),
+	}); err != gsr.ErrCompareFailed {
+		t.Fatalf("Expected ErrCompareFailed, but got %v.", err)
+	}
+	if kv = get(t, b, key); string(kv.Value) != "v2" {
+		t.Fatalf("Expected v2, but got %s.", kv.Value)
+	}
+	put(t, b, key, "v3", &gsr.PutOptions{
+		If: cond(gsr.CompareCreateRevision, "=", rev1),
+	})
+
+	// Leases can be compared too
+	lease, err := b.Grant(ctx, 60)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer b.Revoke(ctx, lease)
+	put(t, b, key, "v4", &gsr.PutOptions{Lease: lease})
+	if kv = get(t, b, key); kv.Lease != lease {
+		t.Fatalf("Expected lease %x, but got %x.", lease, kv.Lease)
+	}
+	if _, err = b.Delete(ctx, key, &gsr.DeleteOptions{
+		If: cond(gsr.CompareLease, "=", int64(gsr.NoLease)),
+	}); err != gsr.ErrCompareFailed {
+		t.Fatalf("Expected ErrCompareFailed, but got %v.", err)
+	}
+	put(t, b, key, "v5", &gsr.PutOptions{IgnoreLease: true})
+	if kv = get(t, b, key); kv.Lease != lease || string(kv.Value) != "v5" {
+		t.Fatalf("Expected v5 on lease %x, but got %+v.", lease, kv)
+	}
+	n, err := b.Delete(ctx, key, &gsr.DeleteOptions{
+		If: cond(gsr.CompareLease, "=", int64(lease)),
+	})
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if n != 1 {
+		t.Fatalf("Expected 1 key deleted, but got %d.", n)
+	}
+	if kv = get(t, b, key); kv != nil {
+		t.Fatalf("Expected nil, but got %+v.", kv)
+	}
+
+	// Once deleted, a key is created afresh
+	rev := put(t, b, key, "v6", create)
+	if kv = get(t, b, key); kv.Version != 1 || kv.CreateRevision != rev {
+		t.Fatalf("Expected version 1 created at %d, but got %+v.", rev, kv)
+	}
+}
+
+func testPrefixIsolation(t *testing.T, factory Factory, p string) {
+	b := connect(t, factory)
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, k := range []string{"a", "a/1", "a/2", "ab", "ab/1", "b/1"} {
+		put(t, b, p+k, k, nil)
+	}
+	if got := keys(t, b, p+"a/"); !sameKeys(got, []string{p + "a/1", p + "a/2"}) {
+		t.Fatalf("Expected only the keys beneath %sa/, but got %v.", p, got)
+	}
+	if kv := get(t, b, p+"a"); kv == nil || string(kv.Value) != "a" {
+		t.Fatalf("Expected %sa, but got %+v.", p, kv)
+	}
+	if kv := get(t, b, p+"a/"); kv != nil {
+		t.Fatalf("Expected nil, but got %+v.", kv)
+	}
+
+	w := &watchReader{
+		t:  t,
+		ch: b.Watch(ctx, p+"a/", &gsr.WatchOptions{Prefix: true}),
+	}
+	put(t, b, p+"a", "a", nil)
+	put(t, b, p+"ab/1", "ab/1", nil)
+	put(t, b, p+"b/1", "b/1", nil)
+	put(t, b, p+"a/3", "a/3", nil)
+	w.expect(gsr.KVPut, p+"a/3")
+
+	// A watch on a single key does not see the keys beneath it
+	one := &watchReader{t: t, ch: b.Watch(ctx, p+"a", nil)}
+	put(t, b, p+"a/4", "a/4", nil)
+	w.expect(gsr.KVPut, p+"a/4")
+	put(t, b, p+"a", "a", nil)
+	one.expect(gsr.KVPut, p+"a")
+
+	n, err := b.Delete(ctx, p+"a/", &gsr.DeleteOptions{Prefix: true})
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if n != 4 {
+		t.Fatalf("Expected 4 keys deleted, but got %d.", n)
+	}
+	expected := []string{p + "a", p + "ab", p + "ab/1", p + "b/1"}
+	if got := keys(t, b, p); !sameKeys(got, expected) {
+		t.Fatalf("Expected %v, but got %v.", expected, got)
+	}
+	one.expectNone()
+}
+
+func testLeaseExpiry(t *testing.T, factory Factory, p string) {
+	b := connect(t, factory)
+	defer b.Close()
+	other := connect(t, factory)
+	defer other.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	expiring, err := b.Grant(ctx, 1)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	kept, err := b.Grant(ctx, 1)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if _, err = b.KeepAlive(ctx, kept); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	put(t, b, p+"expiring", "", &gsr.PutOptions{Lease: expiring})
+	put(t, b, p+"kept", "", &gsr.PutOptions{Lease: kept})
+	rev := put(t, b, p+"plain", "", nil)
+
+	// The expiry is seen by other clients, as a delete on their watches
+	w := &watchReader{
+		t: t,
+		ch: other.Watch(ctx, p, &gsr.WatchOptions{
+			Prefix:   true,
+			Revision: rev + 1,
+		}),
+	}
+	eventually(t, expiryTimeout, func() error {
+		if kv := get(t, other, p+"expiring"); kv != nil {
+			return fmt.Errorf("%s is still attached to lease %x", kv.Key, kv.Lease)
+		}
+		return nil
+	})
+	w.expect(gsr.KVDelete, p+"expiring")
+	if _, _, err = b.TimeToLive(ctx, expiring); err != gsr.ErrLeaseNotFound {
+		t.Fatalf("Expected ErrLeaseNotFound, but got %v.", err)
+	}
+	// An expired lease cannot be kept alive. Backends may report this at once
+	// or by closing the keepalive channel.
+	ka, err := b.KeepAlive(ctx, expiring)
+	if err != nil && err != gsr.ErrLeaseNotFound {
+		t.Fatalf("Expected nil or ErrLeaseNotFound, but got %v.", err)
+	}
+	if err == nil {
+		eventually(t, waitTimeout, func() error {
+			select {
+			case _, ok := <-ka:
+				if ok {
+					return fmt.Errorf("lease %x was kept alive", expiring)
+				}
+				return nil
+			default:
+				return fmt.Errorf("lease %x is still being kept alive", expiring)
+			}
+		})
+	}
+
+	// Keys attached to a lease that is kept alive, or to no lease, stay
+	expected := []string{p + "kept", p + "plain"}
+	if got := keys(t, other, p); !sameKeys(got, expected) {
+		t.Fatalf("Expected %v, but got %v.", expected, got)
+	}
+	ttl, granted, err := b.TimeToLive(ctx, kept)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if ttl <= 0 || ttl > granted {
+		t.Fatalf("Expected a TTL between 1 and %d, but got %d.", granted, ttl)
+	}
+
+	// Revoking a lease deletes its keys at once
+	if err = b.Revoke(ctx, kept); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if kv := get(t, other, p+"kept"); kv != nil {
+		t.Fatalf("Expected nil, but got %+v.", kv)
+	}
+	w.expect(gsr.KVDelete, p+"kept")
+	if err = b.Revoke(ctx, kept); err != gsr.ErrLeaseNotFound {
+		t.Fatalf("Expected ErrLeaseNotFound, but got %v.", err)
+	}
+	if _, err = b.Put(ctx, p+"late", nil, &gsr.PutOptions{
+		Lease: kept,
+	}); err == nil {
+		t.Fatal("Expected error attaching a key to a revoked lease, but got nil.")
+	}
+}
+
+// Writes a key again without IgnoreLease and checks that, as with etcd, the
+// key leaves its lease for the lease of the write, if any.
+func testLeaseDetach(t *testing.T, factory Factory, p string) {
+	b := connect(t, factory)
+	defer b.Close()
+	ctx := context.Background()
+
+	first, err := b.Grant(ctx, 60)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	second, err := b.Grant(ctx, 60)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer b.Revoke(ctx, second)
+	for _, key := range []string{"detached", "moved", "kept"} {
+		put(t, b, p+key, "1", &gsr.PutOptions{Lease: first})
+	}
+	put(t, b, p+"detached", "2", nil)
+	put(t, b, p+"moved", "2", &gsr.PutOptions{Lease: second})
+	put(t, b, p+"kept", "2", &gsr.PutOptions{IgnoreLease: true})
+	expected := map[string]gsr.LeaseID{
+		"detached": gsr.NoLease,
+		"moved":    second,
+		"kept":     first,
+	}
+	for key, lease := range expected {
+		kv := get(t, b, p+key)
+		if kv == nil || kv.Lease != lease || string(kv.Value) != "2" {
+			t.Fatalf("Expected %s attached to lease %x, but got %+v.",
+				key, lease, kv)
+		}
+	}
+
+	// Revoking the first lease only deletes the key still attached to it
+	if err = b.Revoke(ctx, first); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if got := keys(t, b, p); !sameKeys(got, []string{p + "detached", p + "moved"}) {
+		t.Fatalf("Expected %s and %s, but got %v.", p+"detached", p+"moved", got)
+	}
+}
+
+func testWatchOrder(t *testing.T, factory Factory, p string) {
+	b := connect(t, factory)
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := &watchReader{
+		t:  t,
+		ch: b.Watch(ctx, p, &gsr.WatchOptions{Prefix: true}),
+	}
+	// Each key is only written once, so that backends that deliver the
+	// difference between successive reads of the store see every change
+	const n = 20
+	revs := make([]int64, n)
+	for x := 0; x < n; x++ {
+		revs[x] = put(t, b, fmt.Sprintf("%sk%02d", p, x), "", nil)
+		if x > 0 && revs[x] <= revs[x-1] {
+			t.Fatalf("Expected revision greater than %d, but got %d.",
+				revs[x-1], revs[x])
+		}
+	}
+	for x := 0; x < n; x++ {
+		ev := w.expect(gsr.KVPut, fmt.Sprintf("%sk%02d", p, x))
+		if ev.KV.ModRevision != revs[x] {
+			t.Fatalf("Expected revision %d, but got %d.",
+				revs[x], ev.KV.ModRevision)
+		}
+	}
+	if _, err := b.Delete(ctx, p, &gsr.DeleteOptions{Prefix: true}); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	for x := 0; x < n; x++ {
+		w.expect(gsr.KVDelete, fmt.Sprintf("%sk%02d", p, x))
+	}
+
+	// Cancelling the watch closes its channel
+	cancel()
+	timeout := time.After(waitTimeout)
+	for {
+		select {
+		case _, ok := <-w.ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("Timed out waiting for the watch to be closed.")
+		}
+	}
+}
+
+func testWatchAfterReconnect(t *testing.T, factory Factory, p string) {
+	writer := connect(t, factory)
+	defer writer.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b := connect(t, factory)
+	w := &watchReader{
+		t:  t,
+		ch: b.Watch(ctx, p, &gsr.WatchOptions{Prefix: true}),
+	}
+	put(t, writer, p+"k0", "", nil)
+	last := w.expect(gsr.KVPut, p+"k0").KV.ModRevision
+
+	// Closing the client ends its watches
+	b.Close()
+	timeout := time.After(waitTimeout)
+	for closed := false; !closed; {
+		select {
+		case _, ok := <-w.ch:
+			closed = !ok
+		case <-timeout:
+			t.Fatal("Timed out waiting for the watch to be closed.")
+		}
+	}
+
+	put(t, writer, p+"k1", "", nil)
+	put(t, writer, p+"k2", "", nil)
+	if _, err := writer.Delete(ctx, p+"k0", nil); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	// A watch resumed after the last revision seen either replays the
+	// changes missed while disconnected, in order, or reports that it cannot
+	b = connect(t, factory)
+	defer b.Close()
+	w = &watchReader{
+		t: t,
+		ch: b.Watch(ctx, p, &gsr.WatchOptions{
+			Prefix:   true,
+			Revision: last + 1,
+		}),
+	}
+	ev, err := w.next()
+	if err == nil {
+		if ev.Type != gsr.KVPut || ev.KV.Key != p+"k1" {
+			t.Fatalf("Expected %v of %s, but got %v of %s.",
+				gsr.KVPut, p+"k1", ev.Type, ev.KV.Key)
+		}
+		w.expect(gsr.KVPut, p+"k2")
+		w.expect(gsr.KVDelete, p+"k0")
+		put(t, writer, p+"k3", "", nil)
+		w.expect(gsr.KVPut, p+"k3")
+		return
+	}
+	if err != gsr.ErrCompacted {
+		t.Fatalf("Expected nil or ErrCompacted, but got %v.", err)
+	}
+	if _, ok := <-w.ch; ok {
+		t.Fatal("Expected the watch to be closed after ErrCompacted.")
+	}
+
+	// The client can then read the current state and watch from there
+	resp, err := b.Get(ctx, p, &gsr.GetOptions{Prefix: true})
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if len(resp.KVs) != 2 {
+		t.Fatalf("Expected %sk1 and %sk2, but got %v.", p, p, resp.KVs)
+	}
+	w = &watchReader{
+		t: t,
+		ch: b.Watch(ctx, p, &gsr.WatchOptions{
+			Prefix:   true,
+			Revision: resp.Revision + 1,
+		}),
+	}
+	put(t, writer, p+"k3", "", nil)
+	w.expect(gsr.KVPut, p+"k3")
+}
+
+// Creates a Registry storing its entries beneath the supplied key prefix in a
+// new client of the backend.
+func newRegistry(t *testing.T, factory Factory, p string) *gsr.Registry {
+	cfg := gsr.ConfigFromEnv()
+	cfg.EtcdKeyPrefix = p
+	cfg.Namespace = ""
+	r, err := gsr.NewWithConfigAndBackend(cfg, connect(t, factory))
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	return r
+}
+
+func addresses(eps []*gsr.Endpoint) map[string]*gsr.Endpoint {
+	res := make(map[string]*gsr.Endpoint, len(eps))
+	for _, ep := range eps {
+		res[ep.Address] = ep
+	}
+	return res
+}
+
+func testRegisterUnregisterRaces(t *testing.T, factory Factory, p string) {
+	const n = 5
+	service := "race"
+	regs := make([]*gsr.Registry, n)
+	for x := range regs {
+		regs[x] = newRegistry(t, factory, p)
+		defer regs[x].Close()
+	}
+
+	// Concurrent registrations of different endpoints all succeed, and every
+	// registry sees all of them
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for x := range regs {
+		wg.Add(1)
+		go func(x int) {
+			defer wg.Done()
+			errs[x] = regs[x].Register(&gsr.Endpoint{
+				Service: &gsr.Service{Name: service},
+				Address: fmt.Sprintf("10.0.0.%d:80", x+1),
+			})
+		}(x)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatalf("Expected nil, but got %v.", err)
+		}
+	}
+	for _, r := range regs {
+		if eps := r.Endpoints(service); len(eps) != n {
+			t.Fatalf("Expected %d endpoints, but got %d.", n, len(eps))
+		}
+		r := r
+		eventually(t, waitTimeout, func() error {
+			if eps := r.Query(service, nil); len(eps) != n {
+				return fmt.Errorf("%d endpoints cached, expected %d", len(eps), n)
+			}
+			return nil
+		})
+	}
+
+	// When every registry claims the same endpoint at once, exactly one of
+	// them gets it
+	addr := "10.0.1.1:80"
+	eps := make([]*gsr.Endpoint, n)
+	claim := func(x int) error {
+		eps[x] = &gsr.Endpoint{
+			Service: &gsr.Service{Name: service},
+			Address: addr,
+		}
+		return regs[x].Register(eps[x])
+	}
+	for x := range regs {
+		wg.Add(1)
+		go func(x int) {
+			defer wg.Done()
+			errs[x] = claim(x)
+		}(x)
+	}
+	wg.Wait()
+	winner := -1
+	for x, err := range errs {
+		switch err {
+		case nil:
+			if winner != -1 {
+				t.Fatalf("Expected one registry to claim %s, but %d and %d did.",
+					addr, winner, x)
+			}
+			winner = x
+		case gsr.ErrConflict, gsr.ErrEndpointOwned:
+		default:
+			t.Fatalf("Expected nil, ErrConflict or ErrEndpointOwned, but got %v.",
+				err)
+		}
+	}
+	if winner == -1 {
+		t.Fatalf("Expected one registry to claim %s, but none did.", addr)
+	}
+	owned := func(x int) error {
+		ep := addresses(regs[0].Endpoints(service))[addr]
+		if ep == nil {
+			return fmt.Errorf("%s is not registered", addr)
+		}
+		if ep.Owner == nil || ep.Owner.InstanceID != regs[x].InstanceID() {
+			return fmt.Errorf("%s is owned by %v, expected %s",
+				addr, ep.Owner, regs[x].InstanceID())
+		}
+		return nil
+	}
+	if err := owned(winner); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the owner can unregister it. The others race to claim it as soon
+	// as it is unregistered, and again exactly one of them gets it.
+	loser := (winner + 1) % n
+	if err := regs[loser].Unregister(eps[loser]); err != gsr.ErrNotOwner {
+		t.Fatalf("Expected ErrNotOwner, but got %v.", err)
+	}
+	var mu sync.Mutex
+	next := -1
+	for x := range regs {
+		if x == winner {
+			continue
+		}
+		errs[x] = nil
+		wg.Add(1)
+		go func(x int) {
+			defer wg.Done()
+			deadline := time.Now().Add(waitTimeout)
+			for time.Now().Before(deadline) {
+				mu.Lock()
+				done := next != -1
+				mu.Unlock()
+				if done {
+					return
+				}
+				err := claim(x)
+				if err == nil {
+					mu.Lock()
+					if next != -1 {
+						errs[x] = fmt.Errorf("registries %d and %d both "+
+							"claimed %s", next, x, addr)
+					}
+					next = x
+					mu.Unlock()
+					return
+				}
+				if err != gsr.ErrConflict && err != gsr.ErrEndpointOwned {
+					errs[x] = err
+					return
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}(x)
+	}
+	if err := regs[winner].Unregister(eps[winner]); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if next == -1 {
+		t.Fatalf("Expected a registry to claim %s once it was unregistered, "+
+			"but none did.", addr)
+	}
+	if err := owned(next); err != nil {
+		t.Fatal(err)
+	}
+
+	// Unregistering twice is not an error
+	if err := regs[next].Unregister(eps[next]); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if err := regs[next].Unregister(eps[next]); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	for _, r := range regs {
+		r := r
+		eventually(t, waitTimeout, func() error {
+			if ep := addresses(r.Query(service, nil))[addr]; ep != nil {
+				return fmt.Errorf("%s is still cached", addr)
+			}
+			return nil
+		})
+	}
+}
+
+func testManyEndpoints(t *testing.T, factory Factory, p string) {
+	n := 500
+	if testing.Short() {
+		n = 50
+	}
+	const workers = 10
+	service := "many"
+	r := newRegistry(t, factory, p)
+	defer r.Close()
+	watcher := newRegistry(t, factory, p)
+	defer watcher.Close()
+
+	eps := make([]*gsr.Endpoint, n)
+	for x := range eps {
+		eps[x] = &gsr.Endpoint{
+			Service: &gsr.Service{Name: service},
+			Address: fmt.Sprintf("10.1.%d.%d:80", x/250, x%250+1),
+		}
+	}
+	// Runs f on every endpoint, spread over several goroutines
+	each := func(f func(ep *gsr.Endpoint) error) {
+		var wg sync.WaitGroup
+		errs := make([]error, workers)
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				for x := w; x < n; x += workers {
+					if errs[w] = f(eps[x]); errs[w] != nil {
+						return
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				t.Fatalf("Expected nil, but got %v.", err)
+			}
+		}
+	}
+
+	each(r.Register)
+	if got := watcher.Endpoints(service); len(got) != n {
+		t.Fatalf("Expected %d endpoints, but got %d.", n, len(got))
+	}
+	if got := addresses(watcher.AllEndpoints()[service]); len(got) != n {
+		t.Fatalf("Expected %d distinct endpoints, but got %d.", n, len(got))
+	}
+	eventually(t, waitTimeout, func() error {
+		if got := watcher.Query(service, nil); len(got) != n {
+			return fmt.Errorf("%d endpoints cached, expected %d", len(got), n)
+		}
+		return nil
+	})
+
+	each(r.Unregister)
+	if got := watcher.Endpoints(service); len(got) != 0 {
+		t.Fatalf("Expected no endpoints, but got %d.", len(got))
+	}
+	eventually(t, waitTimeout, func() error {
+		if got := watcher.Query(service, nil); len(got) != 0 {
+			return fmt.Errorf("%d endpoints still cached", len(got))
+		}
+		return nil
+	})
+}
@@ -0,0 +1,210 @@
+package gsrtest
+
+// Etcd runs a single-node etcd server inside the test process, so that tests
+// of code using gsr do not need an etcd cluster to be set up beforehand:
+//
+//	func TestFailover(t *testing.T) {
+//	    e := gsrtest.StartEtcd(t)
+//	    defer e.Close()
+//	    r := e.NewRegistry()
+//	    ...
+//	    e.Stop()    // the registry loses its connection
+//	    e.Restart() // and gets it back
+//	}
+//
+// The server listens on random local ports and keeps its data in a temporary
+// directory that is removed when it is closed.
+
+import (
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jaypipes/gsr"
+	etcd "go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/embed"
+	"go.etcd.io/etcd/etcdserver/api/v3rpc/rpctypes"
+	"golang.org/x/net/context"
+)
+
+// How long the embedded server is given to start.
+const etcdStartTimeout = 30 * time.Second
+
+// Etcd is a single-node etcd server embedded in the test process.
+type Etcd struct {
+	t   *testing.T
+	cfg *embed.Config
+	// client is used to manipulate the server's leases
+	client *etcd.Client
+	// mu protects server, which is nil while the server is stopped, and
+	// registries, which holds the Registry objects to close with the server
+	mu         sync.Mutex
+	server     *embed.Etcd
+	registries []*gsr.Registry
+}
+
+// Returns a URL on a local port that is free at the time of the call.
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+// StartEtcd starts an etcd server on random local ports, with its data in a
+// new temporary directory. The server must be closed with Close().
+func StartEtcd(t *testing.T) *Etcd {
+	dir, err := ioutil.TempDir("", "gsrtest-etcd")
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	cfg := embed.NewConfig()
+	cfg.Name = "gsrtest"
+	cfg.Dir = dir
+	client, peer := freeURL(t), freeURL(t)
+	cfg.LCUrls, cfg.ACUrls = []url.URL{client}, []url.URL{client}
+	cfg.LPUrls, cfg.APUrls = []url.URL{peer}, []url.URL{peer}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	// Elect the single member quickly. etcd derives its minimum lease TTL
+	// from the election timeout, so this also keeps short leases short.
+	cfg.TickMs = 50
+	cfg.ElectionMs = 500
+
+	e := &Etcd{t: t, cfg: cfg}
+	e.start()
+	e.client, err = etcd.New(etcd.Config{
+		Endpoints:   e.Endpoints(),
+		DialTimeout: etcdStartTimeout,
+	})
+	if err != nil {
+		e.Close()
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	return e
+}
+
+// Starts the server and waits for it to be ready.
+func (e *Etcd) start() {
+	server, err := embed.StartEtcd(e.cfg)
+	if err != nil {
+		e.t.Fatalf("Expected nil, but got %v.", err)
+	}
+	select {
+	case <-server.Server.ReadyNotify():
+	case err = <-server.Err():
+		server.Close()
+		e.t.Fatalf("Expected nil, but got %v.", err)
+	case <-time.After(etcdStartTimeout):
+		server.Close()
+		e.t.Fatal("Timed out waiting for etcd to start.")
+	}
+	e.mu.Lock()
+	e.server = server
+	e.mu.Unlock()
+}
+
+// Endpoints returns the client URLs of the server.
+func (e *Etcd) Endpoints() []string {
+	res := make([]string, len(e.cfg.ACUrls))
+	for x, u := range e.cfg.ACUrls {
+		res[x] = u.String()
+	}
+	return res
+}
+
+// NewRegistry returns a Registry connected to the server. Other settings are
+// read from the GSR_* environment variables, as with gsr.New(). The Registry
+// is closed when the server is.
+func (e *Etcd) NewRegistry() *gsr.Registry {
+	return e.NewRegistryWithConfig(gsr.ConfigFromEnv())
+}
+
+// NewRegistryWithConfig returns a Registry connected to the server, configured
+// with the supplied Config. The Backend and EtcdEndpoints settings of the
+// Config are ignored. The Registry is closed when the server is.
+func (e *Etcd) NewRegistryWithConfig(cfg *gsr.Config) *gsr.Registry {
+	c := *cfg
+	c.Backend = "etcd"
+	c.EtcdEndpoints = e.Endpoints()
+	r, err := gsr.NewWithConfig(&c)
+	if err != nil {
+		e.t.Fatalf("Expected nil, but got %v.", err)
+	}
+	e.mu.Lock()
+	e.registries = append(e.registries, r)
+	e.mu.Unlock()
+	return r
+}
+
+// ExpireLease ends a lease as if it had not been kept alive, deleting the
+// keys attached to it. The lease of an endpoint is found in its Owner.
+func (e *Etcd) ExpireLease(lease gsr.LeaseID) {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdStartTimeout)
+	defer cancel()
+	_, err := e.client.Revoke(ctx, etcd.LeaseID(lease))
+	if err != nil && err != rpctypes.ErrLeaseNotFound {
+		e.t.Fatalf("Expected nil, but got %v.", err)
+	}
+}
+
+// ExpireLeases ends every lease granted by the server, as if none of them had
+// been kept alive.
+func (e *Etcd) ExpireLeases() {
+	ctx, cancel := context.WithTimeout(context.Background(), etcdStartTimeout)
+	defer cancel()
+	resp, err := e.client.Leases(ctx)
+	if err != nil {
+		e.t.Fatalf("Expected nil, but got %v.", err)
+	}
+	for _, l := range resp.Leases {
+		e.ExpireLease(gsr.LeaseID(l.ID))
+	}
+}
+
+// Stop kills the server. Clients keep trying to reconnect until the server is
+// restarted with Restart().
+func (e *Etcd) Stop() {
+	e.mu.Lock()
+	server := e.server
+	e.server = nil
+	e.mu.Unlock()
+	if server != nil {
+		server.Close()
+	}
+}
+
+// Restart starts the server again after Stop(), on the same ports and with
+// the same data, so that clients reconnect to it. Leases granted before the
+// server was stopped are restored with their full TTL.
+func (e *Etcd) Restart() {
+	e.mu.Lock()
+	running := e.server != nil
+	e.mu.Unlock()
+	if running {
+		e.t.Fatal("Expected the etcd server to be stopped, but it is running.")
+	}
+	e.start()
+}
+
+// Close closes every Registry returned by NewRegistry(), stops the server and
+// removes its data.
+func (e *Etcd) Close() {
+	e.mu.Lock()
+	registries := e.registries
+	e.registries = nil
+	e.mu.Unlock()
+	for _, r := range registries {
+		r.Close()
+	}
+	if e.client != nil {
+		e.client.Close()
+	}
+	e.Stop()
+	os.RemoveAll(e.cfg.Dir)
+}
@@ -0,0 +1,375 @@
+package gsrtest
+
+// FaultBackend wraps a gsr.Backend and injects faults into the operations
+// made through it, so that the way code copes with a misbehaving registry can
+// be tested deterministically:
+//
+//	f := gsrtest.NewFaultBackend(backend)
+//	r, err := gsr.NewWithBackend(f)
+//	...
+//	// The first write fails, the second is slow, the rest go through
+//	f.Script(gsrtest.OpPut, gsrtest.Fault{Err: gsr.ErrCompareFailed},
+//	    gsrtest.Fault{Latency: time.Second})
+//	// One read in ten fails
+//	f.SetErrorRate(gsrtest.OpGet, 0.1, nil)
+//	// Every watch made through the backend is dropped
+//	f.DropWatches()
+//
+// Errors are injected in place of the wrapped operation: an operation that
+// fails is not made at all.
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/jaypipes/gsr"
+	"golang.org/x/net/context"
+)
+
+// ErrInjected is the error returned by operations failed by an error rate set
+// without an error of its own.
+var ErrInjected = errors.New("gsrtest: injected fault")
+
+// Op is a gsr.Backend operation into which faults are injected.
+type Op string
+
+const (
+	OpGet        Op = "Get"
+	OpPut        Op = "Put"
+	OpDelete     Op = "Delete"
+	OpGrant      Op = "Grant"
+	OpKeepAlive  Op = "KeepAlive"
+	OpRevoke     Op = "Revoke"
+	OpTimeToLive Op = "TimeToLive"
+	OpWatch      Op = "Watch"
+)
+
+// Fault is what happens to a single call of an operation: it is delayed by
+// Latency, then fails with Err. The zero Fault lets the call through
+// untouched.
+type Fault struct {
+	Latency time.Duration
+	Err     error
+}
+
+// The faults set for a single operation.
+type opFaults struct {
+	latency time.Duration
+	rate    float64
+	err     error
+	// script holds the faults of the next calls, in order
+	script []Fault
+	calls  int
+}
+
+// A watch made through a FaultBackend. fail receives the error to end the
+// watch with, or nil to close it without one.
+type faultWatch struct {
+	fail chan error
+}
+
+// FaultBackend is a gsr.Backend that passes operations on to another Backend,
+// injecting the faults it has been programmed with. It is safe for
+// concurrent use.
+type FaultBackend struct {
+	backend gsr.Backend
+	// mu protects everything below
+	mu      sync.Mutex
+	rand    *rand.Rand
+	ops     map[Op]*opFaults
+	watches map[*faultWatch]bool
+	// leases holds the leases granted through the FaultBackend and not yet
+	// revoked through it
+	leases map[gsr.LeaseID]bool
+}
+
+// NewFaultBackend returns a FaultBackend wrapping the supplied Backend, with
+// no faults set. Closing the FaultBackend closes the wrapped Backend.
+func NewFaultBackend(b gsr.Backend) *FaultBackend {
+	return &FaultBackend{
+		backend: b,
+		rand:    rand.New(rand.NewSource(1)),
+		ops:     make(map[Op]*opFaults, 0),
+		watches: make(map[*faultWatch]bool, 0),
+		leases:  make(map[gsr.LeaseID]bool, 0),
+	}
+}
+
+// Returns the faults of an operation. The caller must hold the lock.
+func (f *FaultBackend) faults(op Op) *opFaults {
+	o, ok := f.ops[op]
+	if !ok {
+		o = &opFaults{}
+		f.ops[op] = o
+	}
+	return o
+}
+
+// SetLatency delays every call of an operation by the supplied duration.
+// Calls whose context is done before the delay is over fail with the
+// context's error.
+func (f *FaultBackend) SetLatency(op Op, d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults(op).latency = d
+}
+
+// SetErrorRate fails the supplied fraction of the calls of an operation, from
+// 0 (none) to 1 (all), with the supplied error, or ErrInjected if it is nil.
+// Which calls fail is decided by a random source seeded with Seed(), so a
+// test making the same calls in the same order sees the same failures.
+func (f *FaultBackend) SetErrorRate(op Op, rate float64, err error) {
+	if err == nil {
+		err = ErrInjected
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o := f.faults(op)
+	o.rate = rate
+	o.err = err
+}
+
+// Seed seeds the random source that decides which calls fail with
+// SetErrorRate(). The source is seeded with 1 when the FaultBackend is
+// created.
+func (f *FaultBackend) Seed(seed int64) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rand = rand.New(rand.NewSource(seed))
+}
+
+// Script queues faults for the next calls of an operation, one fault per
+// call, after any faults already queued. While faults are queued, the
+// latency and error rate of the operation are ignored.
+func (f *FaultBackend) Script(op Op, faults ...Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o := f.faults(op)
+	o.script = append(o.script, faults...)
+}
+
+// Calls returns the number of calls made to an operation, including the ones
+// that failed.
+func (f *FaultBackend) Calls(op Op) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.faults(op).calls
+}
+
+// Reset removes every fault set, including queued ones, and the call counts.
+func (f *FaultBackend) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ops = make(map[Op]*opFaults, 0)
+}
+
+// Counts a call of an operation and applies the fault due for it, returning
+// the error the call fails with, if any.
+func (f *FaultBackend) inject(ctx context.Context, op Op) error {
+	f.mu.Lock()
+	o := f.faults(op)
+	o.calls++
+	fault := Fault{Latency: o.latency}
+	if len(o.script) > 0 {
+		fault = o.script[0]
+		o.script = o.script[1:]
+	} else if o.rate > 0 && f.rand.Float64() < o.rate {
+		fault.Err = o.err
+	}
+	f.mu.Unlock()
+
+	if fault.Latency > 0 {
+		select {
+		case <-time.After(fault.Latency):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return fault.Err
+}
+
+func (f *FaultBackend) Get(
+	ctx context.Context,
+	key string,
+	opts *gsr.GetOptions,
+) (*gsr.GetResponse, error) {
+	if err := f.inject(ctx, OpGet); err != nil {
+		return nil, err
+	}
+	return f.backend.Get(ctx, key, opts)
+}
+
+func (f *FaultBackend) Put(
+	ctx context.Context,
+	key string,
+	val []byte,
+	opts *gsr.PutOptions,
+) (int64, error) {
+	if err := f.inject(ctx, OpPut); err != nil {
+		return 0, err
+	}
+	return f.backend.Put(ctx, key, val, opts)
+}
+
+func (f *FaultBackend) Delete(
+	ctx context.Context,
+	key string,
+	opts *gsr.DeleteOptions,
+) (int64, error) {
+	if err := f.inject(ctx, OpDelete); err != nil {
+		return 0, err
+	}
+	return f.backend.Delete(ctx, key, opts)
+}
+
+func (f *FaultBackend) Grant(ctx context.Context, ttl int64) (gsr.LeaseID, error) {
+	if err := f.inject(ctx, OpGrant); err != nil {
+		return gsr.NoLease, err
+	}
+	lease, err := f.backend.Grant(ctx, ttl)
+	if err != nil {
+		return gsr.NoLease, err
+	}
+	f.mu.Lock()
+	f.leases[lease] = true
+	f.mu.Unlock()
+	return lease, nil
+}
+
+func (f *FaultBackend) KeepAlive(
+	ctx context.Context,
+	lease gsr.LeaseID,
+) (<-chan struct{}, error) {
+	if err := f.inject(ctx, OpKeepAlive); err != nil {
+		return nil, err
+	}
+	return f.backend.KeepAlive(ctx, lease)
+}
+
+func (f *FaultBackend) Revoke(ctx context.Context, lease gsr.LeaseID) error {
+	if err := f.inject(ctx, OpRevoke); err != nil {
+		return err
+	}
+	err := f.backend.Revoke(ctx, lease)
+	f.mu.Lock()
+	delete(f.leases, lease)
+	f.mu.Unlock()
+	return err
+}
+
+func (f *FaultBackend) TimeToLive(
+	ctx context.Context,
+	lease gsr.LeaseID,
+) (int64, int64, error) {
+	if err := f.inject(ctx, OpTimeToLive); err != nil {
+		return 0, 0, err
+	}
+	return f.backend.TimeToLive(ctx, lease)
+}
+
+// Watch fails a watch by delivering the injected error on it and closing it,
+// as a backend does with a watch that fails after it was made.
+func (f *FaultBackend) Watch(
+	ctx context.Context,
+	key string,
+	opts *gsr.WatchOptions,
+) <-chan *gsr.WatchResponse {
+	ch := make(chan *gsr.WatchResponse)
+	if err := f.inject(ctx, OpWatch); err != nil {
+		go func() {
+			defer close(ch)
+			select {
+			case ch <- &gsr.WatchResponse{Err: err}:
+			case <-ctx.Done():
+			}
+		}()
+		return ch
+	}
+
+	w := &faultWatch{fail: make(chan error, 1)}
+	f.mu.Lock()
+	f.watches[w] = true
+	f.mu.Unlock()
+	wctx, cancel := context.WithCancel(ctx)
+	wch := f.backend.Watch(wctx, key, opts)
+	go func() {
+		defer func() {
+			cancel()
+			f.mu.Lock()
+			delete(f.watches, w)
+			f.mu.Unlock()
+			close(ch)
+		}()
+		for {
+			var resp *gsr.WatchResponse
+			var ok bool
+			select {
+			case resp, ok = <-wch:
+				if !ok {
+					return
+				}
+			case err := <-w.fail:
+				if err == nil {
+					return
+				}
+				resp = &gsr.WatchResponse{Err: err}
+			}
+			select {
+			case ch <- resp:
+			case <-ctx.Done():
+				return
+			}
+			if resp.Err != nil {
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// FailWatches ends every watch currently made through the FaultBackend by
+// delivering the supplied error on it, e.g. gsr.ErrCompacted, and closing it.
+// If the error is nil, the watches are closed without an error, as happens
+// when a connection to etcd is lost.
+func (f *FaultBackend) FailWatches(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for w := range f.watches {
+		select {
+		case w.fail <- err:
+		default:
+		}
+	}
+}
+
+// DropWatches closes every watch currently made through the FaultBackend
+// without an error.
+func (f *FaultBackend) DropWatches() {
+	f.FailWatches(nil)
+}
+
+// RevokeLeases revokes every lease granted through the FaultBackend, as if
+// none of them had been kept alive, deleting the keys attached to them. The
+// revocations are made on the wrapped Backend, so they are not subject to
+// faults.
+func (f *FaultBackend) RevokeLeases() error {
+	f.mu.Lock()
+	leases := f.leases
+	f.leases = make(map[gsr.LeaseID]bool, 0)
+	f.mu.Unlock()
+	for lease := range leases {
+		ctx, cancel := context.WithTimeout(context.Background(), waitTimeout)
+		err := f.backend.Revoke(ctx, lease)
+		cancel()
+		if err != nil && err != gsr.ErrLeaseNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *FaultBackend) Close() error {
+	return f.backend.Close()
+}
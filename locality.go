@@ -0,0 +1,139 @@
+package gsr
+
+// Endpoints record where they run in their region, zone and subzone labels.
+// A Registry configured with its own locality prefers endpoints that are close
+// to it, ranking them into tiers:
+//
+// 0) same region, zone and subzone
+// 1) same region and zone
+// 2) same region
+// 3) anywhere else
+//
+// Endpoints from a further tier are only used when the endpoints from the
+// closer tiers number fewer than the LocalityMinEndpoints setting.
+
+import (
+	"errors"
+)
+
+const (
+	LabelRegion  = "region"
+	LabelZone    = "zone"
+	LabelSubzone = "subzone"
+)
+
+const numLocalityTiers = 4
+
+var (
+	ErrNoEndpoints = errors.New("no endpoints available")
+)
+
+// Locality describes where a Registry or an endpoint runs.
+type Locality struct {
+	Region  string
+	Zone    string
+	Subzone string
+}
+
+// Returns the locality the Registry was configured with.
+func (r *Registry) Locality() Locality {
+	return Locality{
+		Region:  r.config.Region,
+		Zone:    r.config.Zone,
+		Subzone: r.config.Subzone,
+	}
+}
+
+// Returns the locality recorded in the endpoint's labels.
+func (ep *Endpoint) Locality() Locality {
+	return Locality{
+		Region:  ep.Labels[LabelRegion],
+		Zone:    ep.Labels[LabelZone],
+		Subzone: ep.Labels[LabelSubzone],
+	}
+}
+
+// Returns the preference tier, from 0 (closest) to 3, of an endpoint at the
+// supplied locality when seen from this locality.
+func (l Locality) tier(other Locality) int {
+	if l.Region == "" || l.Region != other.Region {
+		return 3
+	}
+	if l.Zone == "" || l.Zone != other.Zone {
+		return 2
+	}
+	if l.Subzone == "" || l.Subzone != other.Subzone {
+		return 1
+	}
+	return 0
+}
+
+// Records the Registry's locality in the labels of an endpoint about to be
+// registered, unless the endpoint already has locality labels of its own.
+func (r *Registry) setLocalityLabels(ep *Endpoint) {
+	loc := r.Locality()
+	if loc.Region == "" {
+		return
+	}
+	if ep.Labels == nil {
+		ep.Labels = make(map[string]string, 3)
+	}
+	if _, found := ep.Labels[LabelRegion]; found {
+		return
+	}
+	ep.Labels[LabelRegion] = loc.Region
+	if loc.Zone != "" {
+		ep.Labels[LabelZone] = loc.Zone
+	}
+	if loc.Subzone != "" {
+		ep.Labels[LabelSubzone] = loc.Subzone
+	}
+}
+
+// NearestEndpoints returns the endpoints of a service matching the supplied
+// selector, closest first. Endpoints further away than needed to reach the
+// LocalityMinEndpoints setting are not included. Draining endpoints are never
+// included. Like Query(), NearestEndpoints is answered from the Registry's
+// local cache.
+func (r *Registry) NearestEndpoints(service string, sel Selector) []*Endpoint {
+	return nearest(
+		r.Query(service, sel),
+		r.Locality(),
+		r.config.LocalityMinEndpoints,
+	)
+}
+
+// Pick returns one of the endpoints of a service matching the supplied
+// selector, balancing requests in round-robin fashion across the endpoints
+// returned by NearestEndpoints(). ErrNoEndpoints is returned if no endpoint
+// is available.
+func (r *Registry) Pick(service string, sel Selector) (*Endpoint, error) {
+	eps := r.NearestEndpoints(service, sel)
+	if len(eps) == 0 {
+		return nil, ErrNoEndpoints
+	}
+	r.mu.Lock()
+	n := r.next[service]
+	r.next[service] = n + 1
+	r.mu.Unlock()
+	return eps[n%uint64(len(eps))], nil
+}
+
+// Returns the closest endpoints to the supplied locality, adding endpoints
+// from each further tier until at least min endpoints have been found. Within
+// a tier, endpoints keep the order they were supplied in.
+func nearest(eps []*Endpoint, loc Locality, min int) []*Endpoint {
+	tiers := make([][]*Endpoint, numLocalityTiers)
+	for _, ep := range eps {
+		t := loc.tier(ep.Locality())
+		tiers[t] = append(tiers[t], ep)
+	}
+	res := make([]*Endpoint, 0, len(eps))
+	for _, tier := range tiers {
+		if len(res) >= min && len(res) > 0 {
+			break
+		}
+		res = append(res, tier...)
+	}
+	return res
+}
@@ -0,0 +1,53 @@
+package gsr
+
+import (
+	"testing"
+)
+
+func TestNearest(t *testing.T) {
+	ep := func(addr string, region string, zone string) *Endpoint {
+		return &Endpoint{
+			Service: &Service{Name: "web"},
+			Address: addr,
+			Labels: map[string]string{
+				LabelRegion: region,
+				LabelZone:   zone,
+			},
+		}
+	}
+	eps := []*Endpoint{
+		ep("10.0.0.1", "us", "us-west"),
+		ep("10.0.0.2", "us", "us-east"),
+		ep("10.0.0.3", "eu", "eu-west"),
+		ep("10.0.0.4", "us", "us-east"),
+	}
+	loc := Locality{Region: "us", Zone: "us-east"}
+
+	tests := []struct {
+		min  int
+		want []string
+	}{
+		{1, []string{"10.0.0.2", "10.0.0.4"}},
+		{2, []string{"10.0.0.2", "10.0.0.4"}},
+		{3, []string{"10.0.0.2", "10.0.0.4", "10.0.0.1"}},
+		{4, []string{"10.0.0.2", "10.0.0.4", "10.0.0.1", "10.0.0.3"}},
+	}
+	for _, test := range tests {
+		got := nearest(eps, loc, test.min)
+		if len(got) != len(test.want) {
+			t.Fatalf("Expected %v with min %d, but got %v.",
+				test.want, test.min, got)
+		}
+		for x, addr := range test.want {
+			if got[x].Address != addr {
+				t.Fatalf("Expected %v with min %d, but got %v.",
+					test.want, test.min, got)
+			}
+		}
+	}
+
+	// Without a locality of its own, a Registry has no preference
+	if got := nearest(eps, Locality{}, 1); len(got) != len(eps) {
+		t.Fatalf("Expected all of %v, but got %v.", eps, got)
+	}
+}
@@ -0,0 +1,193 @@
+package gsr
+
+// Locks provide short-lived mutual exclusion between processes, e.g. so that
+// only one process runs schema migrations during a deploy. A lock is held
+// using the Registry's session lease, so a process that crashes while holding
+// a lock releases it when the lease expires. Within the etcd3 key namespace,
+// locks are stored as:
+//
+// $KEY_PREFIX (and namespace, if any)
+// |
+// -> /locks
+//    |
+//    ->> /$NAME
+//        |
+//        -> /$LEASE_ID  <-- one key per waiter. the oldest holds the lock.
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	etcd "go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/clientv3/concurrency"
+	"golang.org/x/net/context"
+)
+
+var (
+	ErrInvalidLockName = errors.New("lock name must be non-empty and not contain '/'")
+	ErrLocked          = errors.New("lock is held by another process")
+	ErrLockHeld        = errors.New("lock is already held by this registry")
+)
+
+// UnlockFunc releases a lock acquired with Lock() or TryLock().
+type UnlockFunc func() error
+
+// Returns the etcd key prefix under which waiters for a lock are stored.
+func (r *Registry) lockKey(name string) string {
+	return r.namespaceKey() + "locks/" + name
+}
+
+func validateLockName(name string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return ErrInvalidLockName
+	}
+	return nil
+}
+
+// Lock blocks until the named lock is acquired or the supplied context is
+// done. On success, it returns a function that releases the lock and a
+// fencing token. Fencing tokens increase each time the lock changes hands, so
+// resources protected by the lock can reject writes that carry a token lower
+// than one they have already seen, e.g. from a holder whose lease expired
+// while it was paused.
+//
+// Locks are not re-entrant: ErrLockHeld is returned if the Registry already
+// holds the named lock. Locks need the etcd backend: ErrNotSupported is
+// returned with any other backend.
+func (r *Registry) Lock(
+	ctx context.Context,
+	name string,
+) (UnlockFunc, int64, error) {
+	if err := validateLockName(name); err != nil {
+		return nil, 0, err
+	}
+	cs, err := r.concurrencySession()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = r.holdLock(name); err != nil {
+		return nil, 0, err
+	}
+
+	m := concurrency.NewMutex(cs, r.lockKey(name))
+	r.L2("waiting for lock %s", name)
+	if err = m.Lock(ctx); err != nil {
+		r.releaseLock(name)
+		r.L2("failed to acquire lock %s: %v", name, err)
+		return nil, 0, err
+	}
+
+	// The fencing token is the revision at which our waiter key was created
+	b := r.backend
+	gctx, cancel := r.requestCtx()
+	resp, err := b.Get(gctx, m.Key(), nil)
+	cancel()
+	if err == nil && len(resp.KVs) == 0 {
+		err = ErrLocked
+	}
+	if err != nil {
+		r.LERR("failed to read lock %s: %v", name, err)
+		r.unlocker(name, m.Key())()
+		return nil, 0, err
+	}
+	token := resp.KVs[0].CreateRevision
+	r.L1("acquired lock %s with token %d", name, token)
+	return r.unlocker(name, m.Key()), token, nil
+}
+
+// TryLock is like Lock but returns ErrLocked immediately, rather than
+// waiting, if the named lock is held by another process. As with Lock,
+// ErrNotSupported is returned unless the Registry uses the etcd backend.
+func (r *Registry) TryLock(
+	ctx context.Context,
+	name string,
+) (UnlockFunc, int64, error) {
+	if err := validateLockName(name); err != nil {
+		return nil, 0, err
+	}
+	cs, err := r.concurrencySession()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err = r.holdLock(name); err != nil {
+		return nil, 0, err
+	}
+
+	// Use the same waiter key as concurrency.Mutex so that Lock() and
+	// TryLock() callers exclude each other
+	pfx := r.lockKey(name) + "/"
+	key := fmt.Sprintf("%s%x", pfx, cs.Lease())
+	holder := etcd.OpGet(pfx, etcd.WithFirstCreate()...)
+
+	c, err := r.etcdClient()
+	if err != nil {
+		r.releaseLock(name)
+		return nil, 0, err
+	}
+	resp, err := c.Txn(ctx).If(
+		etcd.Compare(etcd.CreateRevision(key), "=", 0),
+	).Then(
+		etcd.OpPut(key, "", etcd.WithLease(cs.Lease())),
+		holder,
+	).Else(
+		holder,
+	).Commit()
+	if err != nil {
+		r.releaseLock(name)
+		r.LERR("failed to create txn in etcd: %v", err)
+		return nil, 0, err
+	}
+	if !resp.Succeeded {
+		// Our waiter key already exists, so the lock belongs to whoever
+		// created it
+		r.releaseLock(name)
+		return nil, 0, ErrLocked
+	}
+	token := resp.Header.Revision
+	kvs := resp.Responses[1].GetResponseRange().Kvs
+	if len(kvs) == 0 || kvs[0].CreateRevision != token {
+		r.unlocker(name, key)()
+		r.L2("lock %s is held by another process", name)
+		return nil, 0, ErrLocked
+	}
+	r.L1("acquired lock %s with token %d", name, token)
+	return r.unlocker(name, key), token, nil
+}
+
+// Records that the Registry holds, or is waiting for, the named lock.
+func (r *Registry) holdLock(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.locks[name] {
+		return ErrLockHeld
+	}
+	r.locks[name] = true
+	return nil
+}
+
+func (r *Registry) releaseLock(name string) {
+	r.mu.Lock()
+	delete(r.locks, name)
+	r.mu.Unlock()
+}
+
+// Returns a function that deletes the supplied waiter key of the named lock.
+// The Registry stops holding the lock even if the key cannot be deleted, so
+// that this process can acquire the lock again. Other processes see the lock
+// as held until the key is deleted or the session lease expires.
+func (r *Registry) unlocker(name string, key string) UnlockFunc {
+	return func() error {
+		defer r.releaseLock(name)
+		b := r.backend
+		ctx, cancel := r.requestCtx()
+		defer cancel()
+		if _, err := b.Delete(ctx, key, nil); err != nil {
+			r.LERR("failed to delete waiter key %s of lock %s: %v",
+				key, name, err)
+			return err
+		}
+		r.L2("released lock %s", name)
+		return nil
+	}
+}
@@ -0,0 +1,557 @@
+package gsr
+
+// memBackend is an in-process Backend. It keeps the whole store, and a window
+// of its history for watches, in memory. It is the store behind the file
+// backend and is useful wherever a real etcd cluster is not available.
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// The number of revisions of history kept for watches. Watches started at an
+// older revision receive ErrCompacted.
+const memHistorySize = 10000
+
+// How often expired leases are looked for.
+const memReapInterval = 100 * time.Millisecond
+
+type memLease struct {
+	granted int64
+	expires time.Time
+	keys    map[string]bool
+}
+
+type memWatcher struct {
+	key    string
+	prefix bool
+	ctx    context.Context
+	closed <-chan struct{}
+	// mu protects queue, which holds responses not yet delivered to ch
+	mu     sync.Mutex
+	queue  []*WatchResponse
+	notify chan struct{}
+	ch     chan *WatchResponse
+}
+
+// Returns the events of a response that the watcher is interested in.
+func (w *memWatcher) filter(resp *WatchResponse) *WatchResponse {
+	evs := make([]*KVEvent, 0)
+	for _, ev := range resp.Events {
+		if ev.KV.Key == w.key || (w.prefix && strings.HasPrefix(ev.KV.Key, w.key)) {
+			evs = append(evs, ev)
+		}
+	}
+	if len(evs) == 0 {
+		return nil
+	}
+	return &WatchResponse{Events: evs, Revision: resp.Revision}
+}
+
+// Queues a response for delivery without blocking the store.
+func (w *memWatcher) enqueue(resp *WatchResponse) {
+	if resp = w.filter(resp); resp == nil {
+		return
+	}
+	w.mu.Lock()
+	w.queue = append(w.queue, resp)
+	w.mu.Unlock()
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Delivers queued responses to the watcher's channel until its context is
+// done.
+func (w *memWatcher) run(remove func()) {
+	defer close(w.ch)
+	defer remove()
+	for {
+		w.mu.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.mu.Unlock()
+		for _, resp := range queue {
+			select {
+			case w.ch <- resp:
+			case <-w.ctx.Done():
+				return
+			case <-w.closed:
+				return
+			}
+		}
+		select {
+		case <-w.notify:
+		case <-w.ctx.Done():
+			return
+		case <-w.closed:
+			return
+		}
+	}
+}
+
+type memBackend struct {
+	mu       sync.Mutex
+	rev      int64
+	kvs      map[string]*KeyValue
+	leases   map[LeaseID]*memLease
+	next     LeaseID
+	history  []*WatchResponse
+	watchers map[*memWatcher]bool
+	closed   chan struct{}
+}
+
+func newMemBackend() *memBackend {
+	b := &memBackend{
+		kvs:      make(map[string]*KeyValue, 0),
+		leases:   make(map[LeaseID]*memLease, 0),
+		watchers: make(map[*memWatcher]bool, 0),
+		closed:   make(chan struct{}),
+	}
+	go b.reap()
+	return b
+}
+
+// Deletes the keys of expired leases until the backend is closed.
+func (b *memBackend) reap() {
+	t := time.NewTicker(memReapInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-b.closed:
+			return
+		}
+		now := time.Now()
+		b.mu.Lock()
+		for id, l := range b.leases {
+			if now.After(l.expires) {
+				b.revokeLocked(id)
+			}
+		}
+		b.mu.Unlock()
+	}
+}
+
+// Records the events of a write at a new revision and sends them to
+// watchers. The caller must hold the lock.
+func (b *memBackend) commit(evs []*KVEvent) int64 {
+	b.rev++
+	if len(evs) == 0 {
+		return b.rev
+	}
+	resp := &WatchResponse{Events: evs, Revision: b.rev}
+	b.history = append(b.history, resp)
+	if len(b.history) > memHistorySize {
+		b.history = b.history[len(b.history)-memHistorySize:]
+	}
+	for w := range b.watchers {
+		w.enqueue(resp)
+	}
+	return b.rev
+}
+
+// Returns the oldest revision that watches can start at. The caller must hold
+// the lock.
+func (b *memBackend) oldestRevision() int64 {
+	if len(b.history) == 0 {
+		return b.rev + 1
+	}
+	return b.history[0].Revision
+}
+
+// Returns a copy of a key that callers may keep.
+func copyKV(kv *KeyValue, keysOnly bool) *KeyValue {
+	c := *kv
+	if keysOnly {
+		c.Value = nil
+	}
+	return &c
+}
+
+func (b *memBackend) Get(
+	ctx context.Context,
+	key string,
+	opts *GetOptions,
+) (*GetResponse, error) {
+	if opts == nil {
+		opts = &GetOptions{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	kvs := b.kvs
+	if opts.Revision != 0 && opts.Revision != b.rev {
+		var err error
+		if kvs, err = b.kvsAt(opts.Revision); err != nil {
+			return nil, err
+		}
+	}
+	res := &GetResponse{KVs: make([]*KeyValue, 0), Revision: b.rev}
+	if !opts.Prefix {
+		if kv, found := kvs[key]; found {
+			res.KVs = append(res.KVs, copyKV(kv, opts.KeysOnly))
+		}
+		return res, nil
+	}
+	for k, kv := range kvs {
+		if strings.HasPrefix(k, key) {
+			res.KVs = append(res.KVs, copyKV(kv, opts.KeysOnly))
+		}
+	}
+	sort.Slice(res.KVs, func(i, j int) bool {
+		return res.KVs[i].Key < res.KVs[j].Key
+	})
+	return res, nil
+}
+
+// Rebuilds the store as it was at a past revision by undoing the changes in
+// the history made since. The caller must hold the lock.
+func (b *memBackend) kvsAt(rev int64) (map[string]*KeyValue, error) {
+	if rev > b.rev || rev < b.oldestRevision()-1 {
+		return nil, ErrCompacted
+	}
+	kvs := make(map[string]*KeyValue, len(b.kvs))
+	for k, kv := range b.kvs {
+		kvs[k] = kv
+	}
+	for x := len(b.history) - 1; x >= 0 && b.history[x].Revision > rev; x-- {
+		for _, ev := range b.history[x].Events {
+			if ev.prev == nil {
+				delete(kvs, ev.KV.Key)
+			} else {
+				kvs[ev.KV.Key] = ev.prev
+			}
+		}
+	}
+	return kvs, nil
+}
+
+// Returns true if all of the supplied conditions hold. The caller must hold
+// the lock.
+func (b *memBackend) holds(conds []Condition) bool {
+	for _, c := range conds {
+		if !c.Holds(b.kvs[c.Key]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *memBackend) Put(
+	ctx context.Context,
+	key string,
+	val []byte,
+	opts *PutOptions,
+) (int64, error) {
+	if opts == nil {
+		opts = &PutOptions{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.holds(opts.If) {
+		return 0, ErrCompareFailed
+	}
+	lease := opts.Lease
+	prev := b.kvs[key]
+	if opts.IgnoreLease {
+		lease = NoLease
+		if prev != nil {
+			lease = prev.Lease
+		}
+	}
+	if lease != NoLease && b.leases[lease] == nil {
+		return 0, ErrLeaseNotFound
+	}
+	return b.putLocked(key, val, lease), nil
+}
+
+// Writes a key at a new revision. The caller must hold the lock.
+func (b *memBackend) putLocked(key string, val []byte, lease LeaseID) int64 {
+	return b.commit([]*KVEvent{b.set(key, val, lease)})
+}
+
+// Writes a key at the next revision without committing the revision, so that
+// several keys can be written at once. The caller must hold the lock.
+func (b *memBackend) set(key string, val []byte, lease LeaseID) *KVEvent {
+	kv := &KeyValue{
+		Key:            key,
+		Value:          append([]byte(nil), val...),
+		CreateRevision: b.rev + 1,
+		ModRevision:    b.rev + 1,
+		Version:        1,
+		Lease:          lease,
+	}
+	prev := b.kvs[key]
+	if prev != nil {
+		kv.CreateRevision = prev.CreateRevision
+		kv.Version = prev.Version + 1
+		if l := b.leases[prev.Lease]; l != nil {
+			delete(l.keys, key)
+		}
+	}
+	if l := b.leases[lease]; l != nil {
+		l.keys[key] = true
+	}
+	b.kvs[key] = kv
+	return &KVEvent{Type: KVPut, KV: kv, prev: prev}
+}
+
+func (b *memBackend) Delete(
+	ctx context.Context,
+	key string,
+	opts *DeleteOptions,
+) (int64, error) {
+	if opts == nil {
+		opts = &DeleteOptions{}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.holds(opts.If) {
+		return 0, ErrCompareFailed
+	}
+	keys := make([]string, 0)
+	if opts.Prefix {
+		for k := range b.kvs {
+			if strings.HasPrefix(k, key) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+	} else if _, found := b.kvs[key]; found {
+		keys = append(keys, key)
+	}
+	b.deleteLocked(keys)
+	return int64(len(keys)), nil
+}
+
+// Deletes keys at a single new revision. The caller must hold the lock.
+func (b *memBackend) deleteLocked(keys []string) {
+	if len(keys) == 0 {
+		return
+	}
+	evs := make([]*KVEvent, len(keys))
+	for x, k := range keys {
+		evs[x] = b.remove(k)
+	}
+	b.commit(evs)
+}
+
+// Deletes a key at the next revision without committing the revision. The
+// caller must hold the lock.
+func (b *memBackend) remove(key string) *KVEvent {
+	prev := b.kvs[key]
+	if l := b.leases[prev.Lease]; l != nil {
+		delete(l.keys, key)
+	}
+	delete(b.kvs, key)
+	return &KVEvent{
+		Type: KVDelete,
+		KV:   &KeyValue{Key: key, ModRevision: b.rev + 1},
+		prev: prev,
+	}
+}
+
+// Writes and deletes several keys, which are not attached to a lease, at a
+// single new revision. Keys attached to a live lease, e.g. endpoints registered
+// by the process, are left alone.
+func (b *memBackend) apply(puts map[string]string, deletes []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	keys := make([]string, 0, len(puts))
+	for k := range puts {
+		if !b.leased(k) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	evs := make([]*KVEvent, 0, len(puts)+len(deletes))
+	for _, k := range keys {
+		evs = append(evs, b.set(k, []byte(puts[k]), NoLease))
+	}
+	for _, k := range deletes {
+		if _, found := b.kvs[k]; found && !b.leased(k) {
+			evs = append(evs, b.remove(k))
+		}
+	}
+	if len(evs) > 0 {
+		b.commit(evs)
+	}
+}
+
+// Returns true if the key exists and is attached to a lease that has not
+// expired. The caller must hold the lock.
+func (b *memBackend) leased(key string) bool {
+	kv := b.kvs[key]
+	if kv == nil || kv.Lease == NoLease {
+		return false
+	}
+	l := b.leases[kv.Lease]
+	return l != nil && time.Now().Before(l.expires)
+}
+
+func (b *memBackend) Grant(ctx context.Context, ttl int64) (LeaseID, error) {
+	// The lease is refreshed every third of its TTL, which has to be
+	// positive
+	if ttl <= 0 {
+		return NoLease, ErrInvalidTTL
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.next++
+	b.leases[b.next] = &memLease{
+		granted: ttl,
+		expires: time.Now().Add(time.Duration(ttl) * time.Second),
+		keys:    make(map[string]bool, 0),
+	}
+	return b.next, nil
+}
+
+// Extends a lease by its granted TTL. Returns false if the lease no longer
+// exists.
+func (b *memBackend) refresh(lease LeaseID) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l := b.leases[lease]
+	if l == nil {
+		return false
+	}
+	l.expires = time.Now().Add(time.Duration(l.granted) * time.Second)
+	return true
+}
+
+func (b *memBackend) KeepAlive(
+	ctx context.Context,
+	lease LeaseID,
+) (<-chan struct{}, error) {
+	b.mu.Lock()
+	l := b.leases[lease]
+	b.mu.Unlock()
+	if l == nil {
+		return nil, ErrLeaseNotFound
+	}
+	// Like etcd clients, refresh the lease every third of its TTL
+	interval := time.Duration(l.granted) * time.Second / 3
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for b.refresh(lease) {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			case <-b.closed:
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (b *memBackend) Revoke(ctx context.Context, lease LeaseID) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.leases[lease] == nil {
+		return ErrLeaseNotFound
+	}
+	b.revokeLocked(lease)
+	return nil
+}
+
+// Deletes a lease and its keys. The caller must hold the lock.
+func (b *memBackend) revokeLocked(lease LeaseID) {
+	l := b.leases[lease]
+	keys := make([]string, 0, len(l.keys))
+	for k := range l.keys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b.deleteLocked(keys)
+	delete(b.leases, lease)
+}
+
+func (b *memBackend) TimeToLive(
+	ctx context.Context,
+	lease LeaseID,
+) (int64, int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	l := b.leases[lease]
+	if l == nil {
+		return 0, 0, ErrLeaseNotFound
+	}
+	ttl := int64(time.Until(l.expires).Seconds() + 0.5)
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl, l.granted, nil
+}
+
+func (b *memBackend) Watch(
+	ctx context.Context,
+	key string,
+	opts *WatchOptions,
+) <-chan *WatchResponse {
+	if opts == nil {
+		opts = &WatchOptions{}
+	}
+	w := &memWatcher{
+		key:    key,
+		prefix: opts.Prefix,
+		ctx:    ctx,
+		closed: b.closed,
+		notify: make(chan struct{}, 1),
+		ch:     make(chan *WatchResponse),
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if opts.Revision != 0 && opts.Revision <= b.rev {
+		if opts.Revision < b.oldestRevision() {
+			w.queue = []*WatchResponse{{Err: ErrCompacted, Revision: b.rev}}
+			go w.deliverError()
+			return w.ch
+		}
+		for _, resp := range b.history {
+			if resp.Revision >= opts.Revision {
+				w.enqueue(resp)
+			}
+		}
+	}
+	b.watchers[w] = true
+	go w.run(func() {
+		b.mu.Lock()
+		delete(b.watchers, w)
+		b.mu.Unlock()
+	})
+	return w.ch
+}
+
+// Delivers a watcher's only response, an error, and closes its channel.
+func (w *memWatcher) deliverError() {
+	defer close(w.ch)
+	select {
+	case w.ch <- w.queue[0]:
+	case <-w.ctx.Done():
+	}
+}
+
+func (b *memBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.closed:
+	default:
+		close(b.closed)
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package gsr
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestMemBackendConditions(t *testing.T) {
+	b := newMemBackend()
+	defer b.Close()
+	ctx := context.Background()
+
+	create := &PutOptions{
+		If: []Condition{{Key: "k", Target: CompareVersion, Op: "=", Value: 0}},
+	}
+	rev, err := b.Put(ctx, "k", []byte("v1"), create)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if _, err = b.Put(ctx, "k", []byte("v2"), create); err != ErrCompareFailed {
+		t.Fatalf("Expected ErrCompareFailed, but got %v.", err)
+	}
+	update := &PutOptions{
+		If: []Condition{
+			{Key: "k", Target: CompareModRevision, Op: "=", Value: rev},
+		},
+	}
+	rev2, err := b.Put(ctx, "k", []byte("v2"), update)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if rev2 <= rev {
+		t.Fatalf("Expected revision greater than %d, but got %d.", rev, rev2)
+	}
+
+	resp, err := b.Get(ctx, "k", nil)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	kv := resp.KVs[0]
+	if string(kv.Value) != "v2" || kv.Version != 2 || kv.CreateRevision != rev {
+		t.Fatalf("Expected v2 at version 2 created at %d, but got %+v.",
+			rev, kv)
+	}
+
+	// Reading at a past revision sees the value of the time
+	resp, err = b.Get(ctx, "k", &GetOptions{Revision: rev})
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if string(resp.KVs[0].Value) != "v1" {
+		t.Fatalf("Expected v1, but got %s.", resp.KVs[0].Value)
+	}
+}
+
+func TestMemBackendLeases(t *testing.T) {
+	b := newMemBackend()
+	defer b.Close()
+	ctx := context.Background()
+
+	if _, err := b.Grant(ctx, 0); err != ErrInvalidTTL {
+		t.Fatalf("Expected ErrInvalidTTL, but got %v.", err)
+	}
+	lease, err := b.Grant(ctx, 1)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if _, err = b.Put(ctx, "a/1", nil, &PutOptions{Lease: lease}); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if _, err = b.Put(ctx, "a/2", nil, nil); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	// Without a keepalive, the lease expires and takes its key with it
+	time.Sleep(1500 * time.Millisecond)
+	resp, err := b.Get(ctx, "a/", &GetOptions{Prefix: true})
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if len(resp.KVs) != 1 || resp.KVs[0].Key != "a/2" {
+		t.Fatalf("Expected only a/2, but got %v.", resp.KVs)
+	}
+	if _, _, err = b.TimeToLive(ctx, lease); err != ErrLeaseNotFound {
+		t.Fatalf("Expected ErrLeaseNotFound, but got %v.", err)
+	}
+
+	lease, err = b.Grant(ctx, 1)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	kactx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if _, err = b.KeepAlive(kactx, lease); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if _, _, err = b.TimeToLive(ctx, lease); err != nil {
+		t.Fatalf("Expected the lease to be kept alive, but got %v.", err)
+	}
+}
+
+func TestMemBackendWatch(t *testing.T) {
+	b := newMemBackend()
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rev, _ := b.Put(ctx, "w/1", []byte("a"), nil)
+	b.Put(ctx, "other", []byte("b"), nil)
+	b.Delete(ctx, "w/1", nil)
+
+	wch := b.Watch(ctx, "w/", &WatchOptions{Prefix: true, Revision: rev})
+	expect := func(typ KVEventType, key string) {
+		select {
+		case resp := <-wch:
+			if resp.Err != nil {
+				t.Fatalf("Expected nil, but got %v.", resp.Err)
+			}
+			ev := resp.Events[0]
+			if ev.Type != typ || ev.KV.Key != key {
+				t.Fatalf("Expected %v of %s, but got %v of %s.",
+					typ, key, ev.Type, ev.KV.Key)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for watch event")
+		}
+	}
+	// Past changes are replayed, then new ones delivered
+	expect(KVPut, "w/1")
+	expect(KVDelete, "w/1")
+	b.Put(ctx, "w/2", []byte("c"), nil)
+	expect(KVPut, "w/2")
+}
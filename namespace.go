@@ -0,0 +1,90 @@
+package gsr
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrInvalidNamespace = errors.New("invalid namespace")
+	ErrCrossNamespace   = errors.New(
+		"cross-namespace access not allowed. set GSR_ALLOW_CROSS_NAMESPACE " +
+			"to enable it",
+	)
+)
+
+// The Registry handles, keyed by namespace, that share a connection to etcd.
+type namespaceHandles struct {
+	sync.Mutex
+	byName map[string]*Registry
+}
+
+// Returns an error if the supplied namespace cannot be used as a single
+// segment of an etcd key. The empty string is the default namespace.
+func validateNamespace(name string) error {
+	if strings.Contains(name, "/") {
+		return ErrInvalidNamespace
+	}
+	return nil
+}
+
+// Namespace returns a Registry handle whose lookups, registrations and watches
+// are confined to the supplied namespace. The handle shares this Registry's
+// connection to etcd. The empty string is the default namespace, whose keys
+// are stored directly under GSR_KEY_PREFIX.
+//
+// A Registry may only return handles to namespaces other than the one it was
+// configured with (see GSR_NAMESPACE) if GSR_ALLOW_CROSS_NAMESPACE is set.
+// Otherwise, ErrCrossNamespace is returned.
+func (r *Registry) Namespace(name string) (*Registry, error) {
+	if err := validateNamespace(name); err != nil {
+		return nil, err
+	}
+	if name != r.config.Namespace && !r.config.AllowCrossNamespace {
+		r.LERR("refusing access to namespace %q from namespace %q",
+			name, r.config.Namespace)
+		return nil, ErrCrossNamespace
+	}
+
+	r.handles.Lock()
+	defer r.handles.Unlock()
+	if h, found := r.handles.byName[name]; found {
+		return h, nil
+	}
+	h := &Registry{
+		config:  r.config,
+		logs:    r.logs,
+		backend: r.backend,
+		handles: r.handles,
+		session: r.session,
+	}
+	h.initHandle(name)
+	r.handles.byName[name] = h
+	return h, nil
+}
+
+// Returns every handle sharing the Registry's connection, including the
+// Registry itself.
+func (r *Registry) namespaceHandles() []*Registry {
+	r.handles.Lock()
+	defer r.handles.Unlock()
+	res := make([]*Registry, 0, len(r.handles.byName))
+	for _, h := range r.handles.byName {
+		res = append(res, h)
+	}
+	return res
+}
+
+// Sets up the per-namespace state of a Registry handle and starts watching
+// the namespace for changes.
+func (r *Registry) initHandle(name string) {
+	r.namespace = name
+	r.subs = make(map[*watchSub]bool, 0)
+	r.next = make(map[string]uint64, 0)
+	r.registered = make(map[*Endpoint]bool, 0)
+	r.elections = make(map[string]*leadership, 0)
+	r.locks = make(map[string]bool, 0)
+	r.L2("using namespace %q", name)
+	r.setupWatch()
+}
@@ -0,0 +1,80 @@
+package gsr
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+)
+
+// Owner identifies the process, and the lease, that registered an endpoint.
+type Owner struct {
+	// InstanceID uniquely identifies the Registry connection that registered
+	// the endpoint. It is random unless GSR_INSTANCE_ID is set.
+	InstanceID string `json:"instance_id"`
+	Hostname   string `json:"hostname,omitempty"`
+	PID        int    `json:"pid,omitempty"`
+	// Lease is the ID of the lease the endpoint is attached to.
+	Lease int64 `json:"lease"`
+}
+
+func (o *Owner) String() string {
+	return fmt.Sprintf(
+		"%s (host %s, pid %d, lease %x)",
+		o.InstanceID, o.Hostname, o.PID, o.Lease,
+	)
+}
+
+// Returns the identity of this process, to be recorded as the owner of the
+// endpoints it registers.
+func newOwner(instanceID string) Owner {
+	if instanceID == "" {
+		b := make([]byte, 8)
+		rand.Read(b)
+		instanceID = hex.EncodeToString(b)
+	}
+	hostname, _ := os.Hostname()
+	return Owner{
+		InstanceID: instanceID,
+		Hostname:   hostname,
+		PID:        os.Getpid(),
+	}
+}
+
+// InstanceID returns the identifier recorded as the owner of every endpoint
+// registered through this Registry's connection.
+func (r *Registry) InstanceID() string {
+	return r.session.owner.InstanceID
+}
+
+// Returns the owner to record for an endpoint attached to the supplied lease.
+func (r *Registry) ownerFor(lease LeaseID) *Owner {
+	o := r.session.owner
+	o.Lease = int64(lease)
+	return &o
+}
+
+// ForceUnregister removes an endpoint from the gsr registry whoever owns it.
+// It is intended for administrative tools that clean up entries left behind by
+// other processes. Services should use Unregister() instead.
+func (r *Registry) ForceUnregister(ep *Endpoint) error {
+	service := ep.Service.Name
+	endpoint := ep.Address
+	b := r.backend
+
+	r.L1("forcibly deleting registry entry for %s:%s", service, endpoint)
+
+	ekey := r.endpointKey(service, endpoint)
+	ctx, cancel := r.requestCtx()
+	deleted, err := b.Delete(ctx, ekey, nil)
+	cancel()
+	if err != nil {
+		r.LERR("failed to delete registry entry for %s:%s: %v",
+			service, endpoint, err)
+		return err
+	}
+	if deleted == 0 {
+		return ErrEndpointNotFound
+	}
+	return nil
+}
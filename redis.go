@@ -0,0 +1,765 @@
+package gsr
+
+// The redis backend stores the registry in Redis:
+//
+//   GSR_BACKEND=redis://127.0.0.1:6379/0
+//
+// Every operation is a Lua script, so conditions are checked and writes are
+// applied atomically. All keys the backend uses begin with "gsr:":
+//
+//   gsr:rev          the revision counter
+//   gsr:k:KEY        a hash holding the value and revisions of KEY
+//   gsr:d:DIR        a set of the keys and directories directly beneath DIR,
+//                    e.g. gsr:d:gsr/services/web/ lists the endpoints of the
+//                    web service
+//   gsr:l:ID         the TTL of lease ID, expiring with the lease
+//   gsr:lk:ID        a set of the keys attached to lease ID
+//   gsr:leases       a set of the IDs of all leases
+//   gsr:events       the most recent changes, scored by revision, with each
+//                    change held in a gsr:e:REV:N hash
+//   gsr:compacted    the latest revision dropped from gsr:events
+//
+// Keys attached to a lease are deleted by whichever process notices the lease
+// has expired first. They also get an expiry of twice the lease's TTL,
+// refreshed with the lease, so that they are removed by Redis when no gsr
+// process is running. Watches poll gsr:events for changes.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"golang.org/x/net/context"
+)
+
+const (
+	// How many changes are kept for watches to catch up with
+	redisHistorySize = 10000
+	// How often watches poll for changes
+	redisPollInterval = 100 * time.Millisecond
+	// How often expired leases are looked for
+	redisReapInterval = 500 * time.Millisecond
+)
+
+// Functions shared by the scripts below. Keys and values are always passed
+// as arguments, never interpolated into the scripts.
+const redisLib = `
+local R = 'gsr:'
+
+local function dirof(key)
+  return string.match(key, '^(.*/)[^/]+/?$') or ''
+end
+
+-- Adds a key or directory to the set of its directory, and that directory
+-- to its own, up to the top.
+local function link(key)
+  while key ~= '' do
+    local dir = dirof(key)
+    local added = redis.call('SADD', R .. 'd:' .. dir, key)
+    if added == 0 and string.sub(key, -1) == '/' then
+      return
+    end
+    key = dir
+  end
+end
+
+-- Removes a key or directory from the set of its directory, and removes
+-- directories left empty from theirs.
+local function unlink(key)
+  while key ~= '' do
+    local dir = dirof(key)
+    redis.call('SREM', R .. 'd:' .. dir, key)
+    if dir == '' or redis.call('SCARD', R .. 'd:' .. dir) > 0 then
+      return
+    end
+    key = dir
+  end
+end
+
+-- Returns the keys equal to key or, with prefix, beginning with it.
+local function keys(key, prefix)
+  local res = {}
+  if prefix ~= '1' then
+    if redis.call('EXISTS', R .. 'k:' .. key) == 1 then
+      res[1] = key
+    end
+    return res
+  end
+  local function walk(dir, match)
+    for _, m in ipairs(redis.call('SMEMBERS', R .. 'd:' .. dir)) do
+      if string.sub(m, 1, string.len(match)) == match then
+        if string.sub(m, -1) == '/' then
+          walk(m, '')
+        elseif redis.call('EXISTS', R .. 'k:' .. m) == 1 then
+          res[#res + 1] = m
+        else
+          -- Expired by Redis while no gsr process was running
+          unlink(m)
+        end
+      end
+    end
+  end
+  walk(dirof(key), key)
+  return res
+end
+
+-- Returns the create revision, mod revision, version and lease of a key,
+-- all 0 if it does not exist.
+local function meta(key)
+  local h = redis.call('HMGET', R .. 'k:' .. key, 'c', 'm', 'ver', 'l')
+  return tonumber(h[1]) or 0, tonumber(h[2]) or 0,
+    tonumber(h[3]) or 0, tonumber(h[4]) or 0
+end
+
+-- Checks the conditions in ARGV, starting at index first.
+local function holds(first)
+  local n = tonumber(ARGV[first])
+  for x = 0, n - 1 do
+    local key = ARGV[first + 1 + x * 4]
+    local target = ARGV[first + 2 + x * 4]
+    local op = ARGV[first + 3 + x * 4]
+    local want = tonumber(ARGV[first + 4 + x * 4])
+    local c, m, ver, l = meta(key)
+    local have = ({version = ver, create = c, mod = m, lease = l})[target]
+    local ok
+    if op == '=' then ok = have == want
+    elseif op == '!=' then ok = have ~= want
+    elseif op == '>' then ok = have > want
+    elseif op == '<' then ok = have < want
+    end
+    if not ok then
+      return false
+    end
+  end
+  return true
+end
+
+local seq = 0
+
+-- Records a change in the event log, dropping the oldest changes beyond
+-- the history size. Changes made at the same revision are ordered by their
+-- ID, so the sequence number is padded to sort as a number would.
+local function record(rev, typ, key, v, c, m, ver, l)
+  seq = seq + 1
+  local id = string.format('%d:%08d', rev, seq)
+  redis.call('HMSET', R .. 'e:' .. id, 't', typ, 'k', key, 'v', v,
+    'c', c, 'm', m, 'ver', ver, 'l', l)
+  redis.call('ZADD', R .. 'events', rev, id)
+end
+
+local function trim()
+  local n = redis.call('ZCARD', R .. 'events') - HISTORY
+  if n <= 0 then
+    return
+  end
+  local old = redis.call('ZRANGE', R .. 'events', 0, n - 1, 'WITHSCORES')
+  for x = 1, #old, 2 do
+    redis.call('DEL', R .. 'e:' .. old[x])
+    redis.call('SET', R .. 'compacted', old[x + 1])
+  end
+  redis.call('ZREMRANGEBYRANK', R .. 'events', 0, n - 1)
+end
+
+-- Deletes keys at a single new revision, returning that revision.
+local function remove(ks)
+  local rev = redis.call('INCR', R .. 'rev')
+  for _, key in ipairs(ks) do
+    local _, _, _, l = meta(key)
+    if l ~= 0 then
+      redis.call('SREM', R .. 'lk:' .. l, key)
+    end
+    redis.call('DEL', R .. 'k:' .. key)
+    unlink(key)
+    record(rev, 'delete', key, '', 0, rev, 0, 0)
+  end
+  trim()
+  return rev
+end
+
+-- Revokes a lease, deleting the keys attached to it.
+local function revoke(id)
+  local ks = {}
+  for _, key in ipairs(redis.call('SMEMBERS', R .. 'lk:' .. id)) do
+    local _, _, _, l = meta(key)
+    if l == tonumber(id) then
+      ks[#ks + 1] = key
+    end
+  end
+  if #ks > 0 then
+    remove(ks)
+  end
+  redis.call('DEL', R .. 'l:' .. id, R .. 'lk:' .. id)
+  redis.call('SREM', R .. 'leases', id)
+end
+`
+
+// ARGV: key, prefix, revision. Returns the current revision, whether the
+// keys changed since the revision, and the keys.
+const redisGetScript = `
+local ks = keys(ARGV[1], ARGV[2])
+local rev = tonumber(redis.call('GET', R .. 'rev')) or 0
+local since = tonumber(ARGV[3])
+local changed = 0
+if since ~= 0 and since < rev then
+  local compacted = tonumber(redis.call('GET', R .. 'compacted')) or 0
+  if since < compacted then
+    changed = 1
+  end
+  local ids = redis.call('ZRANGEBYSCORE', R .. 'events', '(' .. since, '+inf')
+  for _, id in ipairs(ids) do
+    local key = redis.call('HGET', R .. 'e:' .. id, 'k')
+    if key == ARGV[1] or (ARGV[2] == '1' and
+        string.sub(key, 1, string.len(ARGV[1])) == ARGV[1]) then
+      changed = 1
+    end
+  end
+end
+local res = {rev, changed}
+for _, key in ipairs(ks) do
+  local h = redis.call('HMGET', R .. 'k:' .. key, 'v', 'c', 'm', 'ver', 'l')
+  res[#res + 1] = {key, h[1], h[2], h[3], h[4], h[5]}
+end
+return res
+`
+
+// ARGV: key, value, lease, ignore lease, conditions. Returns the new
+// revision, 0 if a condition failed, or -1 if the lease does not exist.
+const redisPutScript = `
+if not holds(5) then
+  return 0
+end
+local key, lease = ARGV[1], tonumber(ARGV[3])
+local c, _, ver, old = meta(key)
+if ARGV[4] == '1' then
+  lease = old
+end
+local ttl = 0
+if lease ~= 0 then
+  ttl = tonumber(redis.call('GET', R .. 'l:' .. lease))
+  if not ttl then
+    return -1
+  end
+end
+local rev = redis.call('INCR', R .. 'rev')
+if ver == 0 then
+  c = rev
+  link(key)
+end
+ver = ver + 1
+local k = R .. 'k:' .. key
+redis.call('HMSET', k, 'v', ARGV[2], 'c', c, 'm', rev, 'ver', ver, 'l', lease)
+if old ~= lease and old ~= 0 then
+  redis.call('SREM', R .. 'lk:' .. old, key)
+end
+if lease ~= 0 then
+  redis.call('SADD', R .. 'lk:' .. lease, key)
+  redis.call('PEXPIRE', k, ttl * 2000)
+else
+  redis.call('PERSIST', k)
+end
+record(rev, 'put', key, ARGV[2], c, rev, ver, lease)
+trim()
+return rev
+`
+
+// ARGV: key, prefix, conditions. Returns whether the conditions held, the
+// number of keys deleted and the new revision.
+const redisDeleteScript = `
+if not holds(3) then
+  return {0, 0, 0}
+end
+local ks = keys(ARGV[1], ARGV[2])
+if #ks == 0 then
+  return {1, 0, 0}
+end
+return {1, #ks, remove(ks)}
+`
+
+// ARGV: TTL in seconds. Returns the new lease ID.
+const redisGrantScript = `
+local id = redis.call('INCR', R .. 'lease')
+redis.call('SET', R .. 'l:' .. id, ARGV[1])
+redis.call('PEXPIRE', R .. 'l:' .. id, tonumber(ARGV[1]) * 1000)
+redis.call('SADD', R .. 'leases', id)
+return id
+`
+
+// ARGV: lease ID. Refreshes the expiry of the lease and of the keys attached
+// to it. Returns 0 if the lease does not exist.
+const redisKeepAliveScript = `
+local ttl = tonumber(redis.call('GET', R .. 'l:' .. ARGV[1]))
+if not ttl then
+  return 0
+end
+redis.call('PEXPIRE', R .. 'l:' .. ARGV[1], ttl * 1000)
+for _, key in ipairs(redis.call('SMEMBERS', R .. 'lk:' .. ARGV[1])) do
+  redis.call('PEXPIRE', R .. 'k:' .. key, ttl * 2000)
+end
+return 1
+`
+
+// ARGV: lease ID. Returns 0 if the lease does not exist.
+const redisRevokeScript = `
+if redis.call('SISMEMBER', R .. 'leases', ARGV[1]) == 0 then
+  return 0
+end
+revoke(ARGV[1])
+return 1
+`
+
+// ARGV: lease ID. Returns the remaining and granted TTL in milliseconds, or
+// nothing if the lease does not exist.
+const redisTTLScript = `
+local ttl = redis.call('PTTL', R .. 'l:' .. ARGV[1])
+if ttl < 0 then
+  return {}
+end
+return {ttl, tonumber(redis.call('GET', R .. 'l:' .. ARGV[1])) * 1000}
+`
+
+// Returns the current revision.
+const redisRevScript = `
+return tonumber(redis.call('GET', R .. 'rev')) or 0
+`
+
+// Revokes every lease that has expired.
+const redisReapScript = `
+for _, id in ipairs(redis.call('SMEMBERS', R .. 'leases')) do
+  if redis.call('EXISTS', R .. 'l:' .. id) == 0 then
+    revoke(id)
+  end
+end
+return 0
+`
+
+// ARGV: revision. Returns the current revision and every change since the
+// revision, or -1 if some of those changes are no longer in the log.
+const redisEventsScript = `
+local since = tonumber(ARGV[1])
+local compacted = tonumber(redis.call('GET', R .. 'compacted')) or 0
+local rev = tonumber(redis.call('GET', R .. 'rev')) or 0
+if since <= compacted then
+  return {-1, rev}
+end
+local res = {0, rev}
+for _, id in ipairs(redis.call('ZRANGEBYSCORE', R .. 'events', since, '+inf')) do
+  local e = redis.call('HMGET', R .. 'e:' .. id,
+    't', 'k', 'v', 'c', 'm', 'ver', 'l')
+  res[#res + 1] = e
+end
+return res
+`
+
+func newRedisScript(src string) *redis.Script {
+	lib := fmt.Sprintf("local HISTORY = %d\n", redisHistorySize)
+	return redis.NewScript(0, lib+redisLib+src)
+}
+
+var (
+	redisGet       = newRedisScript(redisGetScript)
+	redisPut       = newRedisScript(redisPutScript)
+	redisDelete    = newRedisScript(redisDeleteScript)
+	redisGrant     = newRedisScript(redisGrantScript)
+	redisKeepAlive = newRedisScript(redisKeepAliveScript)
+	redisRevoke    = newRedisScript(redisRevokeScript)
+	redisTTL       = newRedisScript(redisTTLScript)
+	redisReap      = newRedisScript(redisReapScript)
+	redisEvents    = newRedisScript(redisEventsScript)
+	redisRev       = newRedisScript(redisRevScript)
+)
+
+type redisBackend struct {
+	pool   *redis.Pool
+	logf   func(string, ...interface{})
+	once   sync.Once
+	closed chan struct{}
+}
+
+// redisDialer opens a connection to the Redis server at the supplied URL.
+type redisDialer func(url string) (redis.Conn, error)
+
+// dialRedis connects redis backends created by New to Redis.
+func dialRedis(url string) (redis.Conn, error) {
+	return redis.DialURL(url)
+}
+
+func newRedisBackend(
+	url string,
+	logf func(string, ...interface{}),
+	dial redisDialer,
+) *redisBackend {
+	b := &redisBackend{
+		pool: &redis.Pool{
+			MaxIdle:     4,
+			IdleTimeout: time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return dial(url)
+			},
+		},
+		logf:   logf,
+		closed: make(chan struct{}),
+	}
+	go b.reap()
+	return b
+}
+
+// Runs a script with the supplied arguments.
+func (b *redisBackend) do(
+	ctx context.Context,
+	s *redis.Script,
+	args ...interface{},
+) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	conn := b.pool.Get()
+	defer conn.Close()
+	return s.Do(conn, args...)
+}
+
+// Returns script arguments for a list of conditions.
+func redisConditions(conds []Condition) []interface{} {
+	targets := map[CompareTarget]string{
+		CompareVersion:        "version",
+		CompareCreateRevision: "create",
+		CompareModRevision:    "mod",
+		CompareLease:          "lease",
+	}
+	args := []interface{}{len(conds)}
+	for _, c := range conds {
+		args = append(args, c.Key, targets[c.Target], c.Op, c.Value)
+	}
+	return args
+}
+
+func redisBool(v bool) string {
+	if v {
+		return "1"
+	}
+	return "0"
+}
+
+// Reads a key as returned by the get script.
+func redisKeyValue(v interface{}) (*KeyValue, error) {
+	fields, err := redis.Values(v, nil)
+	if err != nil {
+		return nil, err
+	}
+	kv := &KeyValue{}
+	var lease int64
+	_, err = redis.Scan(fields,
+		&kv.Key, &kv.Value, &kv.CreateRevision, &kv.ModRevision, &kv.Version,
+		&lease,
+	)
+	kv.Lease = LeaseID(lease)
+	return kv, err
+}
+
+func (b *redisBackend) Get(
+	ctx context.Context,
+	key string,
+	opts *GetOptions,
+) (*GetResponse, error) {
+	if opts == nil {
+		opts = &GetOptions{}
+	}
+	res, err := redis.Values(b.do(
+		ctx, redisGet, key, redisBool(opts.Prefix), opts.Revision,
+	))
+	if err != nil {
+		return nil, err
+	}
+	var rev, changed int64
+	if res, err = redis.Scan(res, &rev, &changed); err != nil {
+		return nil, err
+	}
+	if changed == 1 {
+		return nil, ErrCompacted
+	}
+	resp := &GetResponse{KVs: make([]*KeyValue, len(res)), Revision: rev}
+	for x, v := range res {
+		if resp.KVs[x], err = redisKeyValue(v); err != nil {
+			return nil, err
+		}
+		if opts.KeysOnly {
+			resp.KVs[x].Value = nil
+		}
+	}
+	sort.Slice(resp.KVs, func(i, j int) bool {
+		return resp.KVs[i].Key < resp.KVs[j].Key
+	})
+	return resp, nil
+}
+
+func (b *redisBackend) Put(
+	ctx context.Context,
+	key string,
+	val []byte,
+	opts *PutOptions,
+) (int64, error) {
+	if opts == nil {
+		opts = &PutOptions{}
+	}
+	args := []interface{}{
+		key, val, int64(opts.Lease), redisBool(opts.IgnoreLease),
+	}
+	args = append(args, redisConditions(opts.If)...)
+	rev, err := redis.Int64(b.do(ctx, redisPut, args...))
+	if err != nil {
+		return 0, err
+	}
+	switch rev {
+	case 0:
+		return 0, ErrCompareFailed
+	case -1:
+		return 0, ErrLeaseNotFound
+	}
+	return rev, nil
+}
+
+func (b *redisBackend) Delete(
+	ctx context.Context,
+	key string,
+	opts *DeleteOptions,
+) (int64, error) {
+	if opts == nil {
+		opts = &DeleteOptions{}
+	}
+	args := []interface{}{key, redisBool(opts.Prefix)}
+	args = append(args, redisConditions(opts.If)...)
+	res, err := redis.Int64s(b.do(ctx, redisDelete, args...))
+	if err != nil {
+		return 0, err
+	}
+	if res[0] == 0 {
+		return 0, ErrCompareFailed
+	}
+	return res[1], nil
+}
+
+func (b *redisBackend) Grant(ctx context.Context, ttl int64) (LeaseID, error) {
+	id, err := redis.Int64(b.do(ctx, redisGrant, ttl))
+	if err != nil {
+		return NoLease, err
+	}
+	return LeaseID(id), nil
+}
+
+func (b *redisBackend) KeepAlive(
+	ctx context.Context,
+	lease LeaseID,
+) (<-chan struct{}, error) {
+	ttl, _, err := b.TimeToLive(ctx, lease)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		t := time.NewTicker(time.Duration(ttl) * time.Second / 3)
+		defer t.Stop()
+		for {
+			alive, err := redis.Bool(b.do(ctx, redisKeepAlive, int64(lease)))
+			if err == nil && !alive {
+				return
+			}
+			if err == nil {
+				select {
+				case ch <- struct{}{}:
+				default:
+				}
+			}
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			case <-b.closed:
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (b *redisBackend) Revoke(ctx context.Context, lease LeaseID) error {
+	found, err := redis.Bool(b.do(ctx, redisRevoke, int64(lease)))
+	if err != nil {
+		return err
+	}
+	if !found {
+		return ErrLeaseNotFound
+	}
+	return nil
+}
+
+func (b *redisBackend) TimeToLive(
+	ctx context.Context,
+	lease LeaseID,
+) (int64, int64, error) {
+	res, err := redis.Int64s(b.do(ctx, redisTTL, int64(lease)))
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(res) == 0 {
+		return 0, 0, ErrLeaseNotFound
+	}
+	// Round up, so that a lease with less than a second left is still
+	// reported as alive
+	return (res[0] + 999) / 1000, res[1] / 1000, nil
+}
+
+// Deletes the keys of expired leases until the backend is closed.
+func (b *redisBackend) reap() {
+	t := time.NewTicker(redisReapInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-b.closed:
+			return
+		}
+		if _, err := b.do(context.Background(), redisReap); err != nil {
+			b.logf("failed to revoke expired leases: %v", err)
+		}
+	}
+}
+
+// Returns the changes made since a revision, grouped by revision, and the
+// current revision.
+func (b *redisBackend) events(
+	ctx context.Context,
+	since int64,
+) ([]*WatchResponse, int64, error) {
+	res, err := redis.Values(b.do(ctx, redisEvents, since))
+	if err != nil {
+		return nil, 0, err
+	}
+	var compacted, rev int64
+	if res, err = redis.Scan(res, &compacted, &rev); err != nil {
+		return nil, 0, err
+	}
+	if compacted == -1 {
+		return nil, rev, ErrCompacted
+	}
+	resps := make([]*WatchResponse, 0)
+	for _, v := range res {
+		fields, err := redis.Values(v, nil)
+		if err != nil {
+			return nil, 0, err
+		}
+		var typ string
+		var lease int64
+		kv := &KeyValue{}
+		_, err = redis.Scan(fields,
+			&typ, &kv.Key, &kv.Value, &kv.CreateRevision, &kv.ModRevision,
+			&kv.Version, &lease,
+		)
+		if err != nil {
+			return nil, 0, err
+		}
+		kv.Lease = LeaseID(lease)
+		ev := &KVEvent{Type: KVPut, KV: kv}
+		if typ == "delete" {
+			ev.Type = KVDelete
+			kv.Value = nil
+		}
+		n := len(resps)
+		if n == 0 || resps[n-1].Revision != kv.ModRevision {
+			resps = append(resps, &WatchResponse{Revision: kv.ModRevision})
+			n++
+		}
+		resps[n-1].Events = append(resps[n-1].Events, ev)
+	}
+	return resps, rev, nil
+}
+
+func (b *redisBackend) Watch(
+	ctx context.Context,
+	key string,
+	opts *WatchOptions,
+) <-chan *WatchResponse {
+	if opts == nil {
+		opts = &WatchOptions{}
+	}
+	ch := make(chan *WatchResponse)
+	next := opts.Revision
+	var err error
+	if next == 0 {
+		// Only changes made once Watch returns are delivered
+		var rev int64
+		rev, err = redis.Int64(b.do(ctx, redisRev))
+		next = rev + 1
+	}
+	go b.watch(ctx, key, opts.Prefix, next, err, ch)
+	return ch
+}
+
+// Polls the event log for changes to a key or prefix made at or after the
+// supplied revision.
+func (b *redisBackend) watch(
+	ctx context.Context,
+	key string,
+	prefix bool,
+	next int64,
+	err error,
+	ch chan<- *WatchResponse,
+) {
+	defer close(ch)
+	send := func(resp *WatchResponse) bool {
+		select {
+		case ch <- resp:
+			return true
+		case <-ctx.Done():
+			return false
+		case <-b.closed:
+			return false
+		}
+	}
+	if err != nil {
+		send(&WatchResponse{Err: err})
+		return
+	}
+	t := time.NewTicker(redisPollInterval)
+	defer t.Stop()
+	for {
+		resps, rev, err := b.events(ctx, next)
+		if err != nil {
+			if ctx.Err() == nil {
+				send(&WatchResponse{Err: err, Revision: rev})
+			}
+			return
+		}
+		for _, resp := range resps {
+			evs := resp.Events[:0]
+			for _, ev := range resp.Events {
+				k := ev.KV.Key
+				if k == key || prefix && strings.HasPrefix(k, key) {
+					evs = append(evs, ev)
+				}
+			}
+			if len(evs) == 0 {
+				continue
+			}
+			resp.Events = evs
+			if !send(resp) {
+				return
+			}
+		}
+		next = rev + 1
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		case <-b.closed:
+			return
+		}
+	}
+}
+
+func (b *redisBackend) Close() error {
+	b.once.Do(func() { close(b.closed) })
+	return b.pool.Close()
+}
@@ -0,0 +1,255 @@
+package gsr
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"golang.org/x/net/context"
+)
+
+func newTestRedisBackend(t *testing.T) (*miniredis.Miniredis, *redisBackend) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	logf := func(string, ...interface{}) {}
+	return m, newRedisBackend("redis://"+m.Addr(), logf, dialRedis)
+}
+
+func TestRedisBackendConditions(t *testing.T) {
+	m, b := newTestRedisBackend(t)
+	defer m.Close()
+	defer b.Close()
+	ctx := context.Background()
+
+	create := &PutOptions{
+		If: []Condition{{Key: "k", Target: CompareVersion, Op: "=", Value: 0}},
+	}
+	rev, err := b.Put(ctx, "k", []byte("v1"), create)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if _, err = b.Put(ctx, "k", []byte("v2"), create); err != ErrCompareFailed {
+		t.Fatalf("Expected ErrCompareFailed, but got %v.", err)
+	}
+	update := &PutOptions{
+		If: []Condition{
+			{Key: "k", Target: CompareModRevision, Op: "=", Value: rev},
+		},
+	}
+	rev2, err := b.Put(ctx, "k", []byte("v2"), update)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if rev2 <= rev {
+		t.Fatalf("Expected revision greater than %d, but got %d.", rev, rev2)
+	}
+
+	resp, err := b.Get(ctx, "k", nil)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	kv := resp.KVs[0]
+	if string(kv.Value) != "v2" || kv.Version != 2 || kv.CreateRevision != rev {
+		t.Fatalf("Expected v2 at version 2 created at %d, but got %+v.",
+			rev, kv)
+	}
+	if _, err = b.Get(ctx, "k", &GetOptions{Revision: rev}); err != ErrCompacted {
+		t.Fatalf("Expected ErrCompacted, but got %v.", err)
+	}
+
+	// Prefixes match within and across directories
+	b.Put(ctx, "svc/web/1", []byte("a"), nil)
+	b.Put(ctx, "svc/web/2", []byte("b"), nil)
+	b.Put(ctx, "svc/webx/1", []byte("c"), nil)
+	b.Put(ctx, "svc/db/1", []byte("d"), nil)
+	resp, _ = b.Get(ctx, "svc/web", &GetOptions{Prefix: true})
+	if len(resp.KVs) != 3 || resp.KVs[0].Key != "svc/web/1" ||
+		resp.KVs[2].Key != "svc/webx/1" {
+		t.Fatalf("Expected the web and webx keys, but got %v.", resp.KVs)
+	}
+	n, err := b.Delete(ctx, "svc/web/", &DeleteOptions{Prefix: true})
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 keys deleted, but got %d and %v.", n, err)
+	}
+	resp, _ = b.Get(ctx, "svc/", &GetOptions{Prefix: true})
+	if len(resp.KVs) != 2 {
+		t.Fatalf("Expected 2 keys left, but got %v.", resp.KVs)
+	}
+}
+
+func TestRedisBackendLeases(t *testing.T) {
+	m, b := newTestRedisBackend(t)
+	defer m.Close()
+	defer b.Close()
+	ctx := context.Background()
+
+	lease, err := b.Grant(ctx, 10)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if _, err = b.Put(ctx, "a/1", nil, &PutOptions{Lease: lease}); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if _, err = b.Put(ctx, "a/2", nil, nil); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if _, err = b.Put(ctx, "a/3", nil, &PutOptions{Lease: 999}); err != ErrLeaseNotFound {
+		t.Fatalf("Expected ErrLeaseNotFound, but got %v.", err)
+	}
+	ttl, granted, err := b.TimeToLive(ctx, lease)
+	if err != nil || ttl != 10 || granted != 10 {
+		t.Fatalf("Expected 10 of 10 seconds, but got %d of %d and %v.",
+			ttl, granted, err)
+	}
+
+	// Once the lease expires in Redis, its keys are deleted
+	m.FastForward(11 * time.Second)
+	time.Sleep(2 * redisReapInterval)
+	resp, err := b.Get(ctx, "a/", &GetOptions{Prefix: true})
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if len(resp.KVs) != 1 || resp.KVs[0].Key != "a/2" {
+		t.Fatalf("Expected only a/2, but got %v.", resp.KVs)
+	}
+	if _, _, err = b.TimeToLive(ctx, lease); err != ErrLeaseNotFound {
+		t.Fatalf("Expected ErrLeaseNotFound, but got %v.", err)
+	}
+
+	// Keepalives refresh the expiry of the lease
+	lease, err = b.Grant(ctx, 3)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	kactx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if _, err = b.KeepAlive(kactx, lease); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	m.FastForward(2 * time.Second)
+	time.Sleep(1500 * time.Millisecond)
+	m.FastForward(2 * time.Second)
+	if _, _, err = b.TimeToLive(ctx, lease); err != nil {
+		t.Fatalf("Expected the lease to be kept alive, but got %v.", err)
+	}
+
+	b.Put(ctx, "a/3", nil, &PutOptions{Lease: lease})
+	if err = b.Revoke(ctx, lease); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	resp, _ = b.Get(ctx, "a/3", nil)
+	if len(resp.KVs) != 0 {
+		t.Fatalf("Expected a/3 to be deleted, but got %v.", resp.KVs)
+	}
+	if err = b.Revoke(ctx, lease); err != ErrLeaseNotFound {
+		t.Fatalf("Expected ErrLeaseNotFound, but got %v.", err)
+	}
+}
+
+func TestRedisBackendWatch(t *testing.T) {
+	m, b := newTestRedisBackend(t)
+	defer m.Close()
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rev, _ := b.Put(ctx, "w/1", []byte("a"), nil)
+	b.Put(ctx, "other", []byte("b"), nil)
+	b.Delete(ctx, "w/1", nil)
+
+	wch := b.Watch(ctx, "w/", &WatchOptions{Prefix: true, Revision: rev})
+	expect := func(typ KVEventType, key string) {
+		select {
+		case resp := <-wch:
+			if resp.Err != nil {
+				t.Fatalf("Expected nil, but got %v.", resp.Err)
+			}
+			ev := resp.Events[0]
+			if ev.Type != typ || ev.KV.Key != key {
+				t.Fatalf("Expected %v of %s, but got %v of %s.",
+					typ, key, ev.Type, ev.KV.Key)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for watch event")
+		}
+	}
+	// Past changes are replayed, then new ones delivered
+	expect(KVPut, "w/1")
+	expect(KVDelete, "w/1")
+	b.Put(ctx, "w/2", []byte("c"), nil)
+	expect(KVPut, "w/2")
+
+	// Changes dropped from the history cannot be replayed
+	m.Set("gsr:compacted", "2")
+	wch = b.Watch(ctx, "w/", &WatchOptions{Prefix: true, Revision: rev})
+	select {
+	case resp := <-wch:
+		if resp.Err != ErrCompacted {
+			t.Fatalf("Expected ErrCompacted, but got %v.", resp.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for watch error")
+	}
+}
+
+func TestRedisBackendRegistry(t *testing.T) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer m.Close()
+
+	orig, found := os.LookupEnv("GSR_BACKEND")
+	if !found {
+		defer os.Unsetenv("GSR_BACKEND")
+	} else {
+		defer os.Setenv("GSR_BACKEND", orig)
+	}
+	os.Setenv("GSR_BACKEND", "redis://"+m.Addr())
+
+	r, err := New()
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := r.Watch(ctx, "web", nil)
+	expect := func(typ EventType, addr string) {
+		select {
+		case ev := <-events:
+			if ev.Type != typ || ev.Endpoint.Address != addr {
+				t.Fatalf("Expected %s of %s, but got %s of %s.",
+					typ, addr, ev.Type, ev.Endpoint.Address)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s of %s.", typ, addr)
+		}
+	}
+
+	ep := Endpoint{Service: &Service{Name: "web"}, Address: "127.0.0.1:8080"}
+	if err = r.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	expect(EventCreated, ep.Address)
+
+	// A second registry sharing the server sees the endpoint
+	r2, err := New()
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer r2.Close()
+	eps := r2.Endpoints("web")
+	if len(eps) != 1 || eps[0].Address != ep.Address {
+		t.Fatalf("Expected %s, but got %v.", ep.Address, eps)
+	}
+
+	if err = r.Unregister(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	expect(EventDeleted, ep.Address)
+}
@@ -5,20 +5,30 @@ package gsr
 //
 // $KEY_PREFIX <-- environ['GSR_KEY_PREFIX']
 // |
+// -> /ns
+// |  |
+// |  ->> /$NAMESPACE  <-- environ['GSR_NAMESPACE'], if set
+// |      |
+// |      -> /services  <-- same layout as below
+// |
 // -> /services
 //    |
-//    ->> /$SERVICE
+//    ->> /$SERVICE  <-- optional service definition
 //        |
 //        -> /$ENDPOINT1
 //        -> /$ENDPOINT2
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/cenkalti/backoff"
 	etcd "go.etcd.io/etcd/clientv3"
@@ -26,18 +36,98 @@ import (
 	"google.golang.org/grpc"
 )
 
+var (
+	ErrEndpointNotFound = errors.New("endpoint not found")
+	ErrEndpointOwned    = errors.New(
+		"endpoint is registered by another live process",
+	)
+	ErrNotOwner = errors.New(
+		"endpoint was not registered by this registry",
+	)
+	ErrConflict = errors.New(
+		"endpoint was modified concurrently. read it again and retry",
+	)
+)
+
+// errWatchClosed is returned by readWatch() for a watch that was closed
+// without an error, e.g. because the connection to etcd was lost.
+var errWatchClosed = errors.New("watch closed")
+
+// How long to wait before resuming a lost watch of the registry, at first and
+// at most.
+const (
+	watchRetryInterval    = 100 * time.Millisecond
+	watchRetryMaxInterval = 10 * time.Second
+)
+
 type Service struct {
-	Name string
+	Name string `json:"name"`
+	// The remaining fields are only populated for services that have been
+	// defined with Registry.DefineService() and looked up with
+	// Registry.Service() or Registry.Services().
+	Description   string   `json:"description,omitempty"`
+	Owner         string   `json:"owner,omitempty"`
+	Protocol      string   `json:"protocol,omitempty"`
+	DefaultPort   int      `json:"default_port,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+	SchemaVersion string   `json:"schema_version,omitempty"`
 }
 
 type Endpoint struct {
 	Service *Service
 	Address string
-	lease   etcd.LeaseID
+	// Draining is true when the endpoint has been marked as going away. A
+	// draining endpoint is still registered but should not be sent any new
+	// traffic.
+	Draining bool
+	// Labels are arbitrary key/value metadata about the endpoint, such as its
+	// version or zone, that can be matched with a Selector.
+	Labels map[string]string
+	// Owner identifies who registered the endpoint. It is set by Register()
+	// and when the endpoint is read from the registry, and cannot be changed
+	// by the caller.
+	Owner *Owner
+	lease LeaseID
+	// The etcd revision at which the endpoint's entry was last modified, as
+	// seen by this Registry. Used to detect conflicting updates.
+	modRev int64
+}
+
+// The value stored in etcd at an endpoint's key. Endpoints registered by older
+// versions of gsr have an empty value, which decodes to the zero value.
+type endpointValue struct {
+	Draining bool              `json:"draining,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Owner    *Owner            `json:"owner,omitempty"`
 }
 
+// Returns the serialized etcd value for an endpoint.
+func (ep *Endpoint) value() string {
+	b, _ := json.Marshal(&endpointValue{
+		Draining: ep.Draining,
+		Labels:   ep.Labels,
+		Owner:    ep.Owner,
+	})
+	return string(b)
+}
+
+// Decodes an etcd value into the supplied endpoint.
+func (ep *Endpoint) setValue(val []byte) error {
+	ev := endpointValue{}
+	if len(val) > 0 {
+		if err := json.Unmarshal(val, &ev); err != nil {
+			return err
+		}
+	}
+	ep.Draining = ev.Draining
+	ep.Labels = ev.Labels
+	ep.Owner = ev.Owner
+	return nil
+}
+
+// Heartbeat keeps a lease alive for as long as the Registry is connected.
 type Heartbeat struct {
-	ka <-chan *etcd.LeaseKeepAliveResponse
+	ka <-chan struct{}
 }
 
 type registryLogs struct {
@@ -47,26 +137,62 @@ type registryLogs struct {
 }
 
 type Registry struct {
-	config     *Config
-	logs       *registryLogs
-	client     *etcd.Client
-	watcher    etcd.WatchChan
-	heartbeats map[*Endpoint]*Heartbeat
+	config    *Config
+	logs      *registryLogs
+	backend   Backend
+	namespace string
+	handles   *namespaceHandles
+	session   *session
+	// watchRev is the revision up to which the endpoint cache is up to date,
+	// or zero if the cache has to be reloaded. Once the watch is set up, it
+	// is only used by the goroutine reading the watch.
+	watchRev int64
+	// stopWatch stops the watch keeping the endpoint cache up to date
+	stopWatch context.CancelFunc
+	// mu protects the endpoint cache and the set of watchers
+	mu    sync.RWMutex
+	cache map[string]map[string]*Endpoint
+	subs  map[*watchSub]bool
+	// next holds, per service, the round-robin position used by Pick()
+	next map[string]uint64
+	// registered holds the endpoints registered through this Registry
+	registered map[*Endpoint]bool
+	// elections holds, per service, the elections won with Campaign()
+	elections map[string]*leadership
+	// locks holds the names of the locks held, or waited for, through this
+	// Registry
+	locks map[string]bool
+}
+
+// Returns the etcd key prefix under which everything in the Registry's
+// namespace is stored.
+func (r *Registry) namespaceKey() string {
+	return namespaceKeyFor(r.config.EtcdKeyPrefix, r.namespace)
+}
+
+// Returns the key prefix of a namespace beneath the supplied key prefix.
+func namespaceKeyFor(prefix string, namespace string) string {
+	if namespace == "" {
+		return prefix
+	}
+	return prefix + "ns/" + namespace + "/"
 }
 
 // Returns the etcd key prefix representing the top-level "services" directory.
 func (r *Registry) servicesKey() string {
-	return r.config.EtcdKeyPrefix + "services/"
+	return r.namespaceKey() + "services/"
 }
 
-// Returns the etcd key prefix for a specific service.
+// Returns the etcd key for a specific service. The service's definition, if
+// any, is stored at this key and its endpoints are stored beneath it.
 func (r *Registry) serviceKey(service string) string {
 	return r.servicesKey() + service
 }
 
-// Returns the etcd key for an endpoint within a service.
+// Returns the etcd key for an endpoint within a service. The endpoint address
+// is escaped so that it forms a single key segment.
 func (r *Registry) endpointKey(service string, endpoint string) string {
-	return r.serviceKey(service) + "/" + endpoint
+	return r.serviceKey(service) + "/" + escapeKeySegment(endpoint)
 }
 
 func (r *Registry) requestCtx() (context.Context, context.CancelFunc) {
@@ -77,10 +203,14 @@ func (r *Registry) requestCtx() (context.Context, context.CancelFunc) {
 }
 
 // Given a full key, e.g. "gsr/services/web/127.0.0.1:80", returns the service
-// and endpoint as strings, e.g. "web", "127.0.0.1:80"
+// and endpoint as strings, e.g. "web", "127.0.0.1:80". For a service definition
+// key, e.g. "gsr/services/web", the returned endpoint is empty.
 func (r *Registry) partsFromKey(key string) (string, string) {
-	parts := strings.Split(key[len(r.servicesKey()):], "/")
-	return parts[0], parts[1]
+	parts := strings.SplitN(key[len(r.servicesKey()):], "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], unescapeKeySegment(parts[1])
 }
 
 func (r *Registry) LERR(message string, args ...interface{}) {
@@ -129,161 +259,648 @@ func (r *Registry) L2(message string, args ...interface{}) {
 	}
 }
 
-// Returns a list of endpoints for a requested service type.
+// Returns a list of endpoints for a requested service type, or of every
+// service if the service is empty. Endpoints that are draining are not
+// included. To list the endpoints of every service grouped by service, use
+// AllEndpoints().
 func (r *Registry) Endpoints(service string) []*Endpoint {
-	c := r.client
-	sort := etcd.WithSort(etcd.SortByKey, etcd.SortAscend)
-	skey := r.serviceKey(service)
+	key := r.servicesKey()
+	if service != "" {
+		if err := validateServiceName(service); err != nil {
+			r.L2("error looking up endpoints for service %q: %v", service, err)
+			return []*Endpoint{}
+		}
+		key = r.serviceKey(service) + "/"
+	}
+	eps, _, err := r.readEndpoints(key)
+	if err != nil {
+		r.L2("error looking up endpoints for service %s: %v", service, err)
+		return []*Endpoint{}
+	}
+	return withoutDraining(eps)
+}
+
+// Returns a map, keyed by service name, of the endpoints of every service in
+// the registry. Endpoints that are draining are not included.
+func (r *Registry) AllEndpoints() map[string][]*Endpoint {
+	res := make(map[string][]*Endpoint, 0)
+	eps, _, err := r.readEndpoints(r.servicesKey())
+	if err != nil {
+		r.L2("error looking up endpoints: %v", err)
+		return res
+	}
+	for _, ep := range withoutDraining(eps) {
+		sname := ep.Service.Name
+		res[sname] = append(res[sname], ep)
+	}
+	return res
+}
+
+// Reads all endpoints, including draining ones, with keys beginning with the
+// supplied prefix, in key order. Also returns the etcd revision the endpoints
+// were read at.
+func (r *Registry) readEndpoints(prefix string) ([]*Endpoint, int64, error) {
+	b := r.backend
 	ctx, cancel := r.requestCtx()
-	resp, err := c.KV.Get(ctx, skey, etcd.WithPrefix(), sort)
+	resp, err := b.Get(ctx, prefix, &GetOptions{Prefix: true})
 	cancel()
 	if err != nil {
-		r.L2("error looking up endpoints for service %s: %v",
-			service, err)
-		return []*Endpoint{}
+		return nil, 0, err
 	}
 
-	numEps := resp.Count
-	r.L2("read %d endpoints @ generation %d", numEps, resp.Header.Revision)
+	numEps := len(resp.KVs)
+	r.L2("read %d endpoints @ generation %d", numEps, resp.Revision)
 
-	lenServicesKey := len(skey)
-	eps := make([]*Endpoint, numEps)
-	for x, kv := range resp.Kvs {
-		key := kv.Key
+	eps := make([]*Endpoint, 0, numEps)
+	for _, kv := range resp.KVs {
 		// The full key will be "$KEY_PREFIX/services/$SERVICE/$ENDPOINT
-		parts := strings.Split(string(key[lenServicesKey:]), "/")
-		sname := parts[0]
-		addr := parts[1]
-		eps[x] = &Endpoint{
+		sname, addr := r.partsFromKey(kv.Key)
+		if addr == "" {
+			// This is a service definition, not an endpoint
+			continue
+		}
+		ep := &Endpoint{
 			Service: &Service{Name: sname},
 			Address: addr,
+			modRev:  kv.ModRevision,
+		}
+		if err := ep.setValue(kv.Value); err != nil {
+			r.LERR("failed to decode registry entry for %s:%s: %v",
+				sname, addr, err)
+			continue
 		}
+		eps = append(eps, ep)
 	}
-	return eps
+	return eps, resp.Revision, nil
 }
 
-// Sets up a watch channel for any changes to the gsr registry so that the
-// Registry object can refresh its map of service endpoints when changes occur.
-func (r *Registry) setupWatch() {
-	c := r.client
-	key := r.servicesKey()
-	r.L2("creating watch on %s", key)
-	r.watcher = c.Watch(context.Background(), key, etcd.WithPrefix())
-	go handleChanges(r)
+// Returns the supplied endpoints, minus any that are draining.
+func withoutDraining(eps []*Endpoint) []*Endpoint {
+	res := make([]*Endpoint, 0, len(eps))
+	for _, ep := range eps {
+		if !ep.Draining {
+			res = append(res, ep)
+		}
+	}
+	return res
 }
 
-// Sets up the channel heartbeat mechanism for the endpoint registered in this
-// Registry.
-func (r *Registry) setupHeartbeat(ep *Endpoint) error {
-	c := r.client
-	ch, err := c.KeepAlive(context.TODO(), ep.lease)
+// Loads the Registry's endpoint cache and sets up a watch channel for any
+// changes to the gsr registry so that the Registry object can refresh its
+// cache of service endpoints when changes occur. If the cache cannot be
+// loaded, it starts out empty and is loaded once the registry can be reached.
+func (r *Registry) setupWatch() {
+	ctx, cancel := context.WithCancel(context.Background())
+	r.stopWatch = cancel
+	eps, rev, err := r.readEndpoints(r.servicesKey())
 	if err != nil {
-		return err
+		r.LERR("failed to load endpoint cache: %v", err)
+		r.loadCache([]*Endpoint{})
+	} else {
+		r.L2("loaded %d endpoints into cache @ generation %d", len(eps), rev)
+		r.loadCache(eps)
+		r.watchRev = rev
 	}
-	r.heartbeats[ep] = &Heartbeat{ka: ch}
-	return nil
+	go handleChanges(r, ctx)
 }
 
-// Registers an endpoint for a service type and sets up all necessary heartbeat
-// and watch mechanisms.
+// Registers an endpoint for a service type. The endpoint is attached to the
+// Registry's session lease, which is shared by every endpoint registered
+// through the Registry's connection and kept alive by a single heartbeat. See
+// Claim() for how an existing entry for the endpoint is handled.
 func (r *Registry) Register(ep *Endpoint) error {
+	_, err := r.Claim(ep)
+	return err
+}
+
+// ClaimResult describes how Registry.Claim() registered an endpoint.
+type ClaimResult int
+
+const (
+	// ClaimCreated means no entry existed for the endpoint and a new one was
+	// created.
+	ClaimCreated ClaimResult = iota
+	// ClaimExisting means the entry was already attached to this Registry's
+	// session lease. Its metadata was rewritten.
+	ClaimExisting
+	// ClaimReattached means an entry existed that was attached to a lease no
+	// longer being kept alive, e.g. one left behind by a previous instance of
+	// the process that crashed. The entry was taken over and attached to
+	// this Registry's session lease.
+	ClaimReattached
+)
+
+func (c ClaimResult) String() string {
+	switch c {
+	case ClaimCreated:
+		return "created"
+	case ClaimExisting:
+		return "existing"
+	case ClaimReattached:
+		return "reattached"
+	}
+	return "unknown"
+}
+
+// Claim registers an endpoint for a service type, like Register(), and reports
+// how the endpoint's entry was created or taken over. Taking over an existing
+// entry is atomic: if the entry changes while it is being claimed, ErrConflict
+// is returned. If the entry is attached to a lease that is still being kept
+// alive by another process, ErrEndpointOwned is returned. If that lease cannot
+// be looked up, the backend's error is returned and the entry is left alone.
+func (r *Registry) Claim(ep *Endpoint) (ClaimResult, error) {
 	service := ep.Service.Name
 	addr := ep.Address
-	c := r.client
-	lease, err := c.Grant(context.TODO(), r.config.LeaseSeconds)
+	if err := validateServiceName(service); err != nil {
+		return ClaimCreated, err
+	}
+	if _, err := ParseAddress(addr); err != nil {
+		r.LERR("refusing to register %s: %v", service, err)
+		return ClaimCreated, err
+	}
+	r.setLocalityLabels(ep)
+	lease, err := r.sessionLease()
 	if err != nil {
-		r.LERR("failed to grant lease in etcd: %v", err)
-		return err
+		return ClaimCreated, err
+	}
+	ep.lease = lease
+	ep.Owner = r.ownerFor(lease)
+
+	b := r.backend
+	ekey := r.endpointKey(service, addr)
+	ctx, cancel := r.requestCtx()
+	resp, err := b.Get(ctx, ekey, nil)
+	cancel()
+	if err != nil {
+		r.LERR("failed to look up registry entry for %s:%s: %v",
+			service, addr, err)
+		return ClaimCreated, err
 	}
-	ep.lease = lease.ID
-	eps := r.Endpoints(service)
-	if !contains(addr, eps) {
-		err = r.createEndpoint(ep)
+	if len(resp.KVs) == 0 {
+		if err = r.createEndpoint(ep); err != nil {
+			return ClaimCreated, err
+		}
+		r.trackRegistered(ep)
+		return ClaimCreated, nil
+	}
+
+	kv := resp.KVs[0]
+	owner := kv.Lease
+	existing := &Endpoint{}
+	if err := existing.setValue(kv.Value); err != nil {
+		r.L2("failed to decode existing registry entry for %s:%s: %v",
+			service, addr, err)
+	}
+	result := ClaimReattached
+	if owner == lease {
+		result = ClaimExisting
+	} else if owner != NoLease {
+		// An entry recorded with our own InstanceID is not taken over
+		// while its lease is alive either: the lease may belong to
+		// another process started with the same GSR_INSTANCE_ID.
+		alive, err := r.leaseAlive(owner)
 		if err != nil {
-			return err
+			return result, err
+		}
+		if alive {
+			r.LERR("registry entry for %s:%s is owned by live lease %x (%v).",
+				service, addr, owner, existing.Owner)
+			return result, ErrEndpointOwned
 		}
 	}
 
-	err = r.setupHeartbeat(ep)
+	r.L2("taking over registry entry for %s:%s from lease %x (%s)",
+		service, addr, owner, result)
+
+	// Ensure nobody else has written to the
+	// $PREFIX/services/$SERVICE/$ENDPOINT key since we read it
+	opts := &PutOptions{
+		Lease: lease,
+		If: []Condition{
+			{Key: ekey, Target: CompareModRevision, Op: "=", Value: kv.ModRevision},
+		},
+	}
+	ctx, cancel = r.requestCtx()
+	rev, err := b.Put(ctx, ekey, []byte(ep.value()), opts)
+	cancel()
+	if err == ErrCompareFailed {
+		r.L2("concurrent write detected to key %v.", ekey)
+		return result, ErrConflict
+	}
 	if err != nil {
-		return err
+		r.LERR("failed to write registry entry %v: %v", ekey, err)
+		return result, err
 	}
-	r.L2("started heartbeat channel")
-	return nil
+	ep.modRev = rev
+	r.trackRegistered(ep)
+	return result, nil
+}
+
+// Records that an endpoint was registered through this Registry.
+func (r *Registry) trackRegistered(ep *Endpoint) {
+	r.mu.Lock()
+	r.registered[ep] = true
+	r.mu.Unlock()
+}
+
+// Returns the endpoints registered through this Registry and not since
+// unregistered.
+func (r *Registry) registeredEndpoints() []*Endpoint {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	res := make([]*Endpoint, 0, len(r.registered))
+	for ep := range r.registered {
+		res = append(res, ep)
+	}
+	return res
+}
+
+// Returns true if the supplied lease exists and has not expired. Only
+// ErrLeaseNotFound means the lease is gone: any other error is returned, since
+// the lease may well still be alive.
+func (r *Registry) leaseAlive(lease LeaseID) (bool, error) {
+	b := r.backend
+	ctx, cancel := r.requestCtx()
+	ttl, _, err := b.TimeToLive(ctx, lease)
+	cancel()
+	if err == ErrLeaseNotFound {
+		return false, nil
+	}
+	if err != nil {
+		r.LERR("failed to look up lease %x: %v", lease, err)
+		return false, err
+	}
+	return ttl > 0, nil
 }
 
 // Unregister removes an endpoint from the gsr registry. It is typically called
 // from a SIGTERM signal handler to short-circuit the automatic heartbeat that
 // keeps endpoints "alive" in gsr.
+//
+// Only the Registry that registered the endpoint may unregister it: the entry
+// is only deleted if it is still attached to the lease the endpoint was
+// registered with. Otherwise, ErrNotOwner is returned. Unregistering an
+// endpoint that is no longer in the registry is not an error.
 func (r *Registry) Unregister(ep *Endpoint) error {
 	service := ep.Service.Name
 	endpoint := ep.Address
-	c := r.client
+	b := r.backend
 
 	r.L2("deleting registry entry for %s:%s", service, endpoint)
 
 	ekey := r.endpointKey(service, endpoint)
-	onSuccess := etcd.OpDelete(ekey)
-	// Ensure the $PREFIX/services/$SERVICE/$ENDPOINT key exists
-	compare := etcd.Compare(etcd.Version(ekey), "=", 1)
+	// Ensure the $PREFIX/services/$SERVICE/$ENDPOINT key is attached to our
+	// lease. If it is not, somebody else owns it.
+	opts := &DeleteOptions{
+		If: []Condition{
+			{Key: ekey, Target: CompareLease, Op: "=", Value: int64(ep.lease)},
+		},
+	}
 	ctx, cancel := r.requestCtx()
-	resp, err := c.KV.Txn(ctx).If(compare).Then(onSuccess).Commit()
+	_, err := b.Delete(ctx, ekey, opts)
 	cancel()
 
-	if err != nil {
-		r.LERR("failed to create txn in etcd: %v", err)
-		return err
-	} else if resp.Succeeded == false {
+	if err == ErrCompareFailed {
+		found, err := r.exists(ekey)
+		if err != nil {
+			return err
+		}
+		if !found {
+			r.L2("registry entry for %s:%s already deleted.",
+				service, endpoint)
+			return nil
+		}
 		r.LERR(
-			"failed to delete registry entry for %s:%s %s.",
+			"refusing to delete registry entry for %s:%s. it is not "+
+				"attached to lease %x.",
 			service,
 			endpoint,
-			resp.Responses[0],
+			ep.lease,
 		)
+		return ErrNotOwner
+	} else if err != nil {
+		r.LERR("failed to delete registry entry %v: %v", ekey, err)
+		return err
+	}
+	r.mu.Lock()
+	delete(r.registered, ep)
+	r.mu.Unlock()
+	return nil
+}
+
+// Drain marks an endpoint as draining in the gsr registry. The endpoint stays
+// registered, but other Registry objects will no longer return it from
+// Endpoints(), so callers stop routing new traffic to it. Only an endpoint
+// registered through this Registry may be drained. Otherwise, ErrNotOwner is
+// returned.
+func (r *Registry) Drain(ep *Endpoint) error {
+	service := ep.Service.Name
+	endpoint := ep.Address
+	b := r.backend
+
+	if ep.lease == NoLease {
+		r.LERR("refusing to mark %s:%s as draining. it was not registered "+
+			"by this registry.", service, endpoint)
+		return ErrNotOwner
+	}
+
+	r.L2("marking registry entry for %s:%s as draining", service, endpoint)
+
+	ekey := r.endpointKey(service, endpoint)
+	// Ensure the $PREFIX/services/$SERVICE/$ENDPOINT key is still attached
+	// to our lease. If it is not, somebody else owns it.
+	opts := &PutOptions{
+		Lease: ep.lease,
+		If: []Condition{
+			{Key: ekey, Target: CompareLease, Op: "=", Value: int64(ep.lease)},
+		},
+	}
+	draining := *ep
+	draining.Draining = true
+	ctx, cancel := r.requestCtx()
+	rev, err := b.Put(ctx, ekey, []byte(draining.value()), opts)
+	cancel()
+
+	if err == ErrCompareFailed {
+		found, err := r.exists(ekey)
+		if err != nil {
+			return err
+		}
+		if found {
+			r.LERR(
+				"refusing to mark %s:%s as draining. it is not attached "+
+					"to lease %x.",
+				service,
+				endpoint,
+				ep.lease,
+			)
+			return ErrNotOwner
+		}
+		r.LERR("failed to mark %s:%s as draining. entry not found.",
+			service, endpoint)
+	} else if err != nil {
+		r.LERR("failed to write registry entry %v: %v", ekey, err)
+		return err
+	} else {
+		ep.Draining = true
+		ep.modRev = rev
 	}
 	return nil
 }
 
+// Close shuts down the connection to the gsr registry. Heartbeats for any
+// endpoints registered by this Registry stop, so those endpoints will expire
+// once their leases run out. The connection is shared by every namespace
+// handle returned from Namespace(), so all of them are closed.
+func (r *Registry) Close() error {
+	r.L2("closing connection to registry")
+	r.session.stop()
+	for _, h := range r.namespaceHandles() {
+		h.stopWatch()
+	}
+	return r.backend.Close()
+}
+
+// Update rewrites the metadata (labels and draining state) of a registered
+// endpoint in place. The entry keeps its lease, and watchers see a single
+// EventUpdated rather than the endpoint disappearing and reappearing. The
+// endpoint's Owner is read-only: the entry keeps the owner it was registered
+// with, and the supplied endpoint's Owner is set to it.
+//
+// The update only succeeds if the entry has not been modified since the
+// endpoint was read (by Endpoints(), Query(), Watch() or a previous call to
+// Register() or Update()). Otherwise, ErrConflict is returned and the caller
+// should read the endpoint again and retry. ErrEndpointNotFound is returned if
+// the endpoint is not registered.
+func (r *Registry) Update(ep *Endpoint) error {
+	service := ep.Service.Name
+	endpoint := ep.Address
+	b := r.backend
+
+	r.L2("updating registry entry for %s:%s", service, endpoint)
+
+	ekey := r.endpointKey(service, endpoint)
+	ctx, cancel := r.requestCtx()
+	resp, err := b.Get(ctx, ekey, nil)
+	cancel()
+	if err != nil {
+		r.LERR("failed to look up registry entry for %s:%s: %v",
+			service, endpoint, err)
+		return err
+	}
+	if len(resp.KVs) == 0 {
+		return ErrEndpointNotFound
+	}
+	kv := resp.KVs[0]
+	if kv.ModRevision != ep.modRev {
+		r.L2("concurrent write detected to key %v.", ekey)
+		return ErrConflict
+	}
+	stored := &Endpoint{}
+	if err := stored.setValue(kv.Value); err != nil {
+		r.LERR("failed to decode registry entry for %s:%s: %v",
+			service, endpoint, err)
+		return err
+	}
+	upd := *ep
+	upd.Owner = stored.Owner
+
+	// Ensure nobody else has written to the
+	// $PREFIX/services/$SERVICE/$ENDPOINT key since we read it
+	opts := &PutOptions{
+		IgnoreLease: true,
+		If: []Condition{
+			{Key: ekey, Target: CompareModRevision, Op: "=", Value: ep.modRev},
+		},
+	}
+	ctx, cancel = r.requestCtx()
+	rev, err := b.Put(ctx, ekey, []byte(upd.value()), opts)
+	cancel()
+
+	if err == ErrCompareFailed {
+		found, err := r.exists(ekey)
+		if err != nil {
+			return err
+		}
+		if !found {
+			return ErrEndpointNotFound
+		}
+		r.L2("concurrent write detected to key %v.", ekey)
+		return ErrConflict
+	}
+	if err != nil {
+		r.LERR("failed to write registry entry %v: %v", ekey, err)
+		return err
+	}
+	ep.Owner = stored.Owner
+	ep.modRev = rev
+	return nil
+}
+
+// Returns true if the supplied key exists.
+func (r *Registry) exists(key string) (bool, error) {
+	b := r.backend
+	ctx, cancel := r.requestCtx()
+	resp, err := b.Get(ctx, key, &GetOptions{KeysOnly: true})
+	cancel()
+	if err != nil {
+		r.LERR("failed to look up key %v: %v", key, err)
+		return false, err
+	}
+	return len(resp.KVs) > 0, nil
+}
+
 // Creates an entry for an endpoint in the gsr registry
 func (r *Registry) createEndpoint(ep *Endpoint) error {
 	service := ep.Service.Name
 	endpoint := ep.Address
-	c := r.client
+	b := r.backend
 
 	r.L2("creating new registry entry for %s:%s", service, endpoint)
 
 	ekey := r.endpointKey(service, endpoint)
-	onSuccess := etcd.OpPut(ekey, "", etcd.WithLease(ep.lease))
 	// Ensure the $PREFIX/services/$SERVICE/$ENDPOINT key doesn't yet exist
-	compare := etcd.Compare(etcd.Version(ekey), "=", 0)
+	opts := &PutOptions{
+		Lease: ep.lease,
+		If: []Condition{
+			{Key: ekey, Target: CompareVersion, Op: "=", Value: 0},
+		},
+	}
 	ctx, cancel := r.requestCtx()
-	resp, err := c.KV.Txn(ctx).If(compare).Then(onSuccess).Commit()
+	rev, err := b.Put(ctx, ekey, []byte(ep.value()), opts)
 	cancel()
 
+	if err == ErrCompareFailed {
+		r.L2("concurrent write detected to key %v.", ekey)
+		return ErrConflict
+	} else if err != nil {
+		r.LERR("failed to write registry entry %v: %v", ekey, err)
+		return err
+	}
+	ep.modRev = rev
+	return nil
+}
+
+// Watches the registry for changes, from the revision the endpoint cache was
+// loaded at, and applies them to the cache until the supplied context is done.
+//
+// A watch that fails or is closed is resumed from the last revision seen, so
+// that no change is missed. If that revision has been compacted away, the
+// cache is reloaded and watchers are sent the differences between the old
+// and new contents of the cache, as though the changes had been watched.
+// Either way, watchers are sent an EventReconnected once the registry can be
+// reached again.
+func handleChanges(r *Registry, ctx context.Context) {
+	key := r.servicesKey()
+	bo := backoff.NewExponentialBackOff()
+	bo.InitialInterval = watchRetryInterval
+	bo.MaxInterval = watchRetryMaxInterval
+	bo.MaxElapsedTime = 0
+	reconnect := false
+	for {
+		var err error
+		if r.watchRev == 0 {
+			if err = r.reloadCache(); err != nil {
+				r.LERR("failed to reload endpoint cache: %v", err)
+			}
+		} else if reconnect {
+			// Make sure the registry can be reached before reporting that
+			// the watch has been resumed
+			_, err = r.exists(r.servicesKey())
+		}
+		if err != nil {
+			if !sleepCtx(ctx, bo.NextBackOff()) {
+				return
+			}
+			continue
+		}
+		r.L2("creating watch on %s @ generation %d", key, r.watchRev+1)
+		wch := r.backend.Watch(ctx, key, &WatchOptions{
+			Prefix:   true,
+			Revision: r.watchRev + 1,
+		})
+		if reconnect {
+			r.notifyReconnected()
+		}
+		err = r.readWatch(wch, bo)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == ErrCompacted {
+			r.LERR("changes to registry since generation %d have been "+
+				"compacted. reloading endpoint cache.", r.watchRev)
+			r.watchRev = 0
+		} else {
+			r.LERR("lost watch on registry: %v. resuming @ generation %d.",
+				err, r.watchRev+1)
+		}
+		reconnect = true
+		if !sleepCtx(ctx, bo.NextBackOff()) {
+			return
+		}
+	}
+}
+
+// Reloads the endpoint cache from the registry, sending watchers the
+// differences between the old and new contents of the cache.
+func (r *Registry) reloadCache() error {
+	eps, rev, err := r.readEndpoints(r.servicesKey())
 	if err != nil {
-		r.LERR("failed to create txn in etcd: %v", err)
 		return err
-	} else if resp.Succeeded == false {
-		r.L2("concurrent write detected to key %v.", ekey)
 	}
+	r.L2("reloaded %d endpoints into cache @ generation %d", len(eps), rev)
+	r.resyncCache(eps)
+	r.watchRev = rev
 	return nil
 }
 
-// Reads the registry's watch channel and processes incoming events.
-func handleChanges(r *Registry) {
-	for cin := range r.watcher {
+// Applies the changes delivered on a watch of the registry until the watch
+// ends, and returns the error it ended with. Each response received resets
+// the supplied backoff.
+func (r *Registry) readWatch(
+	wch <-chan *WatchResponse,
+	bo backoff.BackOff,
+) error {
+	for cin := range wch {
+		if cin.Err != nil {
+			return cin.Err
+		}
+		bo.Reset()
 		for _, ev := range cin.Events {
-			service, endpoint := r.partsFromKey(string(ev.Kv.Key))
+			if ev.KV.ModRevision > r.watchRev {
+				r.watchRev = ev.KV.ModRevision
+			}
+			service, endpoint := r.partsFromKey(ev.KV.Key)
+			if endpoint == "" {
+				r.L2("received notification that service %s "+
+					"definition changed.", service)
+				continue
+			}
 			switch ev.Type {
-			case etcd.EventTypeDelete:
+			case KVDelete:
 				r.L2("received notification that %s:%s was deleted. ",
 					service, endpoint)
-			case etcd.EventTypePut:
-				r.L2("received notification that %s:%s was created. ",
+			case KVPut:
+				r.L2("received notification that %s:%s was written. ",
 					service, endpoint)
 			}
+			r.applyChange(ev)
 		}
 	}
+	return errWatchClosed
+}
+
+// Waits for the supplied duration, returning false if the context is done
+// first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
 }
 
 // Returns an etcd3 client using an exponential backoff and reconnect strategy.
@@ -389,8 +1006,59 @@ func (r *Registry) connect() (*etcd.Client, error) {
 // Creates a new gsr.Registry object, registers a service and endpoint with the
 // registry, and returns the registry object.
 func New() (*Registry, error) {
+	return newRegistry(ConfigFromEnv(), nil)
+}
+
+// NewWithConfig creates a new gsr.Registry object configured with a copy of
+// the supplied Config rather than from the environment. Use ConfigFromEnv() to start from
+// the environment's configuration and override parts of it:
+//
+//	cfg := gsr.ConfigFromEnv()
+//	cfg.EtcdEndpoints = []string{"http://etcd.us-west:2379"}
+//	r, err := gsr.NewWithConfig(cfg)
+func NewWithConfig(cfg *Config) (*Registry, error) {
+	if cfg == nil {
+		return nil, errors.New("config must not be nil")
+	}
+	c := *cfg
+	return newRegistry(&c, nil)
+}
+
+// NewWithBackend creates a new gsr.Registry object that stores the registry
+// in the supplied Backend instead of the one selected by GSR_BACKEND. The
+// rest of the Registry's configuration is read from the environment, as with
+// New(). The Registry takes ownership of the Backend and closes it when the
+// Registry is closed.
+func NewWithBackend(b Backend) (*Registry, error) {
+	if b == nil {
+		return nil, errors.New("backend must not be nil")
+	}
+	return newRegistry(ConfigFromEnv(), b)
+}
+
+// NewWithConfigAndBackend creates a new gsr.Registry object configured with
+// the supplied Config that stores the registry in the supplied Backend. The
+// Backend setting of the Config is ignored. Unlike New() and NewWithBackend(),
+// it does not read the environment, so it is safe to call concurrently with
+// code that changes the environment. The Registry takes ownership of the
+// Backend and closes it when the Registry is closed.
+func NewWithConfigAndBackend(cfg *Config, b Backend) (*Registry, error) {
+	if cfg == nil {
+		return nil, errors.New("config must not be nil")
+	}
+	if b == nil {
+		return nil, errors.New("backend must not be nil")
+	}
+	c := *cfg
+	return newRegistry(&c, b)
+}
+
+func newRegistry(cfg *Config, backend Backend) (*Registry, error) {
+	if err := validateNamespace(cfg.Namespace); err != nil {
+		return nil, err
+	}
 	r := new(Registry)
-	r.config = configFromEnv()
+	r.config = cfg
 	logMode := (log.Ldate | log.Ltime | log.LUTC)
 	if r.config.LogMicroseconds {
 		logMode |= log.Lmicroseconds
@@ -403,16 +1071,19 @@ func New() (*Registry, error) {
 		log1: log.New(os.Stderr, "", logMode),
 		log2: log.New(os.Stderr, "", logMode),
 	}
-	client, err := r.connect()
-	if err != nil {
-		return nil, err
+	if backend == nil {
+		var err error
+		if backend, err = r.newBackend(); err != nil {
+			return nil, err
+		}
 	}
-	r.client = client
+	r.backend = backend
 	r.L1("connected to registry.")
 
-	r.heartbeats = make(map[*Endpoint]*Heartbeat, 0)
-
-	r.setupWatch()
+	r.session = newSession(newOwner(cfg.InstanceID))
+	r.handles = &namespaceHandles{byName: make(map[string]*Registry, 0)}
+	r.initHandle(cfg.Namespace)
+	r.handles.byName[cfg.Namespace] = r
 	return r, nil
 }
 
@@ -1,8 +1,13 @@
 package gsr
 
 import (
+	"errors"
 	"os"
+	"syscall"
 	"testing"
+	"time"
+
+	"golang.org/x/net/context"
 )
 
 func TestNewBadAddress(t *testing.T) {
@@ -34,111 +39,278 @@ func TestNewBadAddress(t *testing.T) {
 	}
 }
 
-func TestFunctionalSimple(t *testing.T) {
-	testEps, found := os.LookupEnv("GSR_TEST_ETCD_ENDPOINTS")
-	if !found {
-		t.Skip("GSR_TEST_ETCD_ENDPOINTS not set. Skipping functional test.")
+func TestHandleSignalsContextDone(t *testing.T) {
+	factory, stop := MemBackendFactory()
+	defer stop()
+	r, err := NewWithBackend(factory(t))
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
 	}
 
-	orig, found := os.LookupEnv("GSR_ETCD_ENDPOINTS")
-	if !found {
-		defer os.Unsetenv("GSR_ETCD_ENDPOINTS")
-	} else {
-		defer os.Setenv("GSR_ETCD_ENDPOINTS", orig)
+	ep := Endpoint{
+		Service: &Service{Name: "drain"},
+		Address: "192.168.1.14",
+	}
+	if err = r.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
 	}
 
-	os.Setenv("GSR_ETCD_ENDPOINTS", testEps)
-
-	service := "web"
-	addr := "192.168.1.12"
-	ep := Endpoint{
-		Service: &Service{Name: service},
-		Address: addr,
+	// A shutdown started by the context still waits for the grace period,
+	// so watchers have time to stop routing to the drained endpoint
+	grace := 300 * time.Millisecond
+	var drained time.Time
+	opts := &SignalOptions{
+		GracePeriod: grace,
+		OnDrain: func() error {
+			drained = time.Now()
+			return nil
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = r.HandleSignals(ctx, []*Endpoint{&ep}, opts); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
 	}
+	if waited := time.Since(drained); waited < grace {
+		t.Fatalf("Expected a grace period of %s, but got %s.", grace, waited)
+	}
+}
 
-	r, err := New()
+func TestHandleSignalsAbortGracePeriod(t *testing.T) {
+	factory, stop := MemBackendFactory()
+	defer stop()
+	r, err := NewWithBackend(factory(t))
 	if err != nil {
 		t.Fatalf("Expected nil, but got %v.", err)
 	}
-	if r == nil {
-		t.Fatal("Expected *gsr.Registry, but got nil.")
+
+	// Once a signal has started the shutdown, a context that is done cuts
+	// the grace period short
+	ctx, cancel := context.WithCancel(context.Background())
+	opts := &SignalOptions{
+		Signals:     []os.Signal{syscall.SIGUSR1},
+		GracePeriod: time.Hour,
+		OnDrain: func() error {
+			cancel()
+			return nil
+		},
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- r.HandleSignals(ctx, nil, opts)
+	}()
+	// Give HandleSignals time to start listening for the signal
+	time.Sleep(100 * time.Millisecond)
+	if err = syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Expected nil, but got %v.", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected HandleSignals to skip the grace period.")
 	}
+}
 
-	if err = r.Register(&ep); err != nil {
+func TestConcurrencySessionNotSupported(t *testing.T) {
+	factory, stop := MemBackendFactory()
+	defer stop()
+	r, err := NewWithBackend(factory(t))
+	if err != nil {
 		t.Fatalf("Expected nil, but got %v.", err)
 	}
+	defer r.Close()
 
-	eps := r.Endpoints(service)
-	if eps == nil {
-		t.Fatalf("Expected []string, but got nil")
+	// Backends that do not support elections fail without granting a
+	// session lease
+	if _, err = r.concurrencySession(); err != ErrNotSupported {
+		t.Fatalf("Expected ErrNotSupported, but got %v.", err)
 	}
-	if !contains(addr, eps) {
-		t.Fatalf("Expected to find %s in %v.", addr, eps)
+	if r.session.lease != NoLease {
+		t.Fatalf("Expected no session lease, but got %x.", r.session.lease)
 	}
 }
 
-func TestFunctionalConcurrency(t *testing.T) {
-	testEps, found := os.LookupEnv("GSR_TEST_ETCD_ENDPOINTS")
-	if !found {
-		t.Skip("GSR_TEST_ETCD_ENDPOINTS not set. Skipping functional " +
-			"concurrency test.")
+// A Backend whose deletes fail.
+type failingDeleteBackend struct {
+	Backend
+}
+
+func (b *failingDeleteBackend) Delete(
+	ctx context.Context,
+	key string,
+	opts *DeleteOptions,
+) (int64, error) {
+	return 0, errors.New("delete failed")
+}
+
+func TestLockRelease(t *testing.T) {
+	factory, stop := MemBackendFactory()
+	defer stop()
+	r, err := NewWithBackend(&failingDeleteBackend{factory(t)})
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
 	}
+	defer r.Close()
 
-	orig, found := os.LookupEnv("GSR_ETCD_ENDPOINTS")
-	if !found {
-		defer os.Unsetenv("GSR_ETCD_ENDPOINTS")
-	} else {
-		defer os.Setenv("GSR_ETCD_ENDPOINTS", orig)
+	ctx := context.Background()
+	if _, _, err = r.TryLock(ctx, "migrate"); err != ErrNotSupported {
+		t.Fatalf("Expected ErrNotSupported, but got %v.", err)
+	}
+	if _, _, err = r.Lock(ctx, "migrate"); err != ErrNotSupported {
+		t.Fatalf("Expected ErrNotSupported, but got %v.", err)
+	}
+	if r.session.lease != NoLease {
+		t.Fatalf("Expected no session lease, but got %x.", r.session.lease)
 	}
 
-	os.Setenv("GSR_ETCD_ENDPOINTS", testEps)
+	// A lock whose waiter key cannot be deleted is still released, so that
+	// it can be acquired again
+	if err = r.holdLock("migrate"); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if err = r.unlocker("migrate", r.lockKey("migrate")+"/1")(); err == nil {
+		t.Fatal("Expected the failed delete to be reported, but got nil.")
+	}
+	if err = r.holdLock("migrate"); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+}
 
-	service := "data-access"
-	addr1 := "192.168.1.12"
-	addr2 := "192.168.1.13"
-	addrs := []string{addr1, addr2}
-	ep1 := Endpoint{
-		Service: &Service{Name: service},
-		Address: addr1,
+func TestClaimSameInstanceID(t *testing.T) {
+	factory, stop := MemBackendFactory()
+	defer stop()
+	cfg := ConfigFromEnv()
+	cfg.InstanceID = "web-1"
+	r1, err := newRegistry(cfg, factory(t))
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
 	}
-	ep2 := Endpoint{
-		Service: &Service{Name: service},
-		Address: addr2,
+	defer r1.Close()
+	r2, err := newRegistry(cfg, factory(t))
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
 	}
+	defer r2.Close()
 
-	r1, err := New()
+	ep := Endpoint{
+		Service: &Service{Name: "owned"},
+		Address: "192.168.1.23",
+	}
+	if err = r1.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	// Sharing an instance ID does not let r2 take over an entry whose lease
+	// r1 is still keeping alive
+	other := ep
+	if _, err = r2.Claim(&other); err != ErrEndpointOwned {
+		t.Fatalf("Expected ErrEndpointOwned, but got %v.", err)
+	}
+}
+
+func TestDrainOwnership(t *testing.T) {
+	factory, stop := MemBackendFactory()
+	defer stop()
+	r1, err := NewWithBackend(factory(t))
 	if err != nil {
 		t.Fatalf("Expected nil, but got %v.", err)
 	}
-	if r1 == nil {
-		t.Fatal("Expected *gsr.Registry, but got nil.")
+	defer r1.Close()
+	r2, err := NewWithBackend(factory(t))
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer r2.Close()
+
+	// An endpoint that was never registered has no lease to drain it under
+	fresh := Endpoint{
+		Service: &Service{Name: "drained"},
+		Address: "192.168.1.24",
+	}
+	if err = r1.Drain(&fresh); err != ErrNotOwner {
+		t.Fatalf("Expected ErrNotOwner, but got %v.", err)
+	}
+	if found, _ := r1.exists(r1.endpointKey("drained", fresh.Address)); found {
+		t.Fatalf("Expected %s not to be written.", fresh.Address)
 	}
 
-	if err = r1.Register(&ep1); err != nil {
+	// Draining an endpoint unregistered in the meantime does not bring it
+	// back
+	ep := Endpoint{
+		Service: &Service{Name: "drained"},
+		Address: "192.168.1.25",
+	}
+	if err = r1.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if err = r1.Unregister(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if err = r1.Drain(&ep); err != nil {
 		t.Fatalf("Expected nil, but got %v.", err)
 	}
+	if found, _ := r1.exists(r1.endpointKey("drained", ep.Address)); found {
+		t.Fatalf("Expected %s not to be written.", ep.Address)
+	}
 
-	if eps := r1.Endpoints(service); !contains(addr1, eps) {
-		t.Fatalf("Expected to find %s in %v.", addr1, eps)
+	// Nor does it take over the entry of another process that registered
+	// the same address since
+	other := ep
+	if err = r2.Register(&other); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if err = r1.Drain(&ep); err != ErrNotOwner {
+		t.Fatalf("Expected ErrNotOwner, but got %v.", err)
 	}
+	eps := r2.Endpoints("drained")
+	if len(eps) != 1 || eps[0].Owner.Lease != other.Owner.Lease {
+		t.Fatalf("Expected %s to be left alone, but got %v.", ep.Address, eps)
+	}
+}
 
-	r2, err := New()
+func TestUpdateKeepsOwner(t *testing.T) {
+	factory, stop := MemBackendFactory()
+	defer stop()
+	r, err := NewWithBackend(factory(t))
 	if err != nil {
 		t.Fatalf("Expected nil, but got %v.", err)
 	}
-	if r1 == nil {
-		t.Fatal("Expected *gsr.Registry, but got nil.")
+	defer r.Close()
+
+	service := "owned"
+	ep := Endpoint{
+		Service: &Service{Name: service},
+		Address: "192.168.1.24",
+	}
+	if err = r.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
 	}
 
-	if err = r2.Register(&ep2); err != nil {
+	eps := r.Endpoints(service)
+	if len(eps) != 1 {
+		t.Fatalf("Expected 1 endpoint, but got %v.", eps)
+	}
+	upd := eps[0]
+	upd.Labels = map[string]string{"version": "v2"}
+	upd.Owner = &Owner{InstanceID: "somebody-else"}
+	if err = r.Update(upd); err != nil {
 		t.Fatalf("Expected nil, but got %v.", err)
 	}
-	if eps := r2.Endpoints(service); !containsAll(addrs, eps) {
-		t.Fatalf("Expected to find %s in %v.", addrs, eps)
+	if upd.Owner.InstanceID != r.InstanceID() {
+		t.Fatalf("Expected owner %s, but got %v.", r.InstanceID(), upd.Owner)
 	}
 
-	// first registry should find both endpoints now too
-	if eps := r1.Endpoints(service); !containsAll(addrs, eps) {
-		t.Fatalf("Expected to find %s in %v.", addrs, eps)
+	eps = r.Endpoints(service)
+	if len(eps) != 1 || eps[0].Labels["version"] != "v2" {
+		t.Fatalf("Expected version v2, but got %v.", eps)
+	}
+	if eps[0].Owner == nil || eps[0].Owner.InstanceID != r.InstanceID() {
+		t.Fatalf("Expected owner %s, but got %v.", r.InstanceID(), eps[0].Owner)
+	}
+	if err = r.Unregister(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
 	}
 }
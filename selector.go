@@ -0,0 +1,251 @@
+package gsr
+
+// Implements Kubernetes-style label selectors that can be evaluated against the
+// labels of an endpoint. A selector is a comma-separated list of requirements,
+// all of which must match:
+//
+// zone=us-east            label "zone" equals "us-east"
+// zone==us-east           same as above
+// zone!=us-east           label "zone" is absent or not equal to "us-east"
+// version in (v2,v3)      label "version" is either "v2" or "v3"
+// version notin (v1)      label "version" is absent or not "v1"
+// canary                  label "canary" exists, whatever its value
+// !canary                 label "canary" does not exist
+
+import (
+	"fmt"
+	"strings"
+)
+
+type Operator string
+
+const (
+	OpEquals       Operator = "="
+	OpNotEquals    Operator = "!="
+	OpIn           Operator = "in"
+	OpNotIn        Operator = "notin"
+	OpExists       Operator = "exists"
+	OpDoesNotExist Operator = "!"
+)
+
+// Requirement is a single expression within a Selector.
+type Requirement struct {
+	Key      string
+	Operator Operator
+	// Values holds a single value for OpEquals and OpNotEquals, one or more
+	// values for OpIn and OpNotIn, and nothing for OpExists and
+	// OpDoesNotExist.
+	Values []string
+}
+
+// Selector matches labels when all of its requirements match. An empty
+// Selector matches everything.
+type Selector []Requirement
+
+// Returns true if the supplied labels satisfy the requirement.
+func (req Requirement) Matches(labels map[string]string) bool {
+	val, found := labels[req.Key]
+	switch req.Operator {
+	case OpEquals:
+		return found && len(req.Values) == 1 && val == req.Values[0]
+	case OpNotEquals:
+		return !found || len(req.Values) != 1 || val != req.Values[0]
+	case OpIn:
+		return found && containsString(req.Values, val)
+	case OpNotIn:
+		return !found || !containsString(req.Values, val)
+	case OpExists:
+		return found
+	case OpDoesNotExist:
+		return !found
+	}
+	return false
+}
+
+func (req Requirement) String() string {
+	switch req.Operator {
+	case OpEquals, OpNotEquals:
+		val := ""
+		if len(req.Values) > 0 {
+			val = req.Values[0]
+		}
+		return req.Key + string(req.Operator) + val
+	case OpIn, OpNotIn:
+		return fmt.Sprintf(
+			"%s %s (%s)", req.Key, req.Operator, strings.Join(req.Values, ","),
+		)
+	case OpExists:
+		return req.Key
+	case OpDoesNotExist:
+		return "!" + req.Key
+	}
+	return ""
+}
+
+// Returns true if the supplied labels satisfy every requirement of the
+// selector.
+func (sel Selector) Matches(labels map[string]string) bool {
+	for _, req := range sel {
+		if !req.Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (sel Selector) String() string {
+	reqs := make([]string, len(sel))
+	for x, req := range sel {
+		reqs[x] = req.String()
+	}
+	return strings.Join(reqs, ",")
+}
+
+// ParseSelector parses a selector expression such as
+// "zone=us-east,version in (v2,v3),!canary". An empty expression returns an
+// empty Selector, which matches everything.
+func ParseSelector(expr string) (Selector, error) {
+	sel := Selector{}
+	if strings.TrimSpace(expr) == "" {
+		return sel, nil
+	}
+	terms, err := splitSelectorTerms(expr)
+	if err != nil {
+		return nil, err
+	}
+	for _, term := range terms {
+		req, err := parseRequirement(term)
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+// MustParseSelector is like ParseSelector but panics if the expression cannot
+// be parsed. It is intended for selectors that are constants in the caller's
+// code.
+func MustParseSelector(expr string) Selector {
+	sel, err := ParseSelector(expr)
+	if err != nil {
+		panic(err)
+	}
+	return sel
+}
+
+// Splits a selector expression on the commas that are not within a
+// parenthesized set of values.
+func splitSelectorTerms(expr string) ([]string, error) {
+	terms := make([]string, 0)
+	depth := 0
+	start := 0
+	for x, c := range expr {
+		switch c {
+		case '(':
+			depth++
+			if depth > 1 {
+				return nil, fmt.Errorf("nested parentheses in selector %q", expr)
+			}
+		case ')':
+			depth--
+			if depth < 0 {
+				return nil, fmt.Errorf("unbalanced parentheses in selector %q", expr)
+			}
+		case ',':
+			if depth == 0 {
+				terms = append(terms, expr[start:x])
+				start = x + 1
+			}
+		}
+	}
+	if depth != 0 {
+		return nil, fmt.Errorf("unbalanced parentheses in selector %q", expr)
+	}
+	return append(terms, expr[start:]), nil
+}
+
+// Parses a single requirement, e.g. "version in (v2,v3)".
+func parseRequirement(term string) (Requirement, error) {
+	term = strings.TrimSpace(term)
+	if term == "" {
+		return Requirement{}, fmt.Errorf("empty requirement in selector")
+	}
+	if strings.HasPrefix(term, "!") && !strings.HasPrefix(term, "!=") {
+		key := strings.TrimSpace(term[1:])
+		if !validLabelKey(key) {
+			return Requirement{}, fmt.Errorf("invalid label key in %q", term)
+		}
+		return Requirement{Key: key, Operator: OpDoesNotExist}, nil
+	}
+
+	keyLen := strings.IndexFunc(term, func(c rune) bool {
+		return !isLabelChar(c)
+	})
+	if keyLen == -1 {
+		keyLen = len(term)
+	}
+	key := term[:keyLen]
+	if !validLabelKey(key) {
+		return Requirement{}, fmt.Errorf("invalid label key in %q", term)
+	}
+	rest := strings.TrimSpace(term[keyLen:])
+
+	var op Operator
+	switch {
+	case rest == "":
+		return Requirement{Key: key, Operator: OpExists}, nil
+	case strings.HasPrefix(rest, "!="):
+		op, rest = OpNotEquals, rest[2:]
+	case strings.HasPrefix(rest, "=="):
+		op, rest = OpEquals, rest[2:]
+	case strings.HasPrefix(rest, "="):
+		op, rest = OpEquals, rest[1:]
+	case strings.HasPrefix(rest, "notin"):
+		op, rest = OpNotIn, rest[len("notin"):]
+	case strings.HasPrefix(rest, "in"):
+		op, rest = OpIn, rest[len("in"):]
+	default:
+		return Requirement{}, fmt.Errorf("unknown operator in %q", term)
+	}
+	rest = strings.TrimSpace(rest)
+
+	if op == OpEquals || op == OpNotEquals {
+		if !validLabelValue(rest) {
+			return Requirement{}, fmt.Errorf("invalid label value in %q", term)
+		}
+		return Requirement{Key: key, Operator: op, Values: []string{rest}}, nil
+	}
+
+	if !strings.HasPrefix(rest, "(") || !strings.HasSuffix(rest, ")") {
+		return Requirement{}, fmt.Errorf(
+			"expected parenthesized values after %s in %q", op, term,
+		)
+	}
+	vals := strings.Split(rest[1:len(rest)-1], ",")
+	for x, val := range vals {
+		val = strings.TrimSpace(val)
+		if val == "" || !validLabelValue(val) {
+			return Requirement{}, fmt.Errorf("invalid label value in %q", term)
+		}
+		vals[x] = val
+	}
+	return Requirement{Key: key, Operator: op, Values: vals}, nil
+}
+
+func isLabelChar(c rune) bool {
+	return (c >= 'a' && c <= 'z') ||
+		(c >= 'A' && c <= 'Z') ||
+		(c >= '0' && c <= '9') ||
+		c == '-' || c == '_' || c == '.' || c == '/'
+}
+
+func validLabelKey(key string) bool {
+	return key != "" && validLabelValue(key)
+}
+
+func validLabelValue(val string) bool {
+	return strings.IndexFunc(val, func(c rune) bool {
+		return !isLabelChar(c)
+	}) == -1
+}
@@ -0,0 +1,87 @@
+package gsr
+
+import (
+	"testing"
+)
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string
+	}{
+		{"", ""},
+		{"zone=us-east", "zone=us-east"},
+		{"zone == us-east", "zone=us-east"},
+		{"zone!=us-east", "zone!=us-east"},
+		{"version in (v2, v3)", "version in (v2,v3)"},
+		{"version notin (v1)", "version notin (v1)"},
+		{"canary", "canary"},
+		{"!canary", "!canary"},
+		{
+			"zone=us-east,version in (v2,v3),!canary",
+			"zone=us-east,version in (v2,v3),!canary",
+		},
+	}
+	for _, test := range tests {
+		sel, err := ParseSelector(test.expr)
+		if err != nil {
+			t.Fatalf("Expected nil parsing %q, but got %v.", test.expr, err)
+		}
+		if got := sel.String(); got != test.want {
+			t.Fatalf("Expected %q parsing %q, but got %q.",
+				test.want, test.expr, got)
+		}
+	}
+}
+
+func TestParseSelectorBad(t *testing.T) {
+	bad := []string{
+		"zone=us-east,",
+		"=us-east",
+		"version in v2",
+		"version in (v2,(v3))",
+		"version in (v2",
+		"version in ()",
+		"zone>us-east",
+		"zone=us east",
+	}
+	for _, expr := range bad {
+		if _, err := ParseSelector(expr); err == nil {
+			t.Fatalf("Expected error parsing %q, but got nil.", expr)
+		}
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	labels := map[string]string{
+		"zone":    "us-east",
+		"version": "v2",
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"", true},
+		{"zone=us-east", true},
+		{"zone=us-west", false},
+		{"zone!=us-west", true},
+		{"region!=us", true},
+		{"version in (v2,v3)", true},
+		{"version in (v3)", false},
+		{"version notin (v1)", true},
+		{"region notin (us)", true},
+		{"zone", true},
+		{"region", false},
+		{"!canary", true},
+		{"!zone", false},
+		{"zone=us-east,version in (v2,v3),!canary", true},
+		{"zone=us-east,version in (v3),!canary", false},
+	}
+	for _, test := range tests {
+		sel := MustParseSelector(test.expr)
+		if got := sel.Matches(labels); got != test.want {
+			t.Fatalf("Expected %v matching %q against %v, but got %v.",
+				test.want, test.expr, labels, got)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package gsr
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrServiceNotFound    = errors.New("service not found")
+	ErrInvalidServiceName = errors.New("invalid service name")
+)
+
+// Returns an error if the supplied service name cannot be used as a single
+// segment of an etcd key.
+func validateServiceName(name string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return ErrInvalidServiceName
+	}
+	return nil
+}
+
+// DefineService creates or replaces the definition of a service in the gsr
+// registry. Unlike endpoints, service definitions are not attached to a lease
+// and remain in the registry until they are removed, so that discovery clients
+// can learn about a service before any of its endpoints exist.
+func (r *Registry) DefineService(svc *Service) error {
+	if err := validateServiceName(svc.Name); err != nil {
+		return err
+	}
+	val, err := json.Marshal(svc)
+	if err != nil {
+		return err
+	}
+	b := r.backend
+
+	r.L2("writing definition for service %s", svc.Name)
+
+	skey := r.serviceKey(svc.Name)
+	ctx, cancel := r.requestCtx()
+	_, err = b.Put(ctx, skey, val, nil)
+	cancel()
+	if err != nil {
+		r.LERR("failed to write service definition for %s: %v",
+			svc.Name, err)
+		return err
+	}
+	return nil
+}
+
+// Service returns the definition of a service. If the service has not been
+// defined with DefineService(), ErrServiceNotFound is returned, even if the
+// service has registered endpoints.
+func (r *Registry) Service(name string) (*Service, error) {
+	if err := validateServiceName(name); err != nil {
+		return nil, err
+	}
+	b := r.backend
+	skey := r.serviceKey(name)
+	ctx, cancel := r.requestCtx()
+	resp, err := b.Get(ctx, skey, nil)
+	cancel()
+	if err != nil {
+		r.L2("error looking up service %s: %v", name, err)
+		return nil, err
+	}
+	if len(resp.KVs) == 0 {
+		return nil, ErrServiceNotFound
+	}
+	return decodeService(name, resp.KVs[0].Value)
+}
+
+// ServiceSummary describes a service known to the registry, either because it
+// has been defined with DefineService() or because it has registered endpoints.
+type ServiceSummary struct {
+	Name string
+	// Defined is true if the service has a definition in the registry.
+	Defined bool
+	// EndpointCount is the number of endpoints registered for the service,
+	// including any that are draining.
+	EndpointCount int
+}
+
+// ServiceSummaries returns a summary of every service in the registry, sorted
+// by name. Only keys are read from the backend, so this is cheap even for
+// large registries. Use Services() to read the full definitions of defined
+// services.
+func (r *Registry) ServiceSummaries() ([]*ServiceSummary, error) {
+	b := r.backend
+	ctx, cancel := r.requestCtx()
+	resp, err := b.Get(
+		ctx,
+		r.servicesKey(),
+		&GetOptions{Prefix: true, KeysOnly: true},
+	)
+	cancel()
+	if err != nil {
+		r.L2("error looking up services: %v", err)
+		return nil, err
+	}
+
+	// The keys for one service are not necessarily adjacent in key order:
+	// "web-2/..." sorts between "web" and "web/...", so group by name.
+	byName := make(map[string]*ServiceSummary, 0)
+	svcs := make([]*ServiceSummary, 0)
+	for _, kv := range resp.KVs {
+		name, endpoint := r.partsFromKey(kv.Key)
+		cur, found := byName[name]
+		if !found {
+			cur = &ServiceSummary{Name: name}
+			byName[name] = cur
+			svcs = append(svcs, cur)
+		}
+		if endpoint == "" {
+			cur.Defined = true
+		} else {
+			cur.EndpointCount++
+		}
+	}
+	sort.Slice(svcs, func(i, j int) bool {
+		return svcs[i].Name < svcs[j].Name
+	})
+	return svcs, nil
+}
+
+// Services returns the definitions of all services that have been defined with
+// DefineService(), sorted by name.
+func (r *Registry) Services() ([]*Service, error) {
+	b := r.backend
+	ctx, cancel := r.requestCtx()
+	resp, err := b.Get(ctx, r.servicesKey(), &GetOptions{Prefix: true})
+	cancel()
+	if err != nil {
+		r.L2("error looking up service definitions: %v", err)
+		return nil, err
+	}
+
+	svcs := make([]*Service, 0)
+	for _, kv := range resp.KVs {
+		name, endpoint := r.partsFromKey(kv.Key)
+		if endpoint != "" {
+			continue
+		}
+		svc, err := decodeService(name, kv.Value)
+		if err != nil {
+			r.LERR("failed to decode definition for service %s: %v",
+				name, err)
+			continue
+		}
+		svcs = append(svcs, svc)
+	}
+	return svcs, nil
+}
+
+// Decodes a service definition read from the registry. The service name is always
+// taken from the key rather than the stored value.
+func decodeService(name string, val []byte) (*Service, error) {
+	svc := &Service{}
+	if err := json.Unmarshal(val, svc); err != nil {
+		return nil, err
+	}
+	svc.Name = name
+	return svc, nil
+}
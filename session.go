@@ -0,0 +1,201 @@
+package gsr
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"go.etcd.io/etcd/clientv3/concurrency"
+	"golang.org/x/net/context"
+)
+
+// Every endpoint registered through a connection to the registry, whatever its
+// service or namespace, is attached to a single session lease. The endpoints
+// of a process therefore expire together, and the backend only has to track
+// one lease and one keepalive stream per process.
+type session struct {
+	sync.Mutex
+	// owner identifies this process. It is recorded in every endpoint
+	// registered through the session.
+	owner     Owner
+	lease     LeaseID
+	heartbeat *Heartbeat
+	cancel    context.CancelFunc
+	// cs is the etcd session used for elections and locks. It is attached to
+	// the session lease.
+	cs *concurrency.Session
+	// granted is when the session lease was granted
+	granted time.Time
+	// reregistering is true while endpoints are being registered again
+	// after the session lease was lost, and lost is set when it is lost
+	// again in the meantime
+	reregistering bool
+	lost          bool
+	// retry spaces out attempts to register the endpoints again. It is only
+	// reset once a session lease has lasted for its TTL, so that a backend
+	// which keeps losing leases is not retried in a tight loop.
+	retry *backoff.ExponentialBackOff
+	// ctx is done once the Registry is closed, which stops endpoints from
+	// being registered again
+	ctx  context.Context
+	stop context.CancelFunc
+}
+
+func newSession(owner Owner) *session {
+	ctx, cancel := context.WithCancel(context.Background())
+	retry := backoff.NewExponentialBackOff()
+	retry.InitialInterval = watchRetryInterval
+	retry.MaxInterval = watchRetryMaxInterval
+	retry.MaxElapsedTime = 0
+	return &session{owner: owner, retry: retry, ctx: ctx, stop: cancel}
+}
+
+// Returns the ID of the Registry's session lease, granting the lease and
+// starting its heartbeat if this has not yet been done.
+func (r *Registry) sessionLease() (LeaseID, error) {
+	s := r.session
+	s.Lock()
+	defer s.Unlock()
+	if s.lease != NoLease {
+		return s.lease, nil
+	}
+
+	b := r.backend
+	ctx, cancel := r.requestCtx()
+	lease, err := b.Grant(ctx, r.config.LeaseSeconds)
+	cancel()
+	if err != nil {
+		r.LERR("failed to grant lease: %v", err)
+		return NoLease, err
+	}
+
+	kaCtx, kaCancel := context.WithCancel(context.Background())
+	ch, err := b.KeepAlive(kaCtx, lease)
+	if err != nil {
+		kaCancel()
+		r.LERR("failed to start heartbeat for lease %x: %v", lease, err)
+		return NoLease, err
+	}
+	s.lease = lease
+	s.granted = time.Now()
+	s.heartbeat = &Heartbeat{ka: ch}
+	s.cancel = kaCancel
+	go r.handleHeartbeat(lease, ch)
+	r.L2("started heartbeat channel for session lease %x", lease)
+	return s.lease, nil
+}
+
+// Reads keepalive responses for the session lease until the heartbeat stops,
+// either because the session was revoked or because the lease could not be
+// kept alive. In the latter case, the endpoints attached to the lease are
+// registered again under a new session lease.
+func (r *Registry) handleHeartbeat(
+	lease LeaseID,
+	ch <-chan struct{},
+) {
+	for range ch {
+	}
+	s := r.session
+	s.Lock()
+	if s.lease != lease || s.ctx.Err() != nil {
+		s.Unlock()
+		return
+	}
+	r.LERR("heartbeat for session lease %x stopped. registering its "+
+		"endpoints again.", lease)
+	lived := time.Since(s.granted)
+	if lived >= time.Duration(r.config.LeaseSeconds)*time.Second {
+		s.retry.Reset()
+	}
+	s.reset()
+	s.lost = true
+	running := s.reregistering
+	s.reregistering = true
+	s.Unlock()
+
+	// Revoke the lease in case it has not expired yet, so that its entries
+	// are not mistaken for those of another live process
+	b := r.backend
+	ctx, cancel := r.requestCtx()
+	if err := b.Revoke(ctx, lease); err != nil && err != ErrLeaseNotFound {
+		r.L2("failed to revoke lost session lease %x: %v", lease, err)
+	}
+	cancel()
+	if !running {
+		r.reregister()
+	}
+}
+
+// Registers the endpoints registered through every namespace handle of the
+// Registry again, after the session lease they were attached to was lost.
+// Failed registrations, and registrations under a session lease that was lost
+// in turn, are retried until they succeed or the Registry is closed.
+func (r *Registry) reregister() {
+	s := r.session
+	for {
+		s.Lock()
+		s.lost = false
+		wait := s.retry.NextBackOff()
+		s.Unlock()
+		if !sleepCtx(s.ctx, wait) {
+			s.Lock()
+			s.reregistering = false
+			s.Unlock()
+			return
+		}
+		failed := 0
+		for _, h := range r.namespaceHandles() {
+			for _, ep := range h.registeredEndpoints() {
+				if _, err := h.Claim(ep); err != nil {
+					r.LERR("failed to register %s:%s again: %v",
+						ep.Service.Name, ep.Address, err)
+					failed++
+				}
+			}
+		}
+		s.Lock()
+		if failed == 0 && !s.lost {
+			s.reregistering = false
+			s.Unlock()
+			return
+		}
+		s.Unlock()
+	}
+}
+
+// Stops the session's heartbeats and forgets its lease. The caller must hold
+// the session's lock.
+func (s *session) reset() {
+	s.cancel()
+	if s.cs != nil {
+		s.cs.Orphan()
+	}
+	s.lease = NoLease
+	s.heartbeat = nil
+	s.cancel = nil
+	s.cs = nil
+}
+
+// Stops the heartbeat of the Registry's session lease and revokes it, which
+// removes every endpoint still attached to it from the registry.
+func (r *Registry) revokeSession() error {
+	s := r.session
+	s.Lock()
+	defer s.Unlock()
+	if s.lease == NoLease {
+		return nil
+	}
+	lease := s.lease
+	s.reset()
+
+	b := r.backend
+	ctx, cancel := r.requestCtx()
+	err := b.Revoke(ctx, lease)
+	cancel()
+	if err != nil {
+		r.LERR("failed to revoke session lease %x: %v", lease, err)
+		return err
+	}
+	r.L2("revoked session lease %x", lease)
+	return nil
+}
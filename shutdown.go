@@ -0,0 +1,114 @@
+package gsr
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// SignalOptions controls the shutdown sequence run by Registry.HandleSignals.
+type SignalOptions struct {
+	// Signals that trigger the shutdown sequence. If empty, SIGTERM and
+	// SIGINT are used.
+	Signals []os.Signal
+	// GracePeriod is how long to wait after marking endpoints as draining
+	// before unregistering them, giving other services time to stop routing
+	// traffic to them. If zero, the GSR_DRAIN_GRACE_SECONDS setting is used.
+	GracePeriod time.Duration
+	// OnDrain, if set, is called once all endpoints have been marked as
+	// draining, before the grace period starts.
+	OnDrain func() error
+	// BeforeUnregister, if set, is called after the grace period and before
+	// endpoints are unregistered. This is typically where the caller shuts
+	// down its http.Server.
+	BeforeUnregister func() error
+}
+
+// HandleSignals blocks until one of the configured signals is received or the
+// supplied context is done, and then gracefully removes the supplied endpoints
+// from the registry:
+//
+//  1. each endpoint is marked as draining
+//  2. the OnDrain hook is called
+//  3. the grace period elapses, so watchers stop routing to the endpoints.
+//     The grace period is cut short when another of the signals is received,
+//     or, if the shutdown was started by a signal, once the supplied context
+//     is done. A shutdown started by the context always waits for the whole
+//     grace period.
+//  4. the BeforeUnregister hook is called
+//  5. each endpoint is unregistered
+//  6. the Registry's session lease is revoked and the connection to the
+//     registry is closed
+//
+// Every step is attempted even if an earlier one fails. The first error
+// encountered is returned.
+func (r *Registry) HandleSignals(
+	ctx context.Context,
+	eps []*Endpoint,
+	opts *SignalOptions,
+) error {
+	if opts == nil {
+		opts = &SignalOptions{}
+	}
+	sigs := opts.Signals
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGTERM, syscall.SIGINT}
+	}
+	grace := opts.GracePeriod
+	if grace == 0 {
+		grace = r.config.DrainGraceSeconds
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, sigs...)
+	defer signal.Stop(sigCh)
+
+	// abort cuts the grace period short. It is the supplied context, unless
+	// the context is what started the shutdown.
+	abort := ctx.Done()
+	select {
+	case sig := <-sigCh:
+		r.L1("received %s. draining %d endpoints.", sig, len(eps))
+	case <-ctx.Done():
+		r.L1("context done: %v. draining %d endpoints.", ctx.Err(), len(eps))
+		abort = nil
+	}
+
+	var firstErr error
+	record := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	for _, ep := range eps {
+		record(r.Drain(ep))
+	}
+	if opts.OnDrain != nil {
+		record(opts.OnDrain())
+	}
+
+	r.L2("waiting %s for watchers to stop routing to drained endpoints",
+		grace.String())
+	select {
+	case <-time.After(grace):
+	case sig := <-sigCh:
+		r.L2("received %s. skipping the rest of the grace period.", sig)
+	case <-abort:
+		r.L2("context done: %v. skipping the rest of the grace period.",
+			ctx.Err())
+	}
+
+	if opts.BeforeUnregister != nil {
+		record(opts.BeforeUnregister())
+	}
+	for _, ep := range eps {
+		record(r.Unregister(ep))
+	}
+	record(r.revokeSession())
+	record(r.Close())
+	return firstErr
+}
@@ -0,0 +1,472 @@
+package gsr
+
+// A snapshot is a document describing everything a Registry's namespace holds
+// at a single etcd revision: service definitions, endpoints with their
+// metadata, and configuration documents (including feature flags). Snapshots
+// can be written as JSON or YAML and loaded into another registry with
+// Import(), e.g. to seed a test environment or to attach the state of the
+// registry to an incident report.
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// SnapshotVersion is the version of the snapshot document format written by
+// Snapshot(). Import() rejects documents of any other version.
+const SnapshotVersion = 1
+
+var (
+	ErrSnapshotVersion = errors.New("unsupported snapshot version")
+)
+
+type SnapshotFormat string
+
+const (
+	SnapshotJSON SnapshotFormat = "json"
+	SnapshotYAML SnapshotFormat = "yaml"
+)
+
+// Snapshot is the state of a Registry's namespace at a single etcd revision.
+type Snapshot struct {
+	Version int `json:"version"`
+	// Revision is the etcd revision the snapshot was read at.
+	Revision int64 `json:"revision"`
+	// Namespace is the namespace the snapshot was read from. It is
+	// informational only: Import() loads a snapshot into the namespace of the
+	// Registry it is called on.
+	Namespace string             `json:"namespace,omitempty"`
+	Services  []*SnapshotService `json:"services"`
+}
+
+// SnapshotService holds everything a snapshot records about one service.
+type SnapshotService struct {
+	Name string `json:"name"`
+	// Definition is nil if the service was never defined with
+	// DefineService().
+	Definition *Service            `json:"definition,omitempty"`
+	Endpoints  []*SnapshotEndpoint `json:"endpoints,omitempty"`
+	// Config holds the service's configuration documents, keyed by name.
+	Config map[string]json.RawMessage `json:"config,omitempty"`
+}
+
+// SnapshotEndpoint is an endpoint recorded in a snapshot.
+type SnapshotEndpoint struct {
+	Address  string            `json:"address"`
+	Draining bool              `json:"draining,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Owner    *Owner            `json:"owner,omitempty"`
+}
+
+// Snapshot reads the state of the Registry's namespace at a single
+// revision.
+func (r *Registry) Snapshot() (*Snapshot, error) {
+	snap, _, err := r.snapshot()
+	return snap, err
+}
+
+// Reads a snapshot of the Registry's namespace, along with the keys it was
+// read from, indexed by key.
+func (r *Registry) snapshot() (*Snapshot, map[string]*KeyValue, error) {
+	b := r.backend
+	ctx, cancel := r.requestCtx()
+	defer cancel()
+
+	// Services and configuration are read together so that the snapshot is
+	// consistent on backends that cannot read at a past revision.
+	resp, err := b.Get(ctx, r.namespaceKey(), &GetOptions{Prefix: true})
+	if err != nil {
+		r.LERR("failed to read namespace for snapshot: %v", err)
+		return nil, nil, err
+	}
+	rev := resp.Revision
+	kvs := make(map[string]*KeyValue, len(resp.KVs))
+	sprefix := r.servicesKey()
+	cprefix := r.namespaceKey() + "config/"
+	skvs := make([]*KeyValue, 0, len(resp.KVs))
+	ckvs := make([]*KeyValue, 0)
+	for _, kv := range resp.KVs {
+		kvs[kv.Key] = kv
+		switch {
+		case strings.HasPrefix(kv.Key, sprefix):
+			skvs = append(skvs, kv)
+		case strings.HasPrefix(kv.Key, cprefix):
+			ckvs = append(ckvs, kv)
+		}
+	}
+
+	byName := make(map[string]*SnapshotService, 0)
+	service := func(name string) *SnapshotService {
+		svc, found := byName[name]
+		if !found {
+			svc = &SnapshotService{Name: name}
+			byName[name] = svc
+		}
+		return svc
+	}
+	for _, kv := range skvs {
+		name, addr := r.partsFromKey(kv.Key)
+		svc := service(name)
+		if addr == "" {
+			def, err := decodeService(name, kv.Value)
+			if err != nil {
+				r.LERR("failed to decode service definition %s: %v",
+					name, err)
+				return nil, nil, err
+			}
+			svc.Definition = def
+			continue
+		}
+		ep := &Endpoint{Service: &Service{Name: name}, Address: addr}
+		if err := ep.setValue(kv.Value); err != nil {
+			r.LERR("failed to decode registry entry for %s:%s: %v",
+				name, addr, err)
+			return nil, nil, err
+		}
+		svc.Endpoints = append(svc.Endpoints, &SnapshotEndpoint{
+			Address:  addr,
+			Draining: ep.Draining,
+			Labels:   ep.Labels,
+			Owner:    ep.Owner,
+		})
+	}
+	for _, kv := range ckvs {
+		parts := strings.SplitN(kv.Key[len(cprefix):], "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		svc := service(parts[0])
+		if svc.Config == nil {
+			svc.Config = make(map[string]json.RawMessage, 0)
+		}
+		svc.Config[parts[1]] = json.RawMessage(kv.Value)
+	}
+
+	snap := &Snapshot{
+		Version:   SnapshotVersion,
+		Revision:  rev,
+		Namespace: r.namespace,
+		Services:  make([]*SnapshotService, 0, len(byName)),
+	}
+	for _, svc := range byName {
+		sort.Slice(svc.Endpoints, func(i, j int) bool {
+			return svc.Endpoints[i].Address < svc.Endpoints[j].Address
+		})
+		snap.Services = append(snap.Services, svc)
+	}
+	sort.Slice(snap.Services, func(i, j int) bool {
+		return snap.Services[i].Name < snap.Services[j].Name
+	})
+	return snap, kvs, nil
+}
+
+// Encode writes the snapshot to the supplied writer in the supplied format.
+func (s *Snapshot) Encode(w io.Writer, format SnapshotFormat) error {
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	switch format {
+	case SnapshotJSON:
+		_, err = w.Write(append(b, '\n'))
+		return err
+	case SnapshotYAML:
+		// YAML is a superset of JSON, so the JSON encoding is re-read as YAML,
+		// which keeps the two formats' field names and structure identical.
+		ms := yaml.MapSlice{}
+		if err = yaml.Unmarshal(b, &ms); err != nil {
+			return err
+		}
+		if b, err = yaml.Marshal(ms); err != nil {
+			return err
+		}
+		_, err = w.Write(b)
+		return err
+	}
+	return fmt.Errorf("unknown snapshot format %q", format)
+}
+
+// DecodeSnapshot reads a snapshot in the supplied format from the supplied
+// reader.
+func DecodeSnapshot(rd io.Reader, format SnapshotFormat) (*Snapshot, error) {
+	b, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case SnapshotJSON:
+	case SnapshotYAML:
+		var doc interface{}
+		if err = yaml.Unmarshal(b, &doc); err != nil {
+			return nil, err
+		}
+		if b, err = json.Marshal(jsonCompatible(doc)); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown snapshot format %q", format)
+	}
+	s := &Snapshot{}
+	if err = json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	if s.Version != SnapshotVersion {
+		return nil, ErrSnapshotVersion
+	}
+	return s, nil
+}
+
+// Converts the maps decoded by the yaml package, which have interface{} keys,
+// into maps that can be encoded as JSON.
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprintf("%v", k)] = jsonCompatible(val)
+		}
+		return m
+	case []interface{}:
+		for x, val := range v {
+			v[x] = jsonCompatible(val)
+		}
+	}
+	return v
+}
+
+type ChangeType string
+
+const (
+	ChangeAdd    ChangeType = "add"
+	ChangeUpdate ChangeType = "update"
+	ChangeDelete ChangeType = "delete"
+)
+
+// Change is a single difference between a snapshot and the registry, as
+// reported by Import().
+type Change struct {
+	Type ChangeType
+	// Kind is one of "service", "endpoint" or "config".
+	Kind    string
+	Service string
+	// Name is the address of an endpoint or the name of a configuration
+	// document. It is empty for a service definition.
+	Name string
+}
+
+func (c *Change) String() string {
+	s := string(c.Type) + " " + c.Kind + " " + c.Service
+	if c.Name != "" {
+		s += "/" + c.Name
+	}
+	return s
+}
+
+// ImportOptions controls how Import() loads a snapshot.
+type ImportOptions struct {
+	// DryRun reports the changes that would be made without making them.
+	DryRun bool
+	// Prune deletes service definitions, endpoints and configuration
+	// documents that are not in the snapshot. Without it, they are left
+	// alone.
+	Prune bool
+}
+
+// An entry of a snapshot flattened to the etcd key it is stored at.
+type snapshotEntry struct {
+	change Change
+	value  string
+}
+
+// Flattens a snapshot into the keys and values it is stored as beneath the
+// supplied namespace key (see Registry.namespaceKey()).
+func snapshotEntries(
+	nsKey string,
+	s *Snapshot,
+) (map[string]*snapshotEntry, error) {
+	entries := make(map[string]*snapshotEntry, 0)
+	for _, svc := range s.Services {
+		if err := validateServiceName(svc.Name); err != nil {
+			return nil, fmt.Errorf("invalid service name %q", svc.Name)
+		}
+		skey := nsKey + "services/" + svc.Name
+		if svc.Definition != nil {
+			def := *svc.Definition
+			def.Name = svc.Name
+			val, err := json.Marshal(&def)
+			if err != nil {
+				return nil, err
+			}
+			entries[skey] = &snapshotEntry{
+				change: Change{Kind: "service", Service: svc.Name},
+				value:  string(val),
+			}
+		}
+		for _, sep := range svc.Endpoints {
+			if _, err := ParseAddress(sep.Address); err != nil {
+				return nil, err
+			}
+			ep := &Endpoint{
+				Draining: sep.Draining,
+				Labels:   sep.Labels,
+				Owner:    sep.Owner,
+			}
+			ekey := skey + "/" + escapeKeySegment(sep.Address)
+			entries[ekey] = &snapshotEntry{
+				change: Change{
+					Kind:    "endpoint",
+					Service: svc.Name,
+					Name:    sep.Address,
+				},
+				value: ep.value(),
+			}
+		}
+		cprefix := nsKey + "config/" + svc.Name + "/"
+		for name, doc := range svc.Config {
+			if err := validateConfigName(name); err != nil {
+				return nil, fmt.Errorf("invalid config name %q", name)
+			}
+			buf := &bytes.Buffer{}
+			if err := json.Compact(buf, doc); err != nil {
+				return nil, err
+			}
+			entries[cprefix+name] = &snapshotEntry{
+				change: Change{
+					Kind:    "config",
+					Service: svc.Name,
+					Name:    name,
+				},
+				value: buf.String(),
+			}
+		}
+	}
+	return entries, nil
+}
+
+// Import loads a snapshot into the Registry's namespace and returns the
+// changes it made, sorted by key. Entries in the snapshot are created or
+// overwritten. With opts.Prune, entries that are not in the snapshot are
+// deleted. With opts.DryRun, the changes are returned but not made.
+//
+// Endpoints the snapshot adds are not attached to a lease: they remain in the
+// registry until they are removed, e.g. with ForceUnregister() or by importing
+// another snapshot with opts.Prune. Endpoints that already exist keep the
+// lease they are attached to.
+//
+// Each change is only made if the entry has not changed since the registry
+// was compared with the snapshot. Otherwise, the import stops and ErrConflict
+// is returned along with the changes made so far.
+//
+// A Registry using the file backend is loaded from its file, which should be
+// edited instead: Import returns ErrNotSupported with it.
+func (r *Registry) Import(s *Snapshot, opts *ImportOptions) ([]*Change, error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	if _, ok := r.backend.(*fileBackend); ok {
+		return nil, ErrNotSupported
+	}
+	if s.Version != SnapshotVersion {
+		return nil, ErrSnapshotVersion
+	}
+	want, err := snapshotEntries(r.namespaceKey(), s)
+	if err != nil {
+		return nil, err
+	}
+	cur, kvs, err := r.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	have, err := snapshotEntries(r.namespaceKey(), cur)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(want)+len(have))
+	for key := range want {
+		keys = append(keys, key)
+	}
+	for key := range have {
+		if _, found := want[key]; !found {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	changes := make([]*Change, 0)
+	// changed holds the key of each change
+	changed := make([]string, 0)
+	for _, key := range keys {
+		w, h := want[key], have[key]
+		switch {
+		case h == nil:
+			ch := w.change
+			ch.Type = ChangeAdd
+			changes = append(changes, &ch)
+			changed = append(changed, key)
+		case w == nil:
+			if !opts.Prune {
+				continue
+			}
+			ch := h.change
+			ch.Type = ChangeDelete
+			changes = append(changes, &ch)
+			changed = append(changed, key)
+		case w.value != h.value:
+			ch := w.change
+			ch.Type = ChangeUpdate
+			changes = append(changes, &ch)
+			changed = append(changed, key)
+		}
+	}
+	if opts.DryRun {
+		return changes, nil
+	}
+
+	b := r.backend
+	for x, ch := range changes {
+		key := changed[x]
+		// Ensure nobody else has written to the key since we read it
+		cond := Condition{Key: key, Target: CompareVersion, Op: "=", Value: 0}
+		if kv := kvs[key]; kv != nil {
+			cond = Condition{
+				Key: key, Target: CompareModRevision, Op: "=",
+				Value: kv.ModRevision,
+			}
+		}
+		ctx, cancel := r.requestCtx()
+		switch ch.Type {
+		case ChangeDelete:
+			_, err = b.Delete(ctx, key, &DeleteOptions{If: []Condition{cond}})
+		case ChangeUpdate:
+			_, err = b.Put(ctx, key, []byte(want[key].value), &PutOptions{
+				IgnoreLease: true,
+				If:          []Condition{cond},
+			})
+		default:
+			_, err = b.Put(ctx, key, []byte(want[key].value), &PutOptions{
+				If: []Condition{cond},
+			})
+		}
+		cancel()
+		if err == ErrCompareFailed {
+			r.L2("concurrent write detected to key %v.", key)
+			return changes[:x], ErrConflict
+		}
+		if err != nil {
+			r.LERR("failed to import %s: %v", changes[x], err)
+			return changes[:x], err
+		}
+	}
+	r.L1("imported snapshot of revision %d with %d changes",
+		s.Revision, len(changes))
+	return changes, nil
+}
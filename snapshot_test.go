@@ -0,0 +1,125 @@
+package gsr
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func testSnapshot() *Snapshot {
+	return &Snapshot{
+		Version:  SnapshotVersion,
+		Revision: 42,
+		Services: []*SnapshotService{
+			{
+				Name: "web",
+				Definition: &Service{
+					Name:        "web",
+					Description: "front end",
+					DefaultPort: 80,
+					Tags:        []string{"public"},
+				},
+				Endpoints: []*SnapshotEndpoint{
+					{
+						Address: "10.0.0.1:80",
+						Labels:  map[string]string{"zone": "a"},
+						Owner:   &Owner{InstanceID: "abc", PID: 7},
+					},
+					{Address: "10.0.0.2:80", Draining: true},
+				},
+				Config: map[string]json.RawMessage{
+					"limits": json.RawMessage(`{"max_conns":100,"mode":"yes"}`),
+				},
+			},
+		},
+	}
+}
+
+func TestSnapshotEncodeDecode(t *testing.T) {
+	for _, format := range []SnapshotFormat{SnapshotJSON, SnapshotYAML} {
+		buf := &bytes.Buffer{}
+		if err := testSnapshot().Encode(buf, format); err != nil {
+			t.Fatalf("Expected nil, but got %v.", err)
+		}
+		got, err := DecodeSnapshot(buf, format)
+		if err != nil {
+			t.Fatalf("Expected nil decoding %s, but got %v.", format, err)
+		}
+
+		// Config documents are compared by value, since their formatting
+		// changes with the format of the snapshot
+		var expDoc, gotDoc interface{}
+		json.Unmarshal(testSnapshot().Services[0].Config["limits"], &expDoc)
+		json.Unmarshal(got.Services[0].Config["limits"], &gotDoc)
+		if !reflect.DeepEqual(expDoc, gotDoc) {
+			t.Fatalf("Expected %v, but got %v in %s.", expDoc, gotDoc, format)
+		}
+		got.Services[0].Config = nil
+		exp := testSnapshot()
+		exp.Services[0].Config = nil
+		if !reflect.DeepEqual(exp, got) {
+			t.Fatalf("Expected %+v, but got %+v in %s.", exp, got, format)
+		}
+	}
+}
+
+func TestSnapshotDecodeVersion(t *testing.T) {
+	_, err := DecodeSnapshot(
+		strings.NewReader(`{"version": 2, "services": []}`), SnapshotJSON,
+	)
+	if err != ErrSnapshotVersion {
+		t.Fatalf("Expected ErrSnapshotVersion, but got %v.", err)
+	}
+	_, err = DecodeSnapshot(strings.NewReader("version: 1\n"), "xml")
+	if err == nil {
+		t.Fatalf("Expected an error for an unknown format, but got nil.")
+	}
+}
+
+func TestSnapshotImportKeepsLease(t *testing.T) {
+	factory, stop := MemBackendFactory()
+	defer stop()
+	r, err := NewWithBackend(factory(t))
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer r.Close()
+
+	ep := Endpoint{
+		Service: &Service{Name: "web"},
+		Address: "192.168.1.41",
+	}
+	if err = r.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	snap, err := r.Snapshot()
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	snap.Services[0].Endpoints[0].Labels = map[string]string{"version": "v2"}
+
+	changes, err := r.Import(snap, nil)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if len(changes) != 1 || changes[0].Type != ChangeUpdate {
+		t.Fatalf("Expected 1 update, but got %v.", changes)
+	}
+
+	// The live endpoint stays attached to the lease it was registered with
+	ctx, cancel := r.requestCtx()
+	defer cancel()
+	resp, err := r.backend.Get(ctx, r.endpointKey("web", ep.Address), nil)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if len(resp.KVs) != 1 || resp.KVs[0].Lease != ep.lease {
+		t.Fatalf("Expected lease %x, but got %v.", ep.lease, resp.KVs)
+	}
+	eps := r.Endpoints("web")
+	if len(eps) != 1 || eps[0].Labels["version"] != "v2" {
+		t.Fatalf("Expected version v2, but got %v.", eps)
+	}
+}
@@ -17,3 +17,12 @@ func containsAll(all []string, in []*Endpoint) bool {
 	}
 	return true
 }
+
+func containsString(in []string, search string) bool {
+	for _, s := range in {
+		if s == search {
+			return true
+		}
+	}
+	return false
+}
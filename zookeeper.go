@@ -0,0 +1,946 @@
+package gsr
+
+// The zookeeper backend stores the registry in ZooKeeper:
+//
+//   GSR_BACKEND=zk://zk1:2181,zk2:2181,zk3:2181
+//
+// Each key is stored in the znode at its path, so "gsr/services/web/10.0.0.1:80"
+// is stored in /gsr/services/web/10.0.0.1:80. Znodes that exist only because
+// they are the parent of a key have no data and are not reported as keys.
+//
+// ZooKeeper sessions stand in for leases. Granting a lease opens a session of
+// its own, and keys attached to the lease are ephemeral znodes owned by that
+// session, so ZooKeeper removes them when the session ends, either because it
+// was revoked or because the process holding it went away for longer than its
+// TTL. The ZooKeeper client keeps sessions alive while it is connected, so,
+// as with etcd leases, the backend closes a lease's session itself when it is
+// not kept alive with KeepAlive() for its TTL.
+//
+// Zxids are used as revisions. ZooKeeper keeps no history of changes, so reads
+// and watches at a past revision fail as the Backend contract (see backend.go)
+// describes.
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+	"golang.org/x/net/context"
+)
+
+// The first byte of the data of every znode holding a key.
+const zkKeyMarker = byte('v')
+
+// zkConn is the part of the ZooKeeper client used by the zookeeper backend.
+type zkConn interface {
+	Get(path string) ([]byte, *zk.Stat, error)
+	GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error)
+	Children(path string) ([]string, *zk.Stat, error)
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	Exists(path string) (bool, *zk.Stat, error)
+	ExistsW(path string) (bool, *zk.Stat, <-chan zk.Event, error)
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Multi(ops ...interface{}) ([]zk.MultiResponse, error)
+	SessionID() int64
+	Close()
+}
+
+// zkDialer opens a ZooKeeper session with the supplied timeout.
+type zkDialer func(
+	servers []string,
+	timeout time.Duration,
+) (zkConn, <-chan zk.Event, error)
+
+// zkDial opens the sessions of zookeeper backends created by New.
+var zkDial zkDialer = dialZK
+
+func dialZK(
+	servers []string,
+	timeout time.Duration,
+) (zkConn, <-chan zk.Event, error) {
+	conn, events, err := zk.Connect(
+		servers, timeout, zk.WithLogger(zkNopLogger{}),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, events, nil
+}
+
+// The ZooKeeper client logs every connection attempt. gsr does its own
+// logging.
+type zkNopLogger struct{}
+
+func (zkNopLogger) Printf(string, ...interface{}) {}
+
+var errZKSessionExpired = errors.New("zk: session expired")
+
+// A ZooKeeper session, standing in for a lease.
+type zkSession struct {
+	conn zkConn
+	ttl  int64
+	// done is closed when the session ends
+	done chan struct{}
+	quit chan struct{}
+	once sync.Once
+	// mu protects timer, which closes the session when it is not kept alive,
+	// and expires, the time at which it will
+	mu      sync.Mutex
+	timer   *time.Timer
+	expires time.Time
+}
+
+// Closes the session if it is not kept alive for its TTL from now.
+func (s *zkSession) refresh() {
+	ttl := time.Duration(s.ttl) * time.Second
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.timer == nil {
+		s.timer = time.AfterFunc(ttl, s.close)
+	} else {
+		s.timer.Reset(ttl)
+	}
+	s.expires = time.Now().Add(ttl)
+}
+
+// Returns the number of seconds left before the session is closed.
+func (s *zkSession) remaining() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ttl := int64(time.Until(s.expires).Seconds() + 0.5)
+	if ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+func (s *zkSession) close() {
+	s.once.Do(func() {
+		close(s.quit)
+		s.conn.Close()
+	})
+}
+
+type zkBackend struct {
+	servers []string
+	dial    zkDialer
+	main    *zkSession
+	conn    zkConn
+	// mu protects leases, which holds the sessions opened by Grant, and
+	// owners, which maps sessions of other processes to a znode they own
+	mu     sync.Mutex
+	leases map[LeaseID]*zkSession
+	owners map[LeaseID]string
+	closed chan struct{}
+}
+
+func newZKBackend(
+	servers []string,
+	cfg *Config,
+	dial zkDialer,
+) (*zkBackend, error) {
+	b := &zkBackend{
+		servers: servers,
+		dial:    dial,
+		leases:  make(map[LeaseID]*zkSession, 0),
+		owners:  make(map[LeaseID]string, 0),
+		closed:  make(chan struct{}),
+	}
+	ctx, cancel := context.WithTimeout(
+		context.Background(), cfg.EtcdConnectTimeoutSeconds,
+	)
+	defer cancel()
+	s, err := b.session(ctx, cfg.LeaseSeconds)
+	if err != nil {
+		return nil, err
+	}
+	b.main, b.conn = s, s.conn
+	return b, nil
+}
+
+// Opens a session and waits for ZooKeeper to establish it.
+func (b *zkBackend) session(
+	ctx context.Context,
+	ttl int64,
+) (*zkSession, error) {
+	conn, events, err := b.dial(b.servers, time.Duration(ttl)*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		select {
+		case ev := <-events:
+			if ev.State == zk.StateExpired || ev.State == zk.StateAuthFailed {
+				conn.Close()
+				return nil, errZKSessionExpired
+			}
+			if ev.State != zk.StateHasSession {
+				continue
+			}
+		case <-ctx.Done():
+			conn.Close()
+			return nil, ctx.Err()
+		}
+		break
+	}
+	s := &zkSession{
+		conn: conn,
+		ttl:  ttl,
+		done: make(chan struct{}),
+		quit: make(chan struct{}),
+	}
+	go func() {
+		defer close(s.done)
+		for {
+			select {
+			case ev := <-events:
+				if ev.State == zk.StateExpired {
+					return
+				}
+			case <-s.quit:
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+// Returns the znode path of a key.
+func zkPath(key string) string {
+	return "/" + strings.Trim(key, "/")
+}
+
+// Returns the key stored in a znode.
+func zkKey(path string) string {
+	return path[1:]
+}
+
+func zkJoin(dir string, name string) string {
+	if dir == "/" {
+		return "/" + name
+	}
+	return dir + "/" + name
+}
+
+// Returns the KeyValue a znode holds, or nil if it does not hold a key.
+func (b *zkBackend) toKeyValue(
+	path string,
+	data []byte,
+	stat *zk.Stat,
+) *KeyValue {
+	if stat == nil || len(data) == 0 || data[0] != zkKeyMarker {
+		return nil
+	}
+	kv := &KeyValue{
+		Key:            zkKey(path),
+		Value:          data[1:],
+		CreateRevision: stat.Czxid,
+		ModRevision:    stat.Mzxid,
+		// A key's znode is created empty and its value set afterwards, so
+		// its first value is version 1, as with etcd
+		Version: int64(stat.Version),
+		Lease:   LeaseID(stat.EphemeralOwner),
+	}
+	if kv.Lease != NoLease {
+		b.mu.Lock()
+		if _, mine := b.leases[kv.Lease]; !mine {
+			b.owners[kv.Lease] = path
+		}
+		b.mu.Unlock()
+	}
+	return kv
+}
+
+// The state of a key or prefix, as read by scan.
+type zkState struct {
+	kvs map[string]*KeyValue
+	// The latest zxid to change anything read
+	rev int64
+}
+
+func (s *zkState) note(stat *zk.Stat) {
+	if stat == nil {
+		return
+	}
+	for _, zxid := range []int64{stat.Mzxid, stat.Pzxid} {
+		if zxid > s.rev {
+			s.rev = zxid
+		}
+	}
+}
+
+// zkArmer sets watches on znodes as they are read. It is nil when scanning
+// without watches.
+type zkArmer interface {
+	get(path string) ([]byte, *zk.Stat, error)
+	children(path string) ([]string, *zk.Stat, error)
+	exists(path string) (bool, *zk.Stat, error)
+}
+
+// Reads a key, or every key beginning with it.
+func (b *zkBackend) scan(key string, prefix bool, w zkArmer) (*zkState, error) {
+	get, children, exists := b.conn.Get, b.conn.Children, b.conn.Exists
+	if w != nil {
+		get, children, exists = w.get, w.children, w.exists
+	}
+	st := &zkState{kvs: make(map[string]*KeyValue, 0)}
+
+	var walk func(path string) error
+	walk = func(path string) error {
+		data, stat, err := get(path)
+		if err == zk.ErrNoNode {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		st.note(stat)
+		if kv := b.toKeyValue(path, data, stat); kv != nil {
+			st.kvs[kv.Key] = kv
+		}
+		if stat.NumChildren == 0 && stat.EphemeralOwner != 0 {
+			// Ephemeral znodes cannot have children
+			return nil
+		}
+		names, _, err := children(path)
+		if err == zk.ErrNoNode {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if err = walk(zkJoin(path, name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !prefix {
+		found, stat, err := exists(zkPath(key))
+		if err != nil {
+			return nil, err
+		}
+		st.note(stat)
+		if !found {
+			return st, nil
+		}
+		data, stat, err := get(zkPath(key))
+		if err == zk.ErrNoNode {
+			return st, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		st.note(stat)
+		// Keys such as "a/" share a znode with "a", but are not "a"
+		kv := b.toKeyValue(zkPath(key), data, stat)
+		if kv != nil && kv.Key == key {
+			st.kvs[kv.Key] = kv
+		}
+		return st, nil
+	}
+
+	// A prefix such as "gsr/services/web" matches the children of
+	// /gsr/services whose names begin with "web", and everything beneath them
+	dir, partial := "/", key
+	if x := strings.LastIndex(key, "/"); x >= 0 {
+		dir, partial = zkPath(key[:x]), key[x+1:]
+	}
+	found, stat, err := exists(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		st.note(stat)
+		return st, nil
+	}
+	names, stat, err := children(dir)
+	if err == zk.ErrNoNode {
+		return st, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	st.note(stat)
+	for _, name := range names {
+		if !strings.HasPrefix(name, partial) ||
+			(dir == "/" && name == "zookeeper") {
+			continue
+		}
+		if err = walk(zkJoin(dir, name)); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+func (b *zkBackend) Get(
+	ctx context.Context,
+	key string,
+	opts *GetOptions,
+) (*GetResponse, error) {
+	if opts == nil {
+		opts = &GetOptions{}
+	}
+	st, err := b.scan(key, opts.Prefix, nil)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Revision != 0 && st.rev > opts.Revision {
+		return nil, ErrCompacted
+	}
+	res := &GetResponse{
+		KVs:      make([]*KeyValue, 0, len(st.kvs)),
+		Revision: st.rev,
+	}
+	for _, kv := range st.kvs {
+		if opts.KeysOnly {
+			kv.Value = nil
+		}
+		res.KVs = append(res.KVs, kv)
+	}
+	sort.Slice(res.KVs, func(i, j int) bool {
+		return res.KVs[i].Key < res.KVs[j].Key
+	})
+	return res, nil
+}
+
+// Creates the parents of a znode that do not exist yet.
+func (b *zkBackend) createParents(path string) error {
+	parts := strings.Split(path[1:], "/")
+	dir := ""
+	for _, part := range parts[:len(parts)-1] {
+		dir += "/" + part
+		_, err := b.conn.Create(dir, nil, 0, zk.WorldACL(zk.PermAll))
+		if err != nil && err != zk.ErrNodeExists {
+			return err
+		}
+	}
+	return nil
+}
+
+// Evaluates conditions against the current state of their keys and returns
+// operations that fail a multi if any of those keys change before it is
+// applied. ErrCompareFailed is returned if a condition does not hold.
+func (b *zkBackend) guard(conds []Condition) ([]interface{}, error) {
+	ops := make([]interface{}, 0, len(conds))
+	seen := make(map[string]bool, 0)
+	for _, c := range conds {
+		path := zkPath(c.Key)
+		data, stat, err := b.conn.Get(path)
+		if err != nil && err != zk.ErrNoNode {
+			return nil, err
+		}
+		if err == zk.ErrNoNode {
+			stat = nil
+		}
+		if !c.Holds(b.toKeyValue(path, data, stat)) {
+			return nil, ErrCompareFailed
+		}
+		if seen[path] {
+			continue
+		}
+		seen[path] = true
+		if stat != nil {
+			ops = append(ops, &zk.CheckVersionRequest{
+				Path:    path,
+				Version: stat.Version,
+			})
+			continue
+		}
+		// ZooKeeper cannot check that a znode does not exist, but creating
+		// and deleting it fails if it does
+		if err = b.createParents(path); err != nil {
+			return nil, err
+		}
+		ops = append(ops,
+			&zk.CreateRequest{Path: path, Acl: zk.WorldACL(zk.PermAll)},
+			&zk.DeleteRequest{Path: path, Version: 0},
+		)
+	}
+	return ops, nil
+}
+
+// Applies a multi, returning errZKConflict if it failed because a znode was
+// changed concurrently.
+func zkMulti(conn zkConn, ops []interface{}) ([]zk.MultiResponse, error) {
+	res, err := conn.Multi(ops...)
+	for _, r := range res {
+		if r.Error != nil {
+			err = r.Error
+			break
+		}
+	}
+	switch err {
+	case zk.ErrBadVersion, zk.ErrNodeExists, zk.ErrNoNode, zk.ErrNotEmpty:
+		return nil, errZKConflict
+	}
+	return res, err
+}
+
+var (
+	errZKConflict   = errors.New("zk: conflicting change")
+	errZKInvalidKey = errors.New("zk: key has no znode path of its own")
+)
+
+func (b *zkBackend) Put(
+	ctx context.Context,
+	key string,
+	val []byte,
+	opts *PutOptions,
+) (int64, error) {
+	if opts == nil {
+		opts = &PutOptions{}
+	}
+	if zkKey(zkPath(key)) != key {
+		return 0, errZKInvalidKey
+	}
+	conn := b.conn
+	var flags int32
+	if !opts.IgnoreLease && opts.Lease != NoLease {
+		b.mu.Lock()
+		l, found := b.leases[opts.Lease]
+		b.mu.Unlock()
+		if !found {
+			return 0, ErrLeaseNotFound
+		}
+		// Ephemeral znodes belong to the session that creates them
+		conn, flags = l.conn, zk.FlagEphemeral
+	}
+	path := zkPath(key)
+	data := append([]byte{zkKeyMarker}, val...)
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		if err := b.createParents(path); err != nil {
+			return 0, err
+		}
+		ops, err := b.guard(opts.If)
+		if err != nil {
+			return 0, err
+		}
+		_, stat, err := b.conn.Get(path)
+		if err != nil && err != zk.ErrNoNode {
+			return 0, err
+		}
+		if err == zk.ErrNoNode {
+			stat = nil
+		}
+		owned := stat != nil && (opts.IgnoreLease ||
+			(flags != 0 && stat.EphemeralOwner == conn.SessionID()) ||
+			(flags == 0 && stat.EphemeralOwner == 0))
+		switch {
+		case owned:
+			// The znode already belongs to the right session
+			ops = append(ops, &zk.SetDataRequest{
+				Path: path, Data: data, Version: stat.Version,
+			})
+		case stat != nil && stat.NumChildren > 0:
+			return 0, fmt.Errorf(
+				"zk: cannot attach %s to a lease: it has keys beneath it",
+				key,
+			)
+		case stat != nil:
+			// The owner of a znode cannot be changed, so it is replaced
+			ops = append(ops,
+				&zk.DeleteRequest{Path: path, Version: stat.Version},
+				&zk.CreateRequest{
+					Path: path, Flags: flags, Acl: zk.WorldACL(zk.PermAll),
+				},
+				&zk.SetDataRequest{Path: path, Data: data, Version: 0},
+			)
+		default:
+			ops = append(ops,
+				&zk.CreateRequest{
+					Path: path, Flags: flags, Acl: zk.WorldACL(zk.PermAll),
+				},
+				&zk.SetDataRequest{Path: path, Data: data, Version: 0},
+			)
+		}
+		res, err := zkMulti(conn, ops)
+		if err == errZKConflict {
+			if len(opts.If) > 0 {
+				return 0, ErrCompareFailed
+			}
+			// Somebody else wrote the key between reading and writing it
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		last := res[len(res)-1].Stat
+		if last == nil {
+			return 0, errZKConflict
+		}
+		return last.Mzxid, nil
+	}
+}
+
+func (b *zkBackend) Delete(
+	ctx context.Context,
+	key string,
+	opts *DeleteOptions,
+) (int64, error) {
+	if opts == nil {
+		opts = &DeleteOptions{}
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		ops, err := b.guard(opts.If)
+		if err != nil {
+			return 0, err
+		}
+		st, err := b.scan(key, opts.Prefix, nil)
+		if err != nil {
+			return 0, err
+		}
+		if len(st.kvs) == 0 {
+			return 0, nil
+		}
+		// Delete the deepest znodes first so their parents are empty
+		paths := make([]string, 0, len(st.kvs))
+		for k := range st.kvs {
+			paths = append(paths, zkPath(k))
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+		for _, path := range paths {
+			_, stat, err := b.conn.Exists(path)
+			if err != nil {
+				return 0, err
+			}
+			if stat == nil {
+				continue
+			}
+			if stat.NumChildren > 0 {
+				// Keep the znode for whatever is beneath it, but drop its
+				// value
+				ops = append(ops, &zk.SetDataRequest{
+					Path: path, Version: stat.Version,
+				})
+				continue
+			}
+			ops = append(ops, &zk.DeleteRequest{
+				Path: path, Version: stat.Version,
+			})
+		}
+		_, err = zkMulti(b.conn, ops)
+		if err == errZKConflict {
+			if len(opts.If) > 0 {
+				return 0, ErrCompareFailed
+			}
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		return int64(len(st.kvs)), nil
+	}
+}
+
+func (b *zkBackend) Grant(ctx context.Context, ttl int64) (LeaseID, error) {
+	// The lease is refreshed every third of its TTL, which has to be
+	// positive
+	if ttl <= 0 {
+		return NoLease, ErrInvalidTTL
+	}
+	s, err := b.session(ctx, ttl)
+	if err != nil {
+		return NoLease, err
+	}
+	lease := LeaseID(s.conn.SessionID())
+	s.refresh()
+	b.mu.Lock()
+	b.leases[lease] = s
+	b.mu.Unlock()
+	go func() {
+		select {
+		case <-s.done:
+		case <-b.closed:
+		}
+		b.mu.Lock()
+		delete(b.leases, lease)
+		b.mu.Unlock()
+		s.close()
+	}()
+	return lease, nil
+}
+
+// The ZooKeeper client keeps the session alive on its own while it is
+// connected, so keeping the lease alive only puts off the backend closing the
+// session. The returned channel is closed when the session ends.
+func (b *zkBackend) KeepAlive(
+	ctx context.Context,
+	lease LeaseID,
+) (<-chan struct{}, error) {
+	b.mu.Lock()
+	l, found := b.leases[lease]
+	b.mu.Unlock()
+	if !found {
+		return nil, ErrLeaseNotFound
+	}
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		t := time.NewTicker(time.Duration(l.ttl) * time.Second / 3)
+		defer t.Stop()
+		for {
+			l.refresh()
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+			select {
+			case <-t.C:
+			case <-l.done:
+				return
+			case <-ctx.Done():
+				return
+			case <-b.closed:
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (b *zkBackend) Revoke(ctx context.Context, lease LeaseID) error {
+	b.mu.Lock()
+	l, found := b.leases[lease]
+	delete(b.leases, lease)
+	b.mu.Unlock()
+	if !found {
+		return ErrLeaseNotFound
+	}
+	// Closing the session deletes its ephemeral znodes
+	l.close()
+	return nil
+}
+
+// ZooKeeper does not report the remaining TTL of a session, so sessions of
+// other processes are reported as having a full TTL left, and are known to be
+// alive as long as a znode they own still exists.
+func (b *zkBackend) TimeToLive(
+	ctx context.Context,
+	lease LeaseID,
+) (int64, int64, error) {
+	b.mu.Lock()
+	l, mine := b.leases[lease]
+	path, seen := b.owners[lease]
+	b.mu.Unlock()
+	if mine {
+		select {
+		case <-l.done:
+			return 0, 0, ErrLeaseNotFound
+		default:
+			return l.remaining(), l.ttl, nil
+		}
+	}
+	if seen {
+		_, stat, err := b.conn.Exists(path)
+		if err != nil {
+			return 0, 0, err
+		}
+		if stat != nil && LeaseID(stat.EphemeralOwner) == lease {
+			return b.main.ttl, b.main.ttl, nil
+		}
+		b.mu.Lock()
+		delete(b.owners, lease)
+		b.mu.Unlock()
+	}
+	return 0, 0, ErrLeaseNotFound
+}
+
+// zkWatches arms watches on the znodes read during a scan, and notifies when
+// any of them fires. A watch is only set again once it has fired.
+type zkWatches struct {
+	conn   zkConn
+	mu     sync.Mutex
+	armed  map[string]bool
+	notify chan struct{}
+	stop   chan struct{}
+}
+
+func (w *zkWatches) arm(kind string, path string, ch <-chan zk.Event) {
+	w.mu.Lock()
+	w.armed[kind+path] = true
+	w.mu.Unlock()
+	go func() {
+		select {
+		case <-ch:
+		case <-w.stop:
+			return
+		}
+		w.mu.Lock()
+		delete(w.armed, kind+path)
+		w.mu.Unlock()
+		select {
+		case w.notify <- struct{}{}:
+		default:
+		}
+	}()
+}
+
+func (w *zkWatches) isArmed(kind string, path string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.armed[kind+path]
+}
+
+func (w *zkWatches) get(path string) ([]byte, *zk.Stat, error) {
+	if w.isArmed("data", path) {
+		return w.conn.Get(path)
+	}
+	data, stat, ch, err := w.conn.GetW(path)
+	if err == nil {
+		w.arm("data", path, ch)
+	}
+	return data, stat, err
+}
+
+func (w *zkWatches) children(path string) ([]string, *zk.Stat, error) {
+	if w.isArmed("child", path) {
+		return w.conn.Children(path)
+	}
+	names, stat, ch, err := w.conn.ChildrenW(path)
+	if err == nil {
+		w.arm("child", path, ch)
+	}
+	return names, stat, err
+}
+
+func (w *zkWatches) exists(path string) (bool, *zk.Stat, error) {
+	if w.isArmed("exists", path) {
+		return w.conn.Exists(path)
+	}
+	found, stat, ch, err := w.conn.ExistsW(path)
+	if err == nil {
+		w.arm("exists", path, ch)
+	}
+	return found, stat, err
+}
+
+func (b *zkBackend) Watch(
+	ctx context.Context,
+	key string,
+	opts *WatchOptions,
+) <-chan *WatchResponse {
+	if opts == nil {
+		opts = &WatchOptions{}
+	}
+	ch := make(chan *WatchResponse)
+	w := &zkWatches{
+		conn:   b.conn,
+		armed:  make(map[string]bool, 0),
+		notify: make(chan struct{}, 1),
+		stop:   make(chan struct{}),
+	}
+	// The first scan is made before returning, so that changes made once
+	// Watch returns are seen by the watch
+	last, err := b.scan(key, opts.Prefix, w)
+	go b.watch(ctx, key, opts, w, last, err, ch)
+	return ch
+}
+
+// Scans a key or prefix each time a watch on it fires, starting from the
+// supplied scan, and sends the differences between successive scans as
+// events.
+func (b *zkBackend) watch(
+	ctx context.Context,
+	key string,
+	opts *WatchOptions,
+	w *zkWatches,
+	last *zkState,
+	err error,
+	ch chan<- *WatchResponse,
+) {
+	defer close(ch)
+	defer close(w.stop)
+	send := func(resp *WatchResponse) bool {
+		select {
+		case ch <- resp:
+			return true
+		case <-ctx.Done():
+			return false
+		case <-b.closed:
+			return false
+		}
+	}
+
+	if err != nil {
+		send(&WatchResponse{Err: err})
+		return
+	}
+	if opts.Revision != 0 && last.rev >= opts.Revision {
+		// See point 5 of the Backend contract
+		send(&WatchResponse{Err: ErrCompacted, Revision: last.rev})
+		return
+	}
+	for {
+		select {
+		case <-w.notify:
+		case <-ctx.Done():
+			return
+		case <-b.closed:
+			return
+		}
+		cur, err := b.scan(key, opts.Prefix, w)
+		if err != nil {
+			send(&WatchResponse{Err: err})
+			return
+		}
+		resp := &WatchResponse{Revision: cur.rev}
+		keys := make([]string, 0, len(cur.kvs))
+		for k := range cur.kvs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			kv := cur.kvs[k]
+			if prev, found := last.kvs[k]; found &&
+				prev.ModRevision == kv.ModRevision {
+				continue
+			}
+			resp.Events = append(resp.Events, &KVEvent{Type: KVPut, KV: kv})
+		}
+		keys = keys[:0]
+		for k := range last.kvs {
+			if _, found := cur.kvs[k]; !found {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			resp.Events = append(resp.Events, &KVEvent{
+				Type: KVDelete,
+				KV:   &KeyValue{Key: k, ModRevision: cur.rev},
+			})
+		}
+		last = cur
+		if len(resp.Events) > 0 && !send(resp) {
+			return
+		}
+	}
+}
+
+func (b *zkBackend) Close() error {
+	b.mu.Lock()
+	select {
+	case <-b.closed:
+		b.mu.Unlock()
+		return nil
+	default:
+		close(b.closed)
+	}
+	b.mu.Unlock()
+	b.main.close()
+	return nil
+}
@@ -0,0 +1,675 @@
+package gsr
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/samuel/go-zookeeper/zk"
+	"golang.org/x/net/context"
+)
+
+// fakeZK is an in-process ZooKeeper ensemble implementing what the zookeeper
+// backend uses: znodes, ephemeral znodes, multis, one-shot watches and
+// sessions.
+type fakeZK struct {
+	mu       sync.Mutex
+	zxid     int64
+	nextID   int64
+	nodes    map[string]*fakeZNode
+	sessions map[int64]*fakeZKConn
+	watches  map[string][]*fakeZKWatch
+}
+
+type fakeZNode struct {
+	data     []byte
+	stat     zk.Stat
+	children map[string]bool
+}
+
+type fakeZKWatch struct {
+	session int64
+	ch      chan zk.Event
+}
+
+func newFakeZK() *fakeZK {
+	return &fakeZK{
+		nodes: map[string]*fakeZNode{
+			"/": {children: map[string]bool{}},
+		},
+		sessions: make(map[int64]*fakeZKConn, 0),
+		watches:  make(map[string][]*fakeZKWatch, 0),
+	}
+}
+
+func (z *fakeZK) dial(
+	servers []string,
+	timeout time.Duration,
+) (zkConn, <-chan zk.Event, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.nextID++
+	c := &fakeZKConn{
+		z:      z,
+		id:     z.nextID << 32,
+		events: make(chan zk.Event, 8),
+	}
+	z.sessions[c.id] = c
+	c.events <- zk.Event{Type: zk.EventSession, State: zk.StateConnected}
+	c.events <- zk.Event{Type: zk.EventSession, State: zk.StateHasSession}
+	return c, c.events, nil
+}
+
+// Expires a session as the ensemble would when its client goes away.
+func (z *fakeZK) expire(id int64) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if c := z.endLocked(id); c != nil {
+		c.events <- zk.Event{Type: zk.EventSession, State: zk.StateExpired}
+	}
+}
+
+// Ends a session, deleting its ephemeral znodes. Must be called with z.mu
+// held.
+func (z *fakeZK) endLocked(id int64) *fakeZKConn {
+	c, found := z.sessions[id]
+	if !found {
+		return nil
+	}
+	delete(z.sessions, id)
+	ops := make([]interface{}, 0)
+	for path, n := range z.nodes {
+		if n.stat.EphemeralOwner == id {
+			ops = append(ops, &zk.DeleteRequest{Path: path, Version: -1})
+		}
+	}
+	if len(ops) > 0 {
+		z.multiLocked(id, ops)
+	}
+	for key, ws := range z.watches {
+		kept := ws[:0]
+		for _, w := range ws {
+			if w.session == id {
+				w.ch <- zk.Event{Type: zk.EventNotWatching, Err: zk.ErrClosing}
+				continue
+			}
+			kept = append(kept, w)
+		}
+		z.watches[key] = kept
+	}
+	return c
+}
+
+func (z *fakeZK) watch(id int64, kind string, path string) <-chan zk.Event {
+	w := &fakeZKWatch{session: id, ch: make(chan zk.Event, 1)}
+	z.watches[kind+path] = append(z.watches[kind+path], w)
+	return w.ch
+}
+
+func (z *fakeZK) fire(kind string, path string, typ zk.EventType) {
+	for _, w := range z.watches[kind+path] {
+		w.ch <- zk.Event{Type: typ, Path: path}
+	}
+	delete(z.watches, kind+path)
+}
+
+func fakeZKParent(path string) (string, string) {
+	x := strings.LastIndex(path, "/")
+	if x == 0 {
+		return "/", path[1:]
+	}
+	return path[:x], path[x+1:]
+}
+
+// Applies operations atomically, returning the response to each. Must be
+// called with z.mu held.
+func (z *fakeZK) multiLocked(
+	id int64,
+	ops []interface{},
+) ([]zk.MultiResponse, error) {
+	// Apply the operations to a copy of the tree, which replaces the tree
+	// only if they all succeed
+	nodes := make(map[string]*fakeZNode, len(z.nodes))
+	for p, n := range z.nodes {
+		nodes[p] = n
+	}
+	cp := func(path string) *fakeZNode {
+		n := *nodes[path]
+		n.children = make(map[string]bool, len(n.children))
+		for c := range nodes[path].children {
+			n.children[c] = true
+		}
+		nodes[path] = &n
+		return &n
+	}
+	zxid := z.zxid + 1
+	type firing struct {
+		kind string
+		path string
+		typ  zk.EventType
+	}
+	fires := make([]firing, 0)
+	res := make([]zk.MultiResponse, len(ops))
+	fail := func(x int, err error) ([]zk.MultiResponse, error) {
+		res[x].Error = err
+		return res, err
+	}
+	checkVersion := func(path string, version int32) error {
+		n, found := nodes[path]
+		if !found {
+			return zk.ErrNoNode
+		}
+		if version != -1 && n.stat.Version != version {
+			return zk.ErrBadVersion
+		}
+		return nil
+	}
+	for x, op := range ops {
+		switch op := op.(type) {
+		case *zk.CreateRequest:
+			if _, found := nodes[op.Path]; found {
+				return fail(x, zk.ErrNodeExists)
+			}
+			dir, name := fakeZKParent(op.Path)
+			parent, found := nodes[dir]
+			if !found {
+				return fail(x, zk.ErrNoNode)
+			}
+			if parent.stat.EphemeralOwner != 0 {
+				return fail(x, zk.ErrNoChildrenForEphemerals)
+			}
+			parent = cp(dir)
+			parent.children[name] = true
+			parent.stat.NumChildren++
+			parent.stat.Cversion++
+			parent.stat.Pzxid = zxid
+			n := &fakeZNode{data: op.Data, children: map[string]bool{}}
+			n.stat = zk.Stat{
+				Czxid: zxid, Mzxid: zxid, Pzxid: zxid,
+				DataLength: int32(len(op.Data)),
+			}
+			if op.Flags&zk.FlagEphemeral != 0 {
+				n.stat.EphemeralOwner = id
+			}
+			nodes[op.Path] = n
+			res[x].String = op.Path
+			fires = append(fires,
+				firing{"exists", op.Path, zk.EventNodeCreated},
+				firing{"child", dir, zk.EventNodeChildrenChanged},
+			)
+		case *zk.SetDataRequest:
+			if err := checkVersion(op.Path, op.Version); err != nil {
+				return fail(x, err)
+			}
+			n := cp(op.Path)
+			n.data = op.Data
+			n.stat.Version++
+			n.stat.Mzxid = zxid
+			n.stat.DataLength = int32(len(op.Data))
+			stat := n.stat
+			res[x].Stat = &stat
+			fires = append(fires,
+				firing{"exists", op.Path, zk.EventNodeDataChanged},
+				firing{"data", op.Path, zk.EventNodeDataChanged},
+			)
+		case *zk.DeleteRequest:
+			if err := checkVersion(op.Path, op.Version); err != nil {
+				return fail(x, err)
+			}
+			if len(nodes[op.Path].children) > 0 {
+				return fail(x, zk.ErrNotEmpty)
+			}
+			delete(nodes, op.Path)
+			dir, name := fakeZKParent(op.Path)
+			parent := cp(dir)
+			delete(parent.children, name)
+			parent.stat.NumChildren--
+			parent.stat.Cversion++
+			parent.stat.Pzxid = zxid
+			fires = append(fires,
+				firing{"exists", op.Path, zk.EventNodeDeleted},
+				firing{"data", op.Path, zk.EventNodeDeleted},
+				firing{"child", op.Path, zk.EventNodeDeleted},
+				firing{"child", dir, zk.EventNodeChildrenChanged},
+			)
+		case *zk.CheckVersionRequest:
+			if err := checkVersion(op.Path, op.Version); err != nil {
+				return fail(x, err)
+			}
+		}
+	}
+	z.zxid = zxid
+	z.nodes = nodes
+	for _, f := range fires {
+		z.fire(f.kind, f.path, f.typ)
+	}
+	return res, nil
+}
+
+// fakeZKConn is a client session with a fakeZK.
+type fakeZKConn struct {
+	z      *fakeZK
+	id     int64
+	events chan zk.Event
+}
+
+// Must be called with c.z.mu held.
+func (c *fakeZKConn) liveLocked() error {
+	if _, found := c.z.sessions[c.id]; !found {
+		return zk.ErrSessionExpired
+	}
+	return nil
+}
+
+func (c *fakeZKConn) read(path string) (*fakeZNode, error) {
+	if err := c.liveLocked(); err != nil {
+		return nil, err
+	}
+	n, found := c.z.nodes[path]
+	if !found {
+		return nil, zk.ErrNoNode
+	}
+	return n, nil
+}
+
+func (c *fakeZKConn) Get(path string) ([]byte, *zk.Stat, error) {
+	c.z.mu.Lock()
+	defer c.z.mu.Unlock()
+	n, err := c.read(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	stat := n.stat
+	return append([]byte(nil), n.data...), &stat, nil
+}
+
+func (c *fakeZKConn) GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	c.z.mu.Lock()
+	defer c.z.mu.Unlock()
+	n, err := c.read(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	stat := n.stat
+	ch := c.z.watch(c.id, "data", path)
+	return append([]byte(nil), n.data...), &stat, ch, nil
+}
+
+func (c *fakeZKConn) Children(path string) ([]string, *zk.Stat, error) {
+	c.z.mu.Lock()
+	defer c.z.mu.Unlock()
+	n, err := c.read(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	names := make([]string, 0, len(n.children))
+	for name := range n.children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	stat := n.stat
+	return names, &stat, nil
+}
+
+func (c *fakeZKConn) ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	names, stat, err := c.Children(path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	c.z.mu.Lock()
+	defer c.z.mu.Unlock()
+	return names, stat, c.z.watch(c.id, "child", path), nil
+}
+
+func (c *fakeZKConn) Exists(path string) (bool, *zk.Stat, error) {
+	c.z.mu.Lock()
+	defer c.z.mu.Unlock()
+	n, err := c.read(path)
+	if err == zk.ErrNoNode {
+		return false, nil, nil
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	stat := n.stat
+	return true, &stat, nil
+}
+
+func (c *fakeZKConn) ExistsW(path string) (bool, *zk.Stat, <-chan zk.Event, error) {
+	c.z.mu.Lock()
+	defer c.z.mu.Unlock()
+	n, err := c.read(path)
+	if err != nil && err != zk.ErrNoNode {
+		return false, nil, nil, err
+	}
+	ch := c.z.watch(c.id, "exists", path)
+	if n == nil {
+		return false, nil, ch, nil
+	}
+	stat := n.stat
+	return true, &stat, ch, nil
+}
+
+func (c *fakeZKConn) Create(
+	path string,
+	data []byte,
+	flags int32,
+	acl []zk.ACL,
+) (string, error) {
+	res, err := c.Multi(&zk.CreateRequest{
+		Path: path, Data: data, Flags: flags, Acl: acl,
+	})
+	if err != nil {
+		return "", err
+	}
+	return res[0].String, nil
+}
+
+func (c *fakeZKConn) Multi(ops ...interface{}) ([]zk.MultiResponse, error) {
+	c.z.mu.Lock()
+	defer c.z.mu.Unlock()
+	if err := c.liveLocked(); err != nil {
+		return nil, err
+	}
+	return c.z.multiLocked(c.id, ops)
+}
+
+func (c *fakeZKConn) SessionID() int64 {
+	return c.id
+}
+
+func (c *fakeZKConn) Close() {
+	c.z.mu.Lock()
+	defer c.z.mu.Unlock()
+	c.z.endLocked(c.id)
+}
+
+func newTestZKBackend(t *testing.T, z *fakeZK) *zkBackend {
+	cfg := &Config{LeaseSeconds: 60, EtcdConnectTimeoutSeconds: time.Second}
+	b, err := newZKBackend([]string{"fake:2181"}, cfg, z.dial)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	return b
+}
+
+func TestZKBackendConditions(t *testing.T) {
+	z := newFakeZK()
+	b := newTestZKBackend(t, z)
+	defer b.Close()
+	ctx := context.Background()
+
+	create := &PutOptions{
+		If: []Condition{{Key: "k/a", Target: CompareVersion, Op: "=", Value: 0}},
+	}
+	rev, err := b.Put(ctx, "k/a", []byte("v1"), create)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if _, err = b.Put(ctx, "k/a", []byte("v2"), create); err != ErrCompareFailed {
+		t.Fatalf("Expected ErrCompareFailed, but got %v.", err)
+	}
+	update := &PutOptions{
+		If: []Condition{
+			{Key: "k/a", Target: CompareModRevision, Op: "=", Value: rev},
+		},
+	}
+	rev2, err := b.Put(ctx, "k/a", []byte("v2"), update)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if rev2 <= rev {
+		t.Fatalf("Expected revision greater than %d, but got %d.", rev, rev2)
+	}
+	if _, err = b.Put(ctx, "k/a", []byte("v3"), update); err != ErrCompareFailed {
+		t.Fatalf("Expected ErrCompareFailed, but got %v.", err)
+	}
+
+	resp, err := b.Get(ctx, "k/a", nil)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	kv := resp.KVs[0]
+	if string(kv.Value) != "v2" || kv.Version != 2 || kv.CreateRevision != rev {
+		t.Fatalf("Expected v2 at version 2 created at %d, but got %+v.",
+			rev, kv)
+	}
+	if _, err = b.Get(ctx, "k/a", &GetOptions{Revision: rev}); err != ErrCompacted {
+		t.Fatalf("Expected ErrCompacted, but got %v.", err)
+	}
+
+	// Keys can have keys beneath them, and parents that are not keys are
+	// not reported
+	b.Put(ctx, "k/a/b", []byte("nested"), nil)
+	b.Put(ctx, "k/x/y/z", []byte("deep"), nil)
+	b.Put(ctx, "kz", []byte("sibling"), nil)
+	resp, err = b.Get(ctx, "k/", &GetOptions{Prefix: true})
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	keys := make([]string, len(resp.KVs))
+	for x, kv := range resp.KVs {
+		keys[x] = kv.Key
+	}
+	if strings.Join(keys, ",") != "k/a,k/a/b,k/x/y/z" {
+		t.Fatalf("Expected k/a, k/a/b and k/x/y/z, but got %v.", keys)
+	}
+
+	// Deleting a key with keys beneath it leaves them in place
+	n, err := b.Delete(ctx, "k/a", nil)
+	if err != nil || n != 1 {
+		t.Fatalf("Expected 1 key deleted, but got %d and %v.", n, err)
+	}
+	resp, _ = b.Get(ctx, "k/a", &GetOptions{Prefix: true})
+	if len(resp.KVs) != 1 || resp.KVs[0].Key != "k/a/b" {
+		t.Fatalf("Expected only k/a/b, but got %v.", resp.KVs)
+	}
+	n, err = b.Delete(ctx, "k/", &DeleteOptions{Prefix: true})
+	if err != nil || n != 2 {
+		t.Fatalf("Expected 2 keys deleted, but got %d and %v.", n, err)
+	}
+	resp, _ = b.Get(ctx, "k", &GetOptions{Prefix: true})
+	if len(resp.KVs) != 1 || resp.KVs[0].Key != "kz" {
+		t.Fatalf("Expected only kz, but got %v.", resp.KVs)
+	}
+}
+
+func TestZKBackendLeases(t *testing.T) {
+	z := newFakeZK()
+	b := newTestZKBackend(t, z)
+	defer b.Close()
+	ctx := context.Background()
+
+	if _, err := b.Grant(ctx, 0); err != ErrInvalidTTL {
+		t.Fatalf("Expected ErrInvalidTTL, but got %v.", err)
+	}
+	lease, err := b.Grant(ctx, 10)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if _, err = b.Put(ctx, "a/1", nil, &PutOptions{Lease: lease}); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	if _, err = b.Put(ctx, "a/2", nil, nil); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	resp, _ := b.Get(ctx, "a/1", nil)
+	if len(resp.KVs) != 1 || resp.KVs[0].Lease != lease {
+		t.Fatalf("Expected a/1 attached to %d, but got %v.", lease, resp.KVs)
+	}
+	if _, _, err = b.TimeToLive(ctx, lease); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	// Moving a key to a lease replaces its znode with an ephemeral one
+	if _, err = b.Put(ctx, "a/2", []byte("x"), &PutOptions{Lease: lease}); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	resp, _ = b.Get(ctx, "a/2", nil)
+	if resp.KVs[0].Lease != lease || string(resp.KVs[0].Value) != "x" {
+		t.Fatalf("Expected a/2=x attached to %d, but got %+v.",
+			lease, resp.KVs[0])
+	}
+
+	kactx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	ka, err := b.KeepAlive(kactx, lease)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+
+	// When the session expires, its keys go with it and keepalives stop
+	z.expire(int64(lease))
+	select {
+	case <-ka:
+		for range ka {
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for the keepalive to stop.")
+	}
+	resp, _ = b.Get(ctx, "a/", &GetOptions{Prefix: true})
+	if len(resp.KVs) != 0 {
+		t.Fatalf("Expected no keys, but got %v.", resp.KVs)
+	}
+	if _, _, err = b.TimeToLive(ctx, lease); err != ErrLeaseNotFound {
+		t.Fatalf("Expected ErrLeaseNotFound, but got %v.", err)
+	}
+
+	lease, err = b.Grant(ctx, 10)
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	b.Put(ctx, "a/3", nil, &PutOptions{Lease: lease})
+	if err = b.Revoke(ctx, lease); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	resp, _ = b.Get(ctx, "a/3", nil)
+	if len(resp.KVs) != 0 {
+		t.Fatalf("Expected a/3 to be deleted, but got %v.", resp.KVs)
+	}
+}
+
+func TestZKBackendWatch(t *testing.T) {
+	z := newFakeZK()
+	b := newTestZKBackend(t, z)
+	defer b.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b.Put(ctx, "w/1", []byte("a"), nil)
+	resp, _ := b.Get(ctx, "w/", &GetOptions{Prefix: true})
+
+	wch := b.Watch(ctx, "w/", &WatchOptions{
+		Prefix:   true,
+		Revision: resp.Revision + 1,
+	})
+	expect := func(typ KVEventType, key string) {
+		select {
+		case resp := <-wch:
+			if resp.Err != nil {
+				t.Fatalf("Expected nil, but got %v.", resp.Err)
+			}
+			ev := resp.Events[0]
+			if ev.Type != typ || ev.KV.Key != key {
+				t.Fatalf("Expected %v of %s, but got %v of %s.",
+					typ, key, ev.Type, ev.KV.Key)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for watch event")
+		}
+	}
+	b.Put(ctx, "other", []byte("b"), nil)
+	b.Put(ctx, "w/2/deep", []byte("c"), nil)
+	expect(KVPut, "w/2/deep")
+	b.Put(ctx, "w/1", []byte("d"), nil)
+	expect(KVPut, "w/1")
+	b.Delete(ctx, "w/1", nil)
+	expect(KVDelete, "w/1")
+
+	// Changes made before the watch started cannot be replayed
+	wch = b.Watch(ctx, "w/", &WatchOptions{
+		Prefix:   true,
+		Revision: resp.Revision + 1,
+	})
+	select {
+	case resp := <-wch:
+		if resp.Err != ErrCompacted {
+			t.Fatalf("Expected ErrCompacted, but got %v.", resp.Err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Timed out waiting for watch error")
+	}
+}
+
+func TestZKBackendRegistry(t *testing.T) {
+	z := newFakeZK()
+	defer func(orig zkDialer) { zkDial = orig }(zkDial)
+	zkDial = z.dial
+
+	orig, found := os.LookupEnv("GSR_BACKEND")
+	if !found {
+		defer os.Unsetenv("GSR_BACKEND")
+	} else {
+		defer os.Setenv("GSR_BACKEND", orig)
+	}
+	os.Setenv("GSR_BACKEND", "zk://fake:2181")
+
+	r, err := New()
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer r.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events := r.Watch(ctx, "web", nil)
+	expect := func(typ EventType, addr string) {
+		select {
+		case ev := <-events:
+			if ev.Type != typ || ev.Endpoint.Address != addr {
+				t.Fatalf("Expected %s of %s, but got %s of %s.",
+					typ, addr, ev.Type, ev.Endpoint.Address)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %s of %s.", typ, addr)
+		}
+	}
+
+	ep := Endpoint{Service: &Service{Name: "web"}, Address: "127.0.0.1:8080"}
+	if err = r.Register(&ep); err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	expect(EventCreated, ep.Address)
+
+	// A second registry sharing the ensemble sees the endpoint
+	r2, err := New()
+	if err != nil {
+		t.Fatalf("Expected nil, but got %v.", err)
+	}
+	defer r2.Close()
+	eps := r2.Endpoints("web")
+	if len(eps) != 1 || eps[0].Address != ep.Address {
+		t.Fatalf("Expected %s, but got %v.", ep.Address, eps)
+	}
+
+	// The endpoint is an ephemeral znode, so it goes away with the session
+	// of the registry that registered it, which registers it again under a
+	// new session
+	lease := int64(r.session.lease)
+	z.expire(lease)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		eps = r2.Endpoints("web")
+		if len(eps) == 1 && eps[0].Owner.Lease != lease {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s to be registered again, but got %v.",
+				ep.Address, eps)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}